@@ -36,5 +36,6 @@ require (
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/orcaman/concurrent-map v1.0.0
 	github.com/root-gg/gopentsdb v0.0.0-20150818092623-8733e50b82e2
+	golang.org/x/crypto v0.36.0
 	modernc.org/sqlite v1.31.1
 )
@@ -6,7 +6,11 @@
 // +build ignore
 
 // Generate a self-signed X.509 certificate for a TLS server. Outputs to
-// 'cert.pem' and 'key.pem' and will overwrite existing files.
+// 'wigo.crt' and 'wigo.key' and will overwrite existing files.
+//
+// With a command as first argument it manages a small PKI in a directory :
+// a CA, server certificates for the http and push listeners, client
+// certificates, their renewal and revocation. See usage below.
 
 package main
 
@@ -22,7 +26,10 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -35,6 +42,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		pki(os.Args[1], os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if len(*host) == 0 {
@@ -114,3 +126,387 @@ func main() {
 	keyOut.Close()
 	log.Print("written wigo.key\n")
 }
+
+// PKI
+
+const pkiUsage = `Usage:
+  generate_cert ca      --dir <dir> [--cn <name>] [--duration <d>] [--rsa-bits <n>] [--force]
+  generate_cert server  --dir <dir> --name <name> --host <hosts> [--push] [--duration <d>] [--rsa-bits <n>]
+  generate_cert client  --dir <dir> --name <name> [--duration <d>] [--rsa-bits <n>]
+  generate_cert renew   --dir <dir> --name <name> [--days <n>] [--duration <d>] [--force]
+  generate_cert revoke  --dir <dir> (--name <name> | --serial <hex>)
+  generate_cert crl     --dir <dir> [--duration <d>]
+  generate_cert list    --dir <dir> [--days <n>] [<certificate file>...]
+
+Files are written to <dir> : ca.crt and ca.key for the CA, <name>.crt and
+<name>.key for the certificates it issues, revoked for the revoked serials
+and ca.crl for the certificate revocation list.
+
+Server certificates are valid for the comma-separated hostnames and IPs of
+--host. With --push the certificate may sign the uuids and the client
+certificates of push clients, use it as the [PushServer] SslCert.
+
+Renew issues a new certificate with the same key, subject and hostnames when
+the certificate expires within --days days. Renewing "ca" keeps the CA key so
+the certificates it issued stay valid.
+`
+
+func pki(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, pkiUsage) }
+
+	dir := flags.String("dir", ".", "PKI directory")
+	name := flags.String("name", "", "Certificate name")
+	cn := flags.String("cn", "wigo CA", "CA common name")
+	hosts := flags.String("host", "", "Comma-separated hostnames and IPs")
+	push := flags.Bool("push", false, "Server certificate of a push server")
+	duration := flags.Duration("duration", 0, "Validity")
+	bits := flags.Int("rsa-bits", 4096, "Size of RSA key to generate")
+	days := flags.Int("days", 30, "Renew or warn when expiring within days")
+	serial := flags.String("serial", "", "Serial to revoke, in hexadecimal")
+	force := flags.Bool("force", false, "Overwrite the CA, renew even if not expiring")
+	flags.Parse(args)
+
+	switch command {
+	case "ca":
+		pkiCA(*dir, *cn, pkiDuration(*duration, 10*365*24*time.Hour), *bits, *force)
+	case "server":
+		if *name == "" || *hosts == "" {
+			log.Fatal("Missing required --name or --host parameter")
+		}
+		pkiServer(*dir, *name, *hosts, *push, pkiDuration(*duration, 365*24*time.Hour), *bits)
+	case "client":
+		if *name == "" {
+			log.Fatal("Missing required --name parameter")
+		}
+		pkiClient(*dir, *name, pkiDuration(*duration, 365*24*time.Hour), *bits)
+	case "renew":
+		if *name == "" {
+			log.Fatal("Missing required --name parameter")
+		}
+		pkiRenew(*dir, *name, *days, *duration, *force)
+	case "revoke":
+		pkiRevoke(*dir, *name, *serial)
+	case "crl":
+		pkiCrl(*dir, pkiDuration(*duration, 7*24*time.Hour))
+	case "list":
+		pkiList(*dir, *days, flags.Args())
+	default:
+		fmt.Fprint(os.Stderr, pkiUsage)
+		os.Exit(1)
+	}
+}
+
+func pkiDuration(duration time.Duration, defaultDuration time.Duration) time.Duration {
+	if duration <= 0 {
+		return defaultDuration
+	}
+	return duration
+}
+
+func pkiCA(dir string, cn string, duration time.Duration, bits int, force bool) {
+	if _, err := os.Stat(filepath.Join(dir, "ca.crt")); err == nil && !force {
+		log.Fatalf("%s already exists, use --force to overwrite it", filepath.Join(dir, "ca.crt"))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Failed to create %s : %s", dir, err)
+	}
+
+	key := pkiNewKey(bits)
+	template := &x509.Certificate{
+		SerialNumber:          pkiNewSerial(),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"wigo@root.gg"}},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(duration),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatalf("Failed to create certificate : %s", err)
+	}
+	pkiWriteKey(filepath.Join(dir, "ca.key"), key)
+	pkiWriteCertificate(filepath.Join(dir, "ca.crt"), der)
+}
+
+func pkiServer(dir string, name string, hosts string, push bool, duration time.Duration, bits int) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: strings.Split(hosts, ",")[0], Organization: []string{"wigo@root.gg"}},
+		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	// The push server signs the client certificates with it
+	if push {
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	pkiIssue(dir, name, template, pkiNewKey(bits), duration)
+}
+
+func pkiClient(dir string, name string, duration time.Duration, bits int) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"wigo@root.gg"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	pkiIssue(dir, name, template, pkiNewKey(bits), duration)
+}
+
+func pkiRenew(dir string, name string, days int, duration time.Duration, force bool) {
+	certificate := pkiLoadCertificate(filepath.Join(dir, name+".crt"))
+	if !force && time.Until(certificate.NotAfter) > time.Duration(days)*24*time.Hour {
+		log.Printf("%s expires on %s, not renewing", name, certificate.NotAfter.Format("2006-01-02"))
+		return
+	}
+	if duration <= 0 {
+		duration = certificate.NotAfter.Sub(certificate.NotBefore)
+	}
+	key := pkiLoadKey(filepath.Join(dir, name+".key"))
+
+	template := &x509.Certificate{
+		Subject:               certificate.Subject,
+		DNSNames:              certificate.DNSNames,
+		IPAddresses:           certificate.IPAddresses,
+		KeyUsage:              certificate.KeyUsage,
+		ExtKeyUsage:           certificate.ExtKeyUsage,
+		BasicConstraintsValid: certificate.BasicConstraintsValid,
+		IsCA:                  certificate.IsCA,
+	}
+
+	if name == "ca" {
+		template.SerialNumber = pkiNewSerial()
+		template.NotBefore = time.Now().Add(-5 * time.Minute)
+		template.NotAfter = time.Now().Add(duration)
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			log.Fatalf("Failed to create certificate : %s", err)
+		}
+		pkiWriteCertificate(filepath.Join(dir, "ca.crt"), der)
+		return
+	}
+
+	pkiIssue(dir, name, template, key, duration)
+}
+
+// Sign a certificate with the CA and write it with its key
+func pkiIssue(dir string, name string, template *x509.Certificate, key *rsa.PrivateKey, duration time.Duration) {
+	if name == "ca" || strings.ContainsAny(name, "/\\") {
+		log.Fatalf("Invalid certificate name %s", name)
+	}
+	ca, caKey := pkiLoadCA(dir)
+
+	template.SerialNumber = pkiNewSerial()
+	template.NotBefore = time.Now().Add(-5 * time.Minute)
+	template.NotAfter = time.Now().Add(duration)
+	if template.NotAfter.After(ca.NotAfter) {
+		log.Printf("Warning : the CA expires before the certificate, on %s", ca.NotAfter.Format("2006-01-02"))
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		log.Fatalf("Failed to create certificate : %s", err)
+	}
+	pkiWriteKey(filepath.Join(dir, name+".key"), key)
+	pkiWriteCertificate(filepath.Join(dir, name+".crt"), der)
+}
+
+func pkiRevoke(dir string, name string, serial string) {
+	if name != "" {
+		serial = pkiLoadCertificate(filepath.Join(dir, name+".crt")).SerialNumber.Text(16)
+	}
+	if _, ok := new(big.Int).SetString(serial, 16); !ok {
+		log.Fatal("Missing or invalid --name or --serial parameter")
+	}
+
+	revoked := pkiLoadRevoked(dir)
+	if _, ok := revoked[serial]; ok {
+		log.Printf("%s is already revoked", serial)
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "revoked"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatalf("Failed to open %s : %s", filepath.Join(dir, "revoked"), err)
+	}
+	defer f.Close()
+
+	// Format is "serial revocationtime"
+	fmt.Fprintf(f, "%s %d\n", serial, time.Now().Unix())
+	log.Printf("revoked %s, run generate_cert crl to update the revocation list", serial)
+}
+
+func pkiCrl(dir string, duration time.Duration) {
+	ca, caKey := pkiLoadCA(dir)
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().Unix()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(duration),
+	}
+	for serial, revoked := range pkiLoadRevoked(dir) {
+		number, _ := new(big.Int).SetString(serial, 16)
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   number,
+			RevocationTime: revoked,
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca, caKey)
+	if err != nil {
+		log.Fatalf("Failed to create revocation list : %s", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "ca.crl"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		log.Fatalf("Failed to write %s : %s", filepath.Join(dir, "ca.crl"), err)
+	}
+	log.Printf("written %s with %d revoked certificates", filepath.Join(dir, "ca.crl"), len(template.RevokedCertificateEntries))
+}
+
+// Print the certificates of the PKI and the given ones with their expiry dates
+func pkiList(dir string, days int, files []string) {
+	pkiFiles, _ := filepath.Glob(filepath.Join(dir, "*.crt"))
+	files = append(pkiFiles, files...)
+	revoked := pkiLoadRevoked(dir)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTYPE\tSUBJECT\tHOSTS\tSERIAL\tNOT AFTER\tDAYS LEFT\tSTATUS")
+	for _, file := range files {
+		certificate, err := pkiReadCertificate(file)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\t\t%s\n", file, err)
+			continue
+		}
+
+		kind := "server"
+		switch {
+		case certificate.IsCA && certificate.CheckSignatureFrom(certificate) == nil:
+			kind = "ca"
+		case certificate.IsCA:
+			kind = "push"
+		case len(certificate.ExtKeyUsage) == 1 && certificate.ExtKeyUsage[0] == x509.ExtKeyUsageClientAuth:
+			kind = "client"
+		}
+
+		hosts := certificate.DNSNames
+		for _, ip := range certificate.IPAddresses {
+			hosts = append(hosts, ip.String())
+		}
+
+		left := time.Until(certificate.NotAfter)
+		status := "ok"
+		if _, ok := revoked[certificate.SerialNumber.Text(16)]; ok {
+			status = "revoked"
+		} else if left < 0 {
+			status = "expired"
+		} else if left < time.Duration(days)*24*time.Hour {
+			status = "expiring"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", file, kind, certificate.Subject.CommonName, strings.Join(hosts, ","),
+			certificate.SerialNumber.Text(16), certificate.NotAfter.Format("2006-01-02"), int(left.Hours()/24), status)
+	}
+	w.Flush()
+}
+
+func pkiNewKey(bits int) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		log.Fatalf("failed to generate private key: %s", err)
+	}
+	return key
+}
+
+func pkiNewSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatalf("failed to generate serial number: %s", err)
+	}
+	return serial
+}
+
+func pkiLoadCA(dir string) (*x509.Certificate, *rsa.PrivateKey) {
+	return pkiLoadCertificate(filepath.Join(dir, "ca.crt")), pkiLoadKey(filepath.Join(dir, "ca.key"))
+}
+
+func pkiReadCertificate(file string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no pem certificate in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func pkiLoadCertificate(file string) *x509.Certificate {
+	certificate, err := pkiReadCertificate(file)
+	if err != nil {
+		log.Fatalf("Failed to load certificate %s : %s", file, err)
+	}
+	return certificate
+}
+
+func pkiLoadKey(file string) *rsa.PrivateKey {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Failed to load key %s : %s", file, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		log.Fatalf("No pem key in %s", file)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatalf("Failed to parse key %s : %s", file, err)
+	}
+	return key
+}
+
+// Revocation times by serial
+func pkiLoadRevoked(dir string) (revoked map[string]time.Time) {
+	revoked = make(map[string]time.Time)
+
+	content, err := os.ReadFile(filepath.Join(dir, "revoked"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if date, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			revoked[fields[0]] = time.Unix(date, 0)
+		}
+	}
+	return
+}
+
+func pkiWriteCertificate(file string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		log.Fatalf("failed to write %s : %s", file, err)
+	}
+	log.Printf("written %s\n", file)
+}
+
+func pkiWriteKey(file string, key *rsa.PrivateKey) {
+	content := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		log.Fatalf("failed to write %s : %s", file, err)
+	}
+	log.Printf("written %s\n", file)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"container/list"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,11 +14,11 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/codegangsta/martini"
-	"github.com/codegangsta/martini-contrib/auth"
 	"github.com/codegangsta/martini-contrib/gzip"
 	"github.com/codegangsta/martini-contrib/secure"
 	"github.com/root-gg/wigo/src/wigo"
@@ -45,18 +44,21 @@ func main() {
 		}()
 	}
 
+	// Probes run on demand, besides their interval
+	wigo.SetProbeRunner(runProbe)
+
 	// Launch goroutines
 	go threadWatch(wigo.Channels.ChanWatch)
 	go threadLocalChecks()
 	go threadCallbacks(wigo.Channels.ChanCallbacks)
-	go threadRemoteChecks(config.RemoteWigos.AdvancedList)
+	wigo.GetLocalWigo().GetRemotes().Start()
 
 	if config.Http.Enabled {
 		go threadHttp(config.Http)
 	}
 
 	if config.PushClient.Enabled {
-		go threadPush(config.PushClient)
+		wigo.GetLocalWigo().GetPushTargets().Start()
 	}
 
 	// Signals
@@ -70,7 +72,10 @@ func main() {
 			switch sig {
 			case syscall.SIGHUP:
 				log.Printf("Caught SIGHUP. Reloading logger filehandle and configuration file...\n")
-				wigo.GetLocalWigo().InitOrReloadLogger()
+				if _, err := wigo.GetLocalWigo().ReloadConfig(); err != nil {
+					log.Printf("Failed to reload configuration : %s", err)
+					wigo.GetLocalWigo().InitOrReloadLogger()
+				}
 			case syscall.SIGTERM:
 				os.Exit(0)
 			case os.Interrupt:
@@ -178,6 +183,8 @@ func threadLocalChecks() {
 								probeName := c.Value.(string)
 								if _, ok := wigo.GetLocalWigo().GetLocalHost().Probes.Get(probeName); ok {
 									wigo.GetLocalWigo().GetLocalHost().Probes.Remove(probeName)
+									wigo.GetLocalWigo().ProbeChanged(probeName)
+									wigo.GetLocalWigo().RecordProbeTransition(probeName, nil)
 								}
 							}
 
@@ -245,10 +252,13 @@ func threadLocalChecks() {
 						for c := currentProbesList.Front(); c != nil; c = c.Next() {
 							probeName := c.Value.(string)
 
-							if wigo.GetLocalWigo().IsProbeDisabled(probeName) {
-								log.Printf(" - Probe %s has been disabled earlier. Restart wigo to enable it again!", probeName)
-							} else {
+							if disabled := wigo.GetLocalWigo().GetDisabledProbe(probeName); disabled == nil {
+								go execProbe(directory+"/"+probeName, sleepTImeInt-1)
+							} else if wigo.GetLocalWigo().RetryDisabledProbe(probeName) {
+								log.Printf(" - Probe %s has been disabled by exit code 13, running it again to check if it can be enabled", probeName)
 								go execProbe(directory+"/"+probeName, sleepTImeInt-1)
+							} else {
+								log.Printf(" - Probe %s has been disabled by %s", probeName, disabled.DisabledBy)
 							}
 						}
 
@@ -269,22 +279,14 @@ func threadLocalChecks() {
 	}()
 }
 
-func threadRemoteChecks(remoteWigos []wigo.AdvancedRemoteWigoConfig) {
-	log.Println("Listing remoteWigos : ")
-
-	for _, host := range remoteWigos {
-		log.Printf(" -> Adding %s to the remote check list\n", host.Hostname)
-		go launchRemoteHostCheckRoutine(host)
-	}
-}
-
 func threadCallbacks(chanCallbacks chan wigo.INotification) {
-	httpEnabled := wigo.GetLocalWigo().GetConfig().Notifications.HttpEnabled
-	mailEnabled := wigo.GetLocalWigo().GetConfig().Notifications.EmailEnabled
-
 	for {
 		notification := <-chanCallbacks
 
+		// Settings may change when the configuration is reloaded
+		httpEnabled := wigo.GetLocalWigo().GetConfig().Notifications.HttpEnabled
+		mailEnabled := wigo.GetLocalWigo().GetConfig().Notifications.EmailEnabled
+
 		// Serialize notification
 		json, err := notification.ToJson()
 		if err != nil {
@@ -308,11 +310,48 @@ func threadCallbacks(chanCallbacks chan wigo.INotification) {
 	}
 }
 
-func execProbe(probePath string, timeOut int) {
+// Runs of a probe are serialized, on demand runs may overlap the periodic ones
+var probesLocks = make(map[string]*sync.Mutex)
+var probesLocksLocker sync.Mutex
+
+func lockProbe(probeName string) *sync.Mutex {
+	probesLocksLocker.Lock()
+	lock, ok := probesLocks[probeName]
+	if !ok {
+		lock = new(sync.Mutex)
+		probesLocks[probeName] = lock
+	}
+	probesLocksLocker.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// Run a probe at once and wait for its result, see wigo.RunProbe
+func runProbe(probeName string) (*wigo.ProbeResult, error) {
+	probePath, interval, err := wigo.FindProbe(probeName)
+	if err != nil {
+		log.Printf("Failed to run probe %s : %s", probeName, err)
+		return nil, err
+	}
+
+	if wigo.GetLocalWigo().IsProbeDisabled(probeName) {
+		log.Printf(" - Probe %s has been disabled earlier, not running it", probeName)
+		return nil, &wigo.ProbeDisabledError{Message: fmt.Sprintf("Probe %s is disabled", probeName)}
+	}
+
+	log.Printf("Running probe %s on demand", probeName)
+	return execProbe(probePath, interval-1)
+}
+
+// Run a probe and update its result, returns an error if it has no result
+func execProbe(probePath string, timeOut int) (*wigo.ProbeResult, error) {
 
 	// Get probe name
 	probeDirectory, probeName := path.Split(probePath)
 
+	defer lockProbe(probeName).Unlock()
+
 	// Create ProbeResult
 	var probeResult *wigo.ProbeResult
 
@@ -320,13 +359,13 @@ func execProbe(probePath string, timeOut int) {
 	fileInfo, err := os.Stat(probePath)
 	if err != nil {
 		log.Printf("Failed to stat probe %s : %s", probePath, err)
-		return
+		return nil, err
 	}
 
 	// Test if executable
 	if m := fileInfo.Mode(); m&0111 == 0 {
 		log.Printf(" - Probe %s is not executable (%s)", probePath, m.Perm().String())
-		return
+		return nil, fmt.Errorf("Probe %s is not executable (%s)", probeName, m.Perm().String())
 	}
 
 	// Create Command
@@ -339,14 +378,14 @@ func execProbe(probePath string, timeOut int) {
 	if err != nil {
 		probeResult = wigo.NewProbeResult(probeName, 500, -1, fmt.Sprintf("error getting stdout pipe: %s", err), "")
 		wigo.GetLocalWigo().GetLocalHost().AddOrUpdateProbe(probeResult)
-		return
+		return probeResult, nil
 	}
 
 	errPipe, err := cmd.StderrPipe()
 	if err != nil {
 		probeResult = wigo.NewProbeResult(probeName, 500, -1, fmt.Sprintf("error getting stderr pipe: %s", err), "")
 		wigo.GetLocalWigo().GetLocalHost().AddOrUpdateProbe(probeResult)
-		return
+		return probeResult, nil
 	}
 
 	combinedOutput := io.MultiReader(outputPipe, errPipe)
@@ -356,7 +395,7 @@ func execProbe(probePath string, timeOut int) {
 	if err != nil {
 		probeResult = wigo.NewProbeResult(probeName, 500, -1, fmt.Sprintf("error starting command: %s", err), "")
 		wigo.GetLocalWigo().GetLocalHost().AddOrUpdateProbe(probeResult)
-		return
+		return probeResult, nil
 	}
 
 	// Wait channel
@@ -375,10 +414,12 @@ func execProbe(probePath string, timeOut int) {
 	// Timeout or result ?
 	select {
 	case err := <-done:
-		if err != nil {
 
-			// Get exit code
-			exitCode := 1
+		// Get exit code
+		exitCode := 0
+
+		if err != nil {
+			exitCode = 1
 
 			if exiterr, ok := err.(*exec.ExitError); ok {
 				// The program has exited with an exit code != 0
@@ -391,22 +432,26 @@ func execProbe(probePath string, timeOut int) {
 					exitCode = status.ExitStatus()
 				}
 			}
+		}
 
+		// A probe disabled by exit code 13 can run again
+		if disabled := wigo.GetLocalWigo().GetDisabledProbe(probeName); disabled != nil && disabled.Automatic && exitCode != 13 {
+			wigo.GetLocalWigo().EnableProbe(probeName, fmt.Sprintf("exit code %d", exitCode))
+		}
+
+		if err != nil {
 			if exitCode == 12 {
 				log.Printf(" - Probe %s is disabled\n", probeName)
-				return
+				return nil, &wigo.ProbeDisabledError{Message: fmt.Sprintf("Probe %s is disabled by its configuration", probeName)}
 			}
 
 			if exitCode == 13 {
 				log.Printf(" - Probe %s responded with special exit code 13. Discarding result...\n", probeName)
 
-				// Disabling it
-				wigo.GetLocalWigo().DisableProbe(probeName)
+				// Disabling it, this removes its result
+				wigo.GetLocalWigo().DisableProbe(probeName, "The probe can't run on this host", wigo.DISABLED_BY_EXIT_CODE)
 
-				// Remove result if present
-				wigo.GetLocalWigo().GetLocalHost().DeleteProbeByName(probeName)
-
-				return
+				return nil, &wigo.ProbeDisabledError{Message: fmt.Sprintf("Probe %s can't run on this host, it has been disabled", probeName)}
 			}
 
 			// Create error probe
@@ -414,7 +459,7 @@ func execProbe(probePath string, timeOut int) {
 			wigo.GetLocalWigo().GetLocalHost().AddOrUpdateProbe(probeResult)
 
 			log.Printf(" - Probe %s in directory %s failed to exec : %s\n", probeResult.Name, probeDirectory, err)
-			return
+			return probeResult, nil
 
 		} else {
 			probeResult = wigo.NewProbeResultFromJson(probeName, commandOutput)
@@ -425,7 +470,7 @@ func execProbe(probePath string, timeOut int) {
 			if probeResult.Status > 100 {
 				log.Printf(" 	--> %s\n", probeResult.Message)
 			}
-			return
+			return probeResult, nil
 		}
 
 	case <-time.After(time.Second * time.Duration(timeOut)):
@@ -444,98 +489,7 @@ func execProbe(probePath string, timeOut int) {
 			log.Printf(" - Probe %s successfully killed\n", probeName)
 		}
 
-		return
-	}
-}
-
-func launchRemoteHostCheckRoutine(Hostname wigo.AdvancedRemoteWigoConfig) {
-
-	secondsToSleep := wigo.GetLocalWigo().GetConfig().RemoteWigos.CheckInterval
-	if Hostname.CheckInterval != 0 {
-		secondsToSleep = Hostname.CheckInterval
-	}
-
-	// Split host/port
-	host := Hostname.Hostname
-	if Hostname.Port != 0 {
-		host = Hostname.Hostname + ":" + strconv.Itoa(Hostname.Port)
-	} else {
-		host = Hostname.Hostname + ":" + strconv.Itoa(wigo.GetLocalWigo().GetConfig().Http.Port)
-	}
-
-	// Create vars
-	var resp *http.Response
-	var body []byte
-	var err error
-
-	// Create http client
-	client := http.Client{Timeout: time.Duration(time.Second)}
-
-	sslEnabled := wigo.GetLocalWigo().GetConfig().RemoteWigos.SslEnabled
-	if Hostname.SslEnabled {
-		sslEnabled = Hostname.SslEnabled
-	}
-
-	var protocol string
-	if sslEnabled {
-		protocol = "https://"
-	} else {
-		protocol = "http://"
-	}
-	url := protocol + host + "/api"
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Printf("RemoteHostCheckRoutine : Unable to build get request : %s ", err)
-		return
-	}
-
-	login := wigo.GetLocalWigo().GetConfig().RemoteWigos.Login
-	if Hostname.Login != "" {
-		login = Hostname.Login
-	}
-
-	password := wigo.GetLocalWigo().GetConfig().RemoteWigos.Password
-	if Hostname.Password != "" {
-		password = Hostname.Password
-	}
-
-	if login != "" && password != "" {
-		req.SetBasicAuth(login, password)
-	}
-
-	for {
-		for i := 1; i <= 3; i++ {
-			resp, err = client.Do(req)
-			if err != nil {
-				time.Sleep(time.Second)
-			} else {
-				body, _ = ioutil.ReadAll(resp.Body)
-				resp.Body.Close()
-				break
-			}
-		}
-
-		// Can't connect to remote wigo
-		if err != nil {
-			log.Printf("Can't connect to %s : %s", host, err)
-			time.Sleep(time.Second * time.Duration(secondsToSleep))
-			continue
-		}
-
-		// Instanciate object from remote return
-		wigoObj, err := wigo.NewWigoFromJson(body, Hostname.CheckRemotesDepth)
-		if err != nil {
-			log.Printf("Failed to parse return from host %s : %s\nReturn was : %s", host, err, body)
-			time.Sleep(time.Second * time.Duration(secondsToSleep))
-			continue
-		}
-
-		// Send it to main
-		wigo.GetLocalWigo().AddOrUpdateRemoteWigo(wigoObj)
-
-		// Sleep
-		time.Sleep(time.Second * time.Duration(secondsToSleep))
+		return probeResult, nil
 	}
 }
 
@@ -559,11 +513,11 @@ func threadHttp(config *wigo.HttpConfig) {
 	// Add some basic security checks
 	m.Use(secure.Secure(secure.Options{}))
 
-	// Http basic auth
+	// Http basic auth and api tokens
 	if config.Login != "" && config.Password != "" {
 		log.Println("Http server : basic auth enabled")
-		m.Use(auth.Basic(config.Login, config.Password))
 	}
+	m.Use(wigo.HttpAuthHandler)
 
 	// Serve static files
 	m.Use(martini.Static("public"))
@@ -572,36 +526,14 @@ func threadHttp(config *wigo.HttpConfig) {
 	m.Use(martini.Recovery())
 
 	// Define the routes.
+	r := wigo.NewHttpRouter()
 
-	r := martini.NewRouter()
-
-	r.Get("/api", func() (int, string) {
-		json, err := wigo.GetLocalWigo().ToJsonString()
-		if err != nil {
-			return 500, fmt.Sprintf("%s", err)
-		}
-		return 200, json
-	})
-
-	r.Get("/api/status", func() string { return strconv.Itoa((wigo.GetLocalWigo().GlobalStatus)) })
-	r.Get("/api/logs", wigo.HttpLogsHandler)
-	r.Get("/api/logs/indexes", wigo.HttpLogsIndexesHandler)
-	r.Get("/api/groups", wigo.HttpGroupsHandler)
-	r.Get("/api/groups/:group", wigo.HttpGroupsHandler)
-	r.Get("/api/groups/:group/logs", wigo.HttpLogsHandler)
-	r.Get("/api/groups/:group/probes/:probe/logs", wigo.HttpLogsHandler)
-	r.Get("/api/hosts", wigo.HttpRemotesHandler)
-	r.Get("/api/hosts/:hostname", wigo.HttpRemotesHandler)
-	r.Get("/api/hosts/:hostname/status", wigo.HttpRemotesStatusHandler)
-	r.Get("/api/hosts/:hostname/logs", wigo.HttpLogsHandler)
-	r.Get("/api/hosts/:hostname/probes", wigo.HttpRemotesProbesHandler)
-	r.Get("/api/hosts/:hostname/probes/:probe", wigo.HttpRemotesProbesHandler)
-	r.Get("/api/hosts/:hostname/probes/:probe/status", wigo.HttpRemotesProbesStatusHandler)
-	r.Get("/api/hosts/:hostname/probes/:probe/logs", wigo.HttpLogsHandler)
-	r.Get("/api/probes/:probe/logs", wigo.HttpLogsHandler)
-	r.Get("/api/authority/hosts", wigo.HttpAuthorityListHandler)
-	r.Post("/api/authority/hosts/:uuid/allow", wigo.HttpAuthorityAllowHandler)
-	r.Post("/api/authority/hosts/:uuid/revoke", wigo.HttpAuthorityRevokeHandler)
+	// Enforced by the tests, an incomplete documentation must not prevent wigo from running
+	if missing, err := wigo.CheckOpenApiRoutes(r.(martini.Routes)); err != nil {
+		log.Printf("Http server : invalid openapi specification : %s", err)
+	} else if len(missing) > 0 {
+		log.Printf("Http server : routes missing from openapi specification : %s", strings.Join(missing, ", "))
+	}
 
 	m.Use(func(c martini.Context, w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/api") {
@@ -615,55 +547,26 @@ func threadHttp(config *wigo.HttpConfig) {
 	if config.SslEnabled {
 		address := apiAddress + ":" + strconv.Itoa(apiPort)
 		log.Println("Http server : starting tls server @ " + address)
-		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS10}
+		tlsConfig, err := wigo.NewHttpServerTlsConfig(config)
+		if err != nil {
+			log.Fatalf("Http server : invalid tls configuration : %s", err)
+		}
+		if config.SslClientCa != "" {
+			log.Printf("Http server : verifying client certificates against %s", config.SslClientCa)
+		}
 		server := &http.Server{Addr: address, Handler: m, TLSConfig: tlsConfig}
-		err := server.ListenAndServeTLS(config.SslCert, config.SslKey)
+		err = server.ListenAndServeTLS(config.SslCert, config.SslKey)
 		if err != nil {
 			log.Fatalf("Failed to start http server : %s", err)
 		}
 	} else {
 		address := apiAddress + ":" + strconv.Itoa(apiPort)
+		if config.SslClientCa != "" {
+			log.Println("Http server : SslClientCa is ignored as ssl is disabled")
+		}
 		log.Println("Http server : starting plain http server @ " + address)
 		if err := http.ListenAndServe(address, m); err != nil {
 			log.Fatalf("Failed to start http server : %s", err)
 		}
 	}
 }
-
-func threadPush(config *wigo.PushClientConfig) {
-	var pushClient *wigo.PushClient
-	go func() {
-		for {
-			var err error
-
-			if pushClient == nil {
-				pushClient, err = wigo.NewPushClient(config)
-				if err == nil {
-					err = pushClient.Hello()
-					if err != nil {
-						pushClient.Close()
-						pushClient = nil
-						if err.Error() != "RECONNECT" {
-							time.Sleep(time.Duration(config.PushInterval) * time.Second)
-						}
-						continue
-					}
-				} else {
-					pushClient.Close()
-					pushClient = nil
-					if err.Error() != "RECONNECT" {
-						time.Sleep(time.Duration(config.PushInterval) * time.Second)
-					}
-					continue
-				}
-			}
-
-			time.Sleep(time.Duration(config.PushInterval) * time.Second)
-			err = pushClient.Update()
-			if err != nil {
-				pushClient.Close()
-				pushClient = nil
-			}
-		}
-	}()
-}
@@ -0,0 +1,121 @@
+package wigo
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Accept policies decide what happens to a client registering to the
+// push server for the first time. A policy matches on a regexp of the
+// client hostname, on the networks of the client address and on a
+// regexp of the client certificate subject, empty criteria match any
+// client. The first matching policy accepts, rejects or queues the
+// client for an admin. Without a matching policy AutoAcceptClients
+// decides between accepting and queuing.
+//
+// Registering clients have no certificate signed by the push server
+// yet, the subject is the one of a certificate signed by the
+// RegistrationClientCa bundle, like the ones of an existing PKI.
+
+// Accept policy actions
+const (
+	ACCEPT_POLICY_ACCEPT = "accept"
+	ACCEPT_POLICY_REJECT = "reject"
+	ACCEPT_POLICY_QUEUE  = "queue"
+)
+
+type AcceptPolicy struct {
+	Name   string
+	Action string
+
+	hostname    *regexp.Regexp
+	networks    []*net.IPNet
+	certSubject *regexp.Regexp
+}
+
+func NewAcceptPolicies(configs []AcceptPolicyConfig) (policies []*AcceptPolicy, err error) {
+	for i, config := range configs {
+		policy := &AcceptPolicy{Name: config.Name, Action: config.Action}
+		if policy.Name == "" {
+			policy.Name = "policy " + strconv.Itoa(i)
+		}
+
+		switch config.Action {
+		case ACCEPT_POLICY_ACCEPT, ACCEPT_POLICY_REJECT, ACCEPT_POLICY_QUEUE:
+		default:
+			return nil, fmt.Errorf("Invalid action %s for accept policy %s", config.Action, policy.Name)
+		}
+
+		if config.Hostname != "" {
+			if policy.hostname, err = regexp.Compile(config.Hostname); err != nil {
+				return nil, fmt.Errorf("Invalid hostname regexp for accept policy %s : %s", policy.Name, err)
+			}
+		}
+		if config.CertSubject != "" {
+			if policy.certSubject, err = regexp.Compile(config.CertSubject); err != nil {
+				return nil, fmt.Errorf("Invalid certificate subject regexp for accept policy %s : %s", policy.Name, err)
+			}
+		}
+
+		for _, network := range config.Networks {
+			// A single address is a network of one address
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network for accept policy %s : %s", policy.Name, err)
+			}
+			policy.networks = append(policy.networks, ipNet)
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return
+}
+
+func (this *AcceptPolicy) Match(hostname string, address net.IP, certSubject string) bool {
+	if this.hostname != nil && !this.hostname.MatchString(hostname) {
+		return false
+	}
+
+	if len(this.networks) > 0 {
+		if address == nil {
+			return false
+		}
+		found := false
+		for _, network := range this.networks {
+			if network.Contains(address) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if this.certSubject != nil && (certSubject == "" || !this.certSubject.MatchString(certSubject)) {
+		return false
+	}
+
+	return true
+}
+
+// The first policy matching a registering client, nil if none does
+func (this *Authority) MatchAcceptPolicy(hostname string, address net.IP, certSubject string) *AcceptPolicy {
+	for _, policy := range this.policies {
+		if policy.Match(hostname, address, certSubject) {
+			return policy
+		}
+	}
+	return nil
+}
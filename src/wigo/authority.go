@@ -11,8 +11,11 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"os"
 	"regexp"
+	"sync"
+	"time"
 
 	"fmt"
 
@@ -25,8 +28,9 @@ import (
 // the private key is used to sign the clients uuid
 // to allow the server to verify the clients identities.
 //
-// Allowed client are stored in an allowed list persisted
-// on the file system, so one can easily revoke clients.
+// Clients and the history of their approval are kept in
+// the authority store, see authority_store.go. The allowed
+// list of older versions is imported in the store.
 type Authority struct {
 	key        []byte
 	privateKey *rsa.PrivateKey
@@ -36,9 +40,25 @@ type Authority struct {
 
 	config *PushServerConfig
 
-	Waiting map[string]string
-	Allowed map[string]string
-	Tokens  map[string]string
+	store *AuthorityStore
+
+	// Tokens of the connected clients
+	tokensLocker *sync.Mutex
+	tokens       map[string]*SessionToken
+
+	// See accept_policies.go
+	policies []*AcceptPolicy
+
+	// Client certificates by serial, see enrollment.go
+	certLocker *sync.Mutex
+	Enrolled   map[string]*ClientCertificate
+	Revoked    map[string]*ClientCertificate
+
+	// See enrollment_tokens.go
+	EnrollmentTokens *EnrollmentTokens
+
+	// See push_peers.go
+	peers *PushPeers
 }
 
 func NewAuthority(config *PushServerConfig) (this *Authority) {
@@ -63,6 +83,12 @@ func NewAuthority(config *PushServerConfig) (this *Authority) {
 	if this.key, err = ioutil.ReadFile(this.config.SslKey); err == nil {
 		if block, _ := pem.Decode(this.key); block != nil {
 			if this.privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				// Also accept PKCS8 RSA keys
+				if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+					this.privateKey, _ = key.(*rsa.PrivateKey)
+				}
+			}
+			if this.privateKey == nil {
 				err = errors.New("Authority : Unable to read decode x509 private key")
 				log.Println(err)
 			}
@@ -75,24 +101,52 @@ func NewAuthority(config *PushServerConfig) (this *Authority) {
 		log.Println(err)
 	}
 
-	this.Waiting = make(map[string]string)
-	this.Allowed = make(map[string]string)
-	this.Tokens = make(map[string]string)
-	this.LoadAllowedList()
+	if this.store, err = NewAuthorityStore(LocalWigo.sqlLiteConn, LocalWigo.sqlLiteLock, LocalWigo.Uuid); err != nil {
+		log.Fatalf("Authority : %s", err)
+	}
+	this.store.replicate = this.replicate
+	this.importAllowedList()
+
+	this.tokensLocker = new(sync.Mutex)
+	this.tokens = make(map[string]*SessionToken)
+
+	if this.policies, err = NewAcceptPolicies(this.config.AcceptPolicies); err != nil {
+		log.Fatalf("Authority : %s", err)
+	}
+
+	this.certLocker = new(sync.Mutex)
+	this.Enrolled = this.loadClientCertificates(this.config.EnrolledClientsFile)
+	this.Revoked = this.loadClientCertificates(this.config.RevokedCertsFile)
+
+	this.EnrollmentTokens = NewEnrollmentTokens(this.config.EnrollmentTokensFile)
+	this.EnrollmentTokens.replicate = this.replicate
 
 	return
 }
 
+// Send a change to the push server peers
+func (this *Authority) replicate(kind string, value interface{}) {
+	if this.peers != nil {
+		this.peers.Broadcast(kind, value)
+	}
+}
+
 // Check is a given uuid is in the waiting list
 func (this *Authority) IsWaiting(uuid string) bool {
-	_, ok := this.Waiting[uuid]
-	return ok
+	return this.store.State(uuid) == CLIENT_WAITING
 }
 
 // Check is a given uuid is in the allowed list
 func (this *Authority) IsAllowed(uuid string) bool {
-	_, ok := this.Allowed[uuid]
-	return ok
+	return this.store.State(uuid) == CLIENT_ALLOWED
+}
+
+// Hostname of a known client
+func (this *Authority) GetHostname(uuid string) string {
+	if client, ok := this.store.Get(uuid); ok {
+		return client.Hostname
+	}
+	return ""
 }
 
 // Return the server certificate
@@ -100,129 +154,193 @@ func (this *Authority) GetServerCertificate() []byte {
 	return this.cert
 }
 
-// Add a client to the waiting list
-func (this *Authority) AddClientToWaitingList(uuid string, hostname string) (err error) {
-	if _, ok := this.Waiting[uuid]; !ok {
-		if len(this.Waiting) < this.config.MaxWaitingClients {
-			this.Waiting[uuid] = hostname
-			message := fmt.Sprintf("New client %s", hostname)
-			SendNotification(NewNotificationFromMessage(message))
-			log.Printf("Authority : %s", message)
-			LocalWigo.AddLog(LocalWigo, INFO, message)
-		} else {
-			err = errors.New("Authority : Too many wainting clients")
+// Add a client to the waiting list, recording the accept policy which
+// matched it if any. Nothing is done if it's already waiting or allowed.
+func (this *Authority) AddClientToWaitingList(uuid string, hostname string, address net.IP, policy string) (err error) {
+	_, err = this.store.Update(uuid, hostname, "registered", "", policy, func(client *AuthorityClient) error {
+		if client.State == CLIENT_WAITING || client.State == CLIENT_ALLOWED {
+			return errClientStateUnchanged
+		}
+		if this.store.count(CLIENT_WAITING) >= this.config.MaxWaitingClients {
+			return errors.New("Authority : Too many wainting clients")
 		}
+		client.State = CLIENT_WAITING
+		client.Hostname = hostname
+		client.Address = address.String()
+		client.Policy = policy
+		return nil
+	})
+	if err == errClientStateUnchanged {
+		this.store.Seen(uuid, address)
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
+	message := fmt.Sprintf("New client %s", hostname)
+	SendNotification(NewNotificationFromMessage(message))
+	log.Printf("Authority : %s", message)
+	LocalWigo.AddLog(LocalWigo, INFO, message)
 	return
 }
 
-// Load the allowed clients list from the file system
-// The file format is one "uuid hostname" per line,
-// every non matching line will be ignored
-func (this *Authority) LoadAllowedList() (err error) {
-	if _, err = os.Stat(this.config.AllowedClientsFile); err == nil {
-		file, err := os.Open(this.config.AllowedClientsFile)
-		if err != nil {
-			log.Fatalf("Authority : Error opening allowed clients file %s", err)
+// Reject a client matching a reject accept policy. Rejected clients
+// are recorded up to MaxWaitingClients, like waiting ones.
+func (this *Authority) RejectClient(uuid string, hostname string, address net.IP, policy string) (err error) {
+	_, err = this.store.Update(uuid, hostname, "rejected", "accept policy "+policy, "", func(client *AuthorityClient) error {
+		if client.State == CLIENT_REJECTED && client.Policy == policy {
+			return errClientStateUnchanged
+		}
+		if client.State != CLIENT_REJECTED && this.store.count(CLIENT_REJECTED) >= this.config.MaxWaitingClients {
+			return errors.New("Authority : Too many rejected clients")
 		}
-		defer file.Close()
+		client.State = CLIENT_REJECTED
+		client.Hostname = hostname
+		client.Address = address.String()
+		client.Policy = policy
+		return nil
+	})
+	if err == errClientStateUnchanged {
+		this.store.Seen(uuid, address)
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-		// Format is 7ebd737f-e424-4fd5-77d0-24205f651111 Hostname
-		re, err := regexp.Compile(`([[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}) (.+)`)
-		if err != nil {
-			log.Fatalf("Authority : Invalid allowed client list regexp %s", err)
+	message := fmt.Sprintf("%s (%s) rejected by accept policy %s", hostname, address, policy)
+	log.Printf("Authority : %s", message)
+	LocalWigo.AddLog(LocalWigo, WARNING, message)
+	return
+}
+
+// Import the allowed clients list of older versions. The file format
+// is one "uuid hostname" per line, every non matching line is ignored.
+func (this *Authority) importAllowedList() {
+	file, err := os.Open(this.config.AllowedClientsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Authority : Error opening allowed clients file %s", err)
 		}
+		return
+	}
+	defer file.Close()
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
+	// Format is 7ebd737f-e424-4fd5-77d0-24205f651111 Hostname
+	re, err := regexp.Compile(`([[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}) (.+)`)
+	if err != nil {
+		log.Fatalf("Authority : Invalid allowed client list regexp %s", err)
+	}
 
-			line := scanner.Text()
-			result := re.FindStringSubmatch(line)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
 
-			if len(result) != 3 {
-				log.Printf("Authority : Ignoring invalid allowed client line %s", line)
-				continue
-			}
+		line := scanner.Text()
+		result := re.FindStringSubmatch(line)
 
-			// Verify the uuid validity
-			uuid, err := uuid.ParseHex(result[1])
-			if err != nil {
-				log.Fatalf("Authority : Unable to parse allowed client uuid %s : %s", result[1], err)
-			}
+		if len(result) != 3 {
+			log.Printf("Authority : Ignoring invalid allowed client line %s", line)
+			continue
+		}
 
-			this.Allowed[uuid.String()] = result[2]
+		// Verify the uuid validity
+		uuid, err := uuid.ParseHex(result[1])
+		if err != nil {
+			log.Fatalf("Authority : Unable to parse allowed client uuid %s : %s", result[1], err)
 		}
 
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Authority : Error while loading allowed clients file %s", err)
+		_, err = this.store.Update(uuid.String(), result[2], "imported", "", this.config.AllowedClientsFile, func(client *AuthorityClient) error {
+			if client.State != "" {
+				return errClientStateUnchanged
+			}
+			client.State = CLIENT_ALLOWED
+			client.Approved = client.FirstSeen
+			return nil
+		})
+		if err != nil && err != errClientStateUnchanged {
+			log.Fatalf("Authority : Unable to import allowed client %s : %s", result[1], err)
 		}
 	}
-	return
-}
 
-// Persist the allowed clients list on the file system
-// The file format is one "uuid hostname" per line,
-// every non matching line will be ignored
-func (this *Authority) SaveAllowedList() (err error) {
-	allowedClientsFile, err := os.OpenFile(this.config.AllowedClientsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err == nil {
-		defer allowedClientsFile.Close()
-		for uuid, hostname := range this.Allowed {
-			allowedClientsFile.Write([]byte(uuid + " " + hostname + "\n"))
-		}
-	} else {
-		log.Fatalf("Authority : Failed to create uuid file : %s", err)
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Authority : Error while loading allowed clients file %s", err)
 	}
-	return
+
+	file.Close()
+	if err := os.Rename(this.config.AllowedClientsFile, this.config.AllowedClientsFile+".imported"); err != nil {
+		log.Fatalf("Authority : Unable to rename imported allowed clients file : %s", err)
+	}
+	log.Printf("Authority : Allowed clients imported from %s", this.config.AllowedClientsFile)
 }
 
 // Add a client to the allowed list. The client have to be
-// in the waiting list. // TODO remove this limitation
-func (this *Authority) AllowClient(uuid string) (err error) {
-	if hostname, ok := this.Waiting[uuid]; ok {
-		delete(this.Waiting, uuid)
-		this.Allowed[uuid] = hostname
-		if err := this.SaveAllowedList(); err != nil {
-			// Fatal ?
-			log.Println(err)
+// known, waiting for approval, rejected or revoked.
+func (this *Authority) AllowClient(uuid string, approver string) (err error) {
+	client, err := this.store.Update(uuid, "", "allowed", approver, "", func(client *AuthorityClient) error {
+		if client.State == "" {
+			return errors.New("Authority : Invalid uuid " + uuid)
 		}
-		message := hostname + " added to allowed list"
-		log.Printf("Authority : %s", message)
-		LocalWigo.AddLog(LocalWigo, INFO, message)
-	} else {
-		err = errors.New("Authority : Invalid uuid " + uuid)
+		if client.State == CLIENT_ALLOWED {
+			return errors.New("Authority : " + client.Hostname + " is already allowed")
+		}
+		client.State = CLIENT_ALLOWED
+		client.Approver = approver
+		client.Approved = time.Now().Unix()
+		client.Revoked = 0
+		client.RevocationReason = ""
+		return nil
+	})
+	if err != nil {
+		return
 	}
+
+	message := client.Hostname + " added to allowed list by " + approver
+	log.Printf("Authority : %s", message)
+	LocalWigo.AddLog(LocalWigo, INFO, message)
 	return
 }
 
-// Remove a client from the allowed list, revoke tokens if any and
-// remove client data.
+// Revoke a client, its certificate and tokens, and remove its data.
 // TODO The dedup data in gopentsdb are leaked.
-func (this *Authority) RevokeClient(uuid string) (err error) {
-	if hostname, ok := this.Waiting[uuid]; ok {
-		delete(this.Waiting, uuid)
-		log.Println("Authority : " + hostname + " removed from waiting list")
+func (this *Authority) RevokeClient(uuid string, actor string, reason string) (err error) {
+	client, ok := this.store.Get(uuid)
+	if !ok {
+		return errors.New("Authority : Invalid uuid " + uuid)
 	}
-	if hostname, ok := this.Allowed[uuid]; ok {
-		delete(this.Allowed, uuid)
-		if err := this.SaveAllowedList(); err != nil {
-			// Fatal ?
-			log.Println(err)
+
+	if client.State != CLIENT_REVOKED {
+		_, err = this.store.Update(uuid, "", "revoked", actor, reason, func(client *AuthorityClient) error {
+			client.State = CLIENT_REVOKED
+			client.Revoked = time.Now().Unix()
+			client.RevocationReason = reason
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		message := client.Hostname + " revoked by " + actor
+		if reason != "" {
+			message += " : " + reason
 		}
-		message := hostname + " removed from the allowed list"
 		log.Printf("Authority : %s", message)
 		LocalWigo.AddLog(LocalWigo, INFO, message)
 	}
-	for token, u := range this.Tokens {
-		if uuid == u {
-			delete(this.Tokens, token)
-			log.Println("Authority : token " + token + " revoked")
-		}
+
+	this.RevokeClientCertificate(uuid)
+	if err := this.EnrollmentTokens.SetGroup(uuid, ""); err != nil {
+		log.Printf("Authority : %s", err)
 	}
+
+	this.RevokeTokens(uuid)
+
 	if tmp, ok := LocalWigo.RemoteWigos.Get(uuid); ok {
 		wigo := tmp.(*Wigo)
 		LocalWigo.RemoteWigos.Remove(uuid)
+		LocalWigo.RemoteWigoChanged(uuid)
 		log.Println("Authority : " + wigo.Hostname + " removed")
 	}
 	return
@@ -250,16 +368,32 @@ func (this *Authority) VerifyUuidSignature(uuid string, uuidSignature []byte) (e
 	return
 }
 
-// Generate a token to use as a proof of identity for all subsequent requests
-func (this *Authority) GetToken(clientUuid string) (token string, err error) {
+// Session tokens prove the identity of a client for all the requests
+// following Hello. A token is bound to the connection it has been
+// issued on and expires after SessionTokenTtl seconds, clients
+// refresh it before it expires. Refreshing rotates the token.
+type SessionToken struct {
+	Uuid    string
+	Expires time.Time
+
+	// Id of the push session the token has been issued to
+	session string
+}
+
+// Generate a token to use as a proof of identity for all subsequent
+// requests of a push session. Previous tokens of the client are revoked.
+func (this *Authority) GetToken(clientUuid string, session string) (token string, err error) {
 	if t, err := uuid.NewV4(); err == nil {
 		token = t.String()
-		for t, u := range this.Tokens {
-			if clientUuid == u {
-				delete(this.Tokens, t)
+
+		this.tokensLocker.Lock()
+		for t, sessionToken := range this.tokens {
+			if clientUuid == sessionToken.Uuid || sessionToken.expired() {
+				delete(this.tokens, t)
 			}
 		}
-		this.Tokens[token] = clientUuid
+		this.tokens[token] = &SessionToken{Uuid: clientUuid, Expires: this.tokenExpiration(), session: session}
+		this.tokensLocker.Unlock()
 	} else {
 		err = errors.New("Authority : Unable to generate token : " + err.Error())
 		log.Println(err)
@@ -268,30 +402,55 @@ func (this *Authority) GetToken(clientUuid string) (token string, err error) {
 	return
 }
 
+func (this *Authority) tokenExpiration() time.Time {
+	if this.config.SessionTokenTtl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(this.config.SessionTokenTtl) * time.Second)
+}
+
+func (this *SessionToken) expired() bool {
+	return !this.Expires.IsZero() && time.Now().After(this.Expires)
+}
+
 // Verify the validity of a token
-func (this *Authority) VerifyToken(uuid string, token string) (err error) {
-	if u, ok := this.Tokens[token]; ok {
-		if uuid != u {
-			err = errors.New("Authority : Invalid token " + token + " for client with uuid " + uuid)
-			log.Println(err)
-		}
-	} else {
+func (this *Authority) VerifyToken(uuid string, token string, session string) (err error) {
+	this.tokensLocker.Lock()
+	sessionToken, ok := this.tokens[token]
+	this.tokensLocker.Unlock()
+
+	switch {
+	case !ok || uuid != sessionToken.Uuid:
 		err = errors.New("Authority : Invalid token " + token + " for client with uuid " + uuid)
+	case sessionToken.session != session:
+		err = errors.New("Authority : Token " + token + " of client with uuid " + uuid + " used on another connection")
+	case sessionToken.expired():
+		err = errors.New("Authority : Token " + token + " of client with uuid " + uuid + " has expired")
+	case !this.IsAllowed(uuid):
+		err = errors.New("Authority : Token " + token + " of client with uuid " + uuid + " is not allowed anymore")
+	}
+	if err != nil {
 		log.Println(err)
 	}
 
 	return
 }
 
+// Replace a valid token by a new one
+func (this *Authority) RefreshToken(uuid string, token string, session string) (newToken string, err error) {
+	if err = this.VerifyToken(uuid, token, session); err != nil {
+		return
+	}
+	return this.GetToken(uuid, session)
+}
+
 // Revoke a token
 func (this *Authority) RevokeToken(uuid string, token string) (err error) {
-	if u, ok := this.Tokens[token]; ok {
-		if uuid == u {
-			delete(this.Tokens, token)
-		} else {
-			err = errors.New("Authority : Invalid token " + token + " for client with uuid " + uuid)
-			log.Println(err)
-		}
+	this.tokensLocker.Lock()
+	defer this.tokensLocker.Unlock()
+
+	if sessionToken, ok := this.tokens[token]; ok && uuid == sessionToken.Uuid {
+		delete(this.tokens, token)
 	} else {
 		err = errors.New("Authority : Invalid token " + token + " for client with uuid " + uuid)
 		log.Println(err)
@@ -299,3 +458,16 @@ func (this *Authority) RevokeToken(uuid string, token string) (err error) {
 
 	return
 }
+
+// Revoke every token of a client
+func (this *Authority) RevokeTokens(uuid string) {
+	this.tokensLocker.Lock()
+	defer this.tokensLocker.Unlock()
+
+	for token, sessionToken := range this.tokens {
+		if uuid == sessionToken.Uuid {
+			delete(this.tokens, token)
+			log.Println("Authority : token " + token + " revoked")
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package wigo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The authority state is stored in the sqlite database, alongside
+// the logs. Every client known by the push server has a row with its
+// state and the history of its approval. Every state change is made
+// in a transaction which also appends it to the audit trail.
+//
+// Clients are cached in memory as they are checked on every rpc.
+
+// Client states
+const (
+	CLIENT_WAITING  = "waiting"
+	CLIENT_ALLOWED  = "allowed"
+	CLIENT_REJECTED = "rejected"
+	CLIENT_REVOKED  = "revoked"
+)
+
+// The last seen time is only persisted once a minute
+const clientSeenPersistInterval = 60
+
+// Returned by change functions to leave a client as is
+var errClientStateUnchanged = errors.New("unchanged")
+
+type AuthorityClient struct {
+	Uuid      string
+	Hostname  string
+	State     string
+	Address   string `json:",omitempty"`
+	FirstSeen int64
+	LastSeen  int64
+
+	// Accept policy which matched the client, if any
+	Policy string `json:",omitempty"`
+
+	Approver         string `json:",omitempty"`
+	Approved         int64  `json:",omitempty"`
+	Revoked          int64  `json:",omitempty"`
+	RevocationReason string `json:",omitempty"`
+
+	// Last change, push server peers keep the most recent state. Changes
+	// made in the same second are ordered by the revision of the client,
+	// then by the uuid of the push server which made them.
+	Changed   int64
+	Revision  int64
+	ChangedBy string `json:",omitempty"`
+}
+
+type AuthorityAuditEntry struct {
+	Date     int64
+	Uuid     string
+	Hostname string
+	Action   string
+	Actor    string `json:",omitempty"`
+	Details  string `json:",omitempty"`
+}
+
+type AuthorityStore struct {
+	db     *sql.DB
+	dbLock *sync.Mutex
+
+	locker  *sync.RWMutex
+	clients map[string]*AuthorityClient
+
+	// Uuid of this push server, orders the changes of peers
+	origin string
+
+	// Sends the changes to the push server peers
+	replicate func(kind string, value interface{})
+}
+
+func NewAuthorityStore(db *sql.DB, dbLock *sync.Mutex, origin string) (this *AuthorityStore, err error) {
+	this = new(AuthorityStore)
+	this.db = db
+	this.dbLock = dbLock
+	this.origin = origin
+	this.locker = new(sync.RWMutex)
+	this.clients = make(map[string]*AuthorityClient)
+
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	sqlStmt := `
+    CREATE TABLE IF NOT EXISTS authority_clients (uuid text not null primary key, hostname text, state text, address text, first_seen timestamp, last_seen timestamp, policy text, approver text, approved timestamp, revoked timestamp, reason text, changed timestamp, revision integer, changed_by text) ;
+    CREATE TABLE IF NOT EXISTS authority_audit (id integer not null primary key, date timestamp, uuid text, hostname text, action text, actor text, details text) ;
+    `
+	if _, err = this.db.Exec(sqlStmt); err != nil {
+		return nil, fmt.Errorf("Unable to create authority tables : %s", err)
+	}
+
+	// Tables created before push server peers don't have the change columns
+	columns := []struct{ name, definition string }{
+		{"changed", "timestamp DEFAULT 0"},
+		{"revision", "integer DEFAULT 0"},
+		{"changed_by", "text DEFAULT ''"},
+	}
+	for _, column := range columns {
+		if _, err = this.db.Exec(`SELECT ` + column.name + ` FROM authority_clients LIMIT 1;`); err != nil {
+			if _, err = this.db.Exec(`ALTER TABLE authority_clients ADD COLUMN ` + column.name + ` ` + column.definition + `;`); err != nil {
+				return nil, fmt.Errorf("Unable to upgrade authority tables : %s", err)
+			}
+		}
+	}
+
+	rows, err := this.db.Query(`SELECT uuid,hostname,state,address,first_seen,last_seen,policy,approver,approved,revoked,reason,changed,revision,changed_by FROM authority_clients;`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load authority clients : %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client := new(AuthorityClient)
+		if err = rows.Scan(&client.Uuid, &client.Hostname, &client.State, &client.Address, &client.FirstSeen, &client.LastSeen, &client.Policy, &client.Approver, &client.Approved, &client.Revoked, &client.RevocationReason, &client.Changed, &client.Revision, &client.ChangedBy); err != nil {
+			return nil, fmt.Errorf("Unable to load authority clients : %s", err)
+		}
+		this.clients[client.Uuid] = client
+	}
+
+	return this, rows.Err()
+}
+
+func (this *AuthorityStore) Get(uuid string) (client *AuthorityClient, ok bool) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	if client, ok = this.clients[uuid]; ok {
+		copy := *client
+		client = &copy
+	}
+	return
+}
+
+func (this *AuthorityStore) State(uuid string) string {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	if client, ok := this.clients[uuid]; ok {
+		return client.State
+	}
+	return ""
+}
+
+func (this *AuthorityStore) List() (clients []*AuthorityClient) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	clients = make([]*AuthorityClient, 0, len(this.clients))
+	for _, client := range this.clients {
+		copy := *client
+		clients = append(clients, &copy)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Hostname < clients[j].Hostname })
+
+	return
+}
+
+// Must be called with the lock held
+func (this *AuthorityStore) count(state string) (count int) {
+	for _, client := range this.clients {
+		if client.State == state {
+			count++
+		}
+	}
+	return
+}
+
+// Change a client, or create it, and record the change in the audit
+// trail. Both are done in a single transaction. The change function
+// is applied on a copy of the client, nothing is changed if it fails.
+func (this *AuthorityStore) Update(uuid string, hostname string, action string, actor string, details string, change func(client *AuthorityClient) error) (client *AuthorityClient, err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	now := time.Now().Unix()
+	client = &AuthorityClient{Uuid: uuid, Hostname: hostname, FirstSeen: now, LastSeen: now}
+	if previous, ok := this.clients[uuid]; ok {
+		copy := *previous
+		client = &copy
+	}
+
+	if err = change(client); err != nil {
+		return nil, err
+	}
+
+	// Never order a change before the one it replaces, even if
+	// it was made by a peer whose clock is ahead of ours
+	if now > client.Changed {
+		client.Changed = now
+	}
+	client.Revision++
+	client.ChangedBy = this.origin
+
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err = this.save(tx, client); err == nil {
+		err = this.audit(tx, now, client.Uuid, client.Hostname, action, actor, details)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("Unable to update authority client %s : %s", uuid, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Unable to update authority client %s : %s", uuid, err)
+	}
+
+	this.clients[uuid] = client
+	copy := *client
+	entry := &AuthorityAuditEntry{Date: now, Uuid: client.Uuid, Hostname: client.Hostname, Action: action, Actor: actor, Details: details}
+	this.replicate(PEER_REPLICATE_CLIENT, &replicatedClient{Client: &copy, Audit: entry})
+	return &copy, nil
+}
+
+func (this *AuthorityStore) save(tx *sql.Tx, client *AuthorityClient) (err error) {
+	sqlStmt := `INSERT OR REPLACE INTO authority_clients(uuid,hostname,state,address,first_seen,last_seen,policy,approver,approved,revoked,reason,changed,revision,changed_by) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
+	_, err = tx.Exec(sqlStmt, client.Uuid, client.Hostname, client.State, client.Address, client.FirstSeen, client.LastSeen, client.Policy, client.Approver, client.Approved, client.Revoked, client.RevocationReason, client.Changed, client.Revision, client.ChangedBy)
+	return
+}
+
+func (this *AuthorityStore) audit(tx *sql.Tx, date int64, uuid string, hostname string, action string, actor string, details string) (err error) {
+	sqlStmt := `INSERT INTO authority_audit(date,uuid,hostname,action,actor,details) VALUES(?,?,?,?,?,?);`
+	_, err = tx.Exec(sqlStmt, date, uuid, hostname, action, actor, details)
+	return
+}
+
+// Record an event which doesn't change the state of a client
+func (this *AuthorityStore) Audit(uuid string, hostname string, action string, actor string, details string) (err error) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	if err = this.audit(tx, now, uuid, hostname, action, actor, details); err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	this.replicate(PEER_REPLICATE_AUDIT, &AuthorityAuditEntry{Date: now, Uuid: uuid, Hostname: hostname, Action: action, Actor: actor, Details: details})
+	return
+}
+
+// Whether the change of the client comes after the other one. Every
+// peer orders the changes the same way, so they all keep the same state.
+func (this *AuthorityClient) isAfter(other *AuthorityClient) bool {
+	if this.Changed != other.Changed {
+		return this.Changed > other.Changed
+	}
+	if this.Revision != other.Revision {
+		return this.Revision > other.Revision
+	}
+	return this.ChangedBy > other.ChangedBy
+}
+
+// Apply a client change or an audit entry sent by a push server peer.
+// Changes which don't come after the state we have are only kept in
+// the audit trail.
+func (this *AuthorityStore) Replicate(client *AuthorityClient, entry *AuthorityAuditEntry) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if client != nil {
+		if current, ok := this.clients[client.Uuid]; ok && !client.isAfter(current) {
+			client = nil
+		}
+	}
+	if client == nil && entry == nil {
+		return
+	}
+
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return
+	}
+	if client != nil {
+		err = this.save(tx, client)
+	}
+	if err == nil && entry != nil {
+		err = this.audit(tx, entry.Date, entry.Uuid, entry.Hostname, entry.Action, entry.Actor, entry.Details)
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	if client != nil {
+		this.clients[client.Uuid] = client
+	}
+	return
+}
+
+// Update the last time and address a known client was seen from
+func (this *AuthorityStore) Seen(uuid string, address net.IP) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	client, ok := this.clients[uuid]
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	addressChanged := address != nil && address.String() != client.Address
+	if !addressChanged && now-client.LastSeen < clientSeenPersistInterval {
+		return
+	}
+	client.LastSeen = now
+	if address != nil {
+		client.Address = address.String()
+	}
+
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	this.db.Exec(`UPDATE authority_clients SET last_seen=?, address=? WHERE uuid=?;`, client.LastSeen, client.Address, uuid)
+}
+
+// The most recent entries of the audit trail, of a client if uuid is set
+func (this *AuthorityStore) AuditTrail(uuid string, limit int) (entries []*AuthorityAuditEntry, err error) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	var rows *sql.Rows
+	if uuid != "" {
+		rows, err = this.db.Query(`SELECT date,uuid,hostname,action,actor,details FROM authority_audit WHERE uuid=? ORDER BY id DESC LIMIT ?;`, uuid, limit)
+	} else {
+		rows, err = this.db.Query(`SELECT date,uuid,hostname,action,actor,details FROM authority_audit ORDER BY id DESC LIMIT ?;`, limit)
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	entries = make([]*AuthorityAuditEntry, 0)
+	for rows.Next() {
+		entry := new(AuthorityAuditEntry)
+		if err = rows.Scan(&entry.Date, &entry.Uuid, &entry.Hostname, &entry.Action, &entry.Actor, &entry.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
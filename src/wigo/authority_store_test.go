@@ -0,0 +1,146 @@
+package wigo
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store of a push server peer, keeping the client changes it replicates
+func newTestAuthorityStore(t *testing.T, origin string) (*AuthorityStore, *[]*replicatedClient) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "wigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewAuthorityStore(db, new(sync.Mutex), origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicated := new([]*replicatedClient)
+	store.replicate = func(kind string, value interface{}) {
+		if change, ok := value.(*replicatedClient); ok {
+			*replicated = append(*replicated, change)
+		}
+	}
+
+	return store, replicated
+}
+
+func setClientState(state string) func(client *AuthorityClient) error {
+	return func(client *AuthorityClient) error {
+		client.State = state
+		return nil
+	}
+}
+
+func TestAuthorityStoreReplicateConflicts(t *testing.T) {
+	// Changes made after a change replicated with a clock ahead
+	// of ours get its timestamp, so both peers below change the
+	// client in the same second
+	future := time.Now().Unix() + 3600
+	seed := &AuthorityClient{Uuid: "client", Hostname: "client", State: CLIENT_WAITING, Changed: future, Revision: 1, ChangedBy: "seed"}
+
+	tests := []struct {
+		name     string
+		changesA []string
+		changesB []string
+		expected string
+	}{
+		{
+			name:     "conflicting changes in the same second",
+			changesA: []string{CLIENT_ALLOWED},
+			changesB: []string{CLIENT_REJECTED},
+			expected: CLIENT_REJECTED,
+		},
+		{
+			name:     "conflicting changes in the same second, other order",
+			changesA: []string{CLIENT_REJECTED},
+			changesB: []string{CLIENT_ALLOWED},
+			expected: CLIENT_ALLOWED,
+		},
+		{
+			name:     "more changes of the client win",
+			changesA: []string{CLIENT_ALLOWED, CLIENT_REVOKED},
+			changesB: []string{CLIENT_REJECTED},
+			expected: CLIENT_REVOKED,
+		},
+		{
+			name:     "changes of a single peer",
+			changesA: []string{CLIENT_ALLOWED, CLIENT_REVOKED},
+			expected: CLIENT_REVOKED,
+		},
+	}
+
+	for _, test := range tests {
+		storeA, replicatedA := newTestAuthorityStore(t, "peer-a")
+		storeB, replicatedB := newTestAuthorityStore(t, "peer-b")
+
+		for _, store := range []*AuthorityStore{storeA, storeB} {
+			copy := *seed
+			if err := store.Replicate(&copy, nil); err != nil {
+				t.Fatalf("%s : %s", test.name, err)
+			}
+		}
+
+		for _, state := range test.changesA {
+			if _, err := storeA.Update("client", "client", state, "admin", "", setClientState(state)); err != nil {
+				t.Fatalf("%s : %s", test.name, err)
+			}
+		}
+		for _, state := range test.changesB {
+			if _, err := storeB.Update("client", "client", state, "admin", "", setClientState(state)); err != nil {
+				t.Fatalf("%s : %s", test.name, err)
+			}
+		}
+
+		for _, change := range *replicatedA {
+			if change.Client.Changed != future {
+				t.Fatalf("%s : expected the change to be made at %d, got %d", test.name, future, change.Client.Changed)
+			}
+			copy := *change.Client
+			if err := storeB.Replicate(&copy, change.Audit); err != nil {
+				t.Fatalf("%s : %s", test.name, err)
+			}
+		}
+		for _, change := range *replicatedB {
+			copy := *change.Client
+			if err := storeA.Replicate(&copy, change.Audit); err != nil {
+				t.Fatalf("%s : %s", test.name, err)
+			}
+		}
+
+		stateA, stateB := storeA.State("client"), storeB.State("client")
+		if stateA != test.expected || stateB != test.expected {
+			t.Errorf("%s : expected both peers to end %s, got %s and %s", test.name, test.expected, stateA, stateB)
+		}
+	}
+}
+
+func TestAuthorityStoreReplicateIgnoresOlderChanges(t *testing.T) {
+	store, _ := newTestAuthorityStore(t, "peer-a")
+
+	if _, err := store.Update("client", "client", CLIENT_ALLOWED, "admin", "", setClientState(CLIENT_ALLOWED)); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := store.Get("client")
+
+	older := *client
+	older.State = CLIENT_REVOKED
+	older.Changed--
+	same := *client
+	same.State = CLIENT_REVOKED
+
+	for _, change := range []*AuthorityClient{&older, &same} {
+		if err := store.Replicate(change, nil); err != nil {
+			t.Fatal(err)
+		}
+		if state := store.State("client"); state != CLIENT_ALLOWED {
+			t.Fatalf("expected the change at %d revision %d to be ignored, got state %s", change.Changed, change.Revision, state)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package wigo
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Changes of the local wigo state are numbered by a revision
+// counter so pollers can only fetch what changed since their
+// last poll with /api/changes?since=<revision>&epoch=<epoch>.
+//
+// The journal keeps the revision of the last change of every
+// local probe and remote wigo. Removed ones are remembered for
+// at least an hour, a client asking for older changes, or for
+// changes of a previous run of wigo (different epoch), is asked
+// to fetch the whole state again.
+
+const (
+	CHANGE_PROBE  = "probe:"
+	CHANGE_REMOTE = "remote:"
+)
+
+const changesRetention = time.Hour
+
+type changesJournal struct {
+	locker *sync.Mutex
+
+	epoch    string
+	revision uint64
+	changes  map[string]uint64
+
+	// Changes up to this revision may have been forgotten
+	pruned       uint64
+	lastPrunable uint64
+}
+
+// Changes since a revision, if Full is set the client must fetch
+// the whole state with /api instead
+type ApiChanges struct {
+	Epoch    string
+	Revision uint64
+	Full     bool
+
+	Uuid          string `json:",omitempty"`
+	Version       string `json:",omitempty"`
+	Hostname      string `json:",omitempty"`
+	IsAlive       bool
+	GlobalStatus  int
+	GlobalMessage string `json:",omitempty"`
+	LastUpdate    int64
+
+	// Local host with only the changed probes
+	LocalHost     *Host            `json:",omitempty"`
+	RemovedProbes []string         `json:",omitempty"`
+	RemoteWigos   map[string]*Wigo `json:",omitempty"`
+	RemovedWigos  []string         `json:",omitempty"`
+}
+
+func newChangesJournal() (this *changesJournal) {
+	this = new(changesJournal)
+	this.locker = new(sync.Mutex)
+	this.epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+	this.changes = make(map[string]uint64)
+	return
+}
+
+// Record a change of the key. The new revision is stored in published
+// while the journal is locked, so it never goes backwards.
+func (this *changesJournal) touch(key string, published *uint64) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.revision++
+	this.changes[key] = this.revision
+
+	atomic.StoreUint64(published, this.revision)
+}
+
+// Keys changed since the given revision
+func (this *changesJournal) since(revision uint64) (current uint64, keys []string, ok bool) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if revision > this.revision || revision < this.pruned {
+		return this.revision, nil, false
+	}
+
+	for key, rev := range this.changes {
+		if rev > revision {
+			keys = append(keys, key)
+		}
+	}
+
+	return this.revision, keys, true
+}
+
+// Forget the keys of removed entities changed before the previous
+// call, so removals are kept at least for the time between two calls
+func (this *changesJournal) prune(exists func(key string) bool) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for key, rev := range this.changes {
+		if rev <= this.lastPrunable && !exists(key) {
+			delete(this.changes, key)
+			if rev > this.pruned {
+				this.pruned = rev
+			}
+		}
+	}
+
+	this.lastPrunable = this.revision
+}
+
+func (this *Wigo) initChanges() {
+	this.changes = newChangesJournal()
+	this.Epoch = this.changes.epoch
+
+	go func() {
+		for {
+			time.Sleep(changesRetention)
+			this.changes.prune(this.changeExists)
+		}
+	}()
+}
+
+func (this *Wigo) changeExists(key string) bool {
+	switch {
+	case strings.HasPrefix(key, CHANGE_PROBE):
+		_, ok := this.LocalHost.Probes.Get(strings.TrimPrefix(key, CHANGE_PROBE))
+		return ok
+	case strings.HasPrefix(key, CHANGE_REMOTE):
+		_, ok := this.RemoteWigos.Get(strings.TrimPrefix(key, CHANGE_REMOTE))
+		return ok
+	}
+	return false
+}
+
+// Record a change of a local probe
+func (this *Wigo) ProbeChanged(name string) {
+	if this.changes != nil {
+		this.changes.touch(CHANGE_PROBE+name, &this.Revision)
+	}
+}
+
+// Record a change of a remote wigo
+func (this *Wigo) RemoteWigoChanged(uuid string) {
+	if this.changes != nil {
+		this.changes.touch(CHANGE_REMOTE+uuid, &this.Revision)
+	}
+}
+
+// Revision of the last change, updated concurrently by ProbeChanged and RemoteWigoChanged
+func (this *Wigo) GetRevision() uint64 {
+	return atomic.LoadUint64(&this.Revision)
+}
+
+// Changes of the wigo state since the given revision, as seen by the user
+func (this *Wigo) GetChanges(since uint64, epoch string, user *ApiUser) (changes *ApiChanges) {
+	changes = new(ApiChanges)
+	changes.Epoch = this.changes.epoch
+
+	revision, keys, ok := this.changes.since(since)
+	changes.Revision = revision
+	if !ok || epoch != this.changes.epoch {
+		changes.Full = true
+		return
+	}
+
+	changes.Uuid = this.Uuid
+	changes.Version = this.Version
+	changes.Hostname = this.Hostname
+	changes.IsAlive = this.IsAlive
+	changes.GlobalStatus = this.GlobalStatus
+	changes.GlobalMessage = this.GlobalMessage
+	changes.LastUpdate = this.LastUpdate
+
+	changes.LocalHost = NewHost()
+	changes.LocalHost.Name = this.LocalHost.Name
+	changes.LocalHost.Group = this.LocalHost.Group
+	changes.LocalHost.Status = this.LocalHost.Status
+
+	showProbes := user.CanSeeGroup(this.LocalHost.Group)
+	changes.RemoteWigos = make(map[string]*Wigo)
+
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(key, CHANGE_PROBE):
+			if !showProbes {
+				continue
+			}
+			name := strings.TrimPrefix(key, CHANGE_PROBE)
+			if probe, ok := this.LocalHost.Probes.Get(name); ok {
+				changes.LocalHost.Probes.Set(name, probe)
+			} else {
+				changes.RemovedProbes = append(changes.RemovedProbes, name)
+			}
+		case strings.HasPrefix(key, CHANGE_REMOTE):
+			uuid := strings.TrimPrefix(key, CHANGE_REMOTE)
+			if tmp, ok := this.RemoteWigos.Get(uuid); ok {
+				remoteWigo := tmp.(*Wigo).FilterForUser(user)
+				if user.CanSeeGroup(remoteWigo.GetLocalHost().Group) || remoteWigo.RemoteWigos.Count() > 0 {
+					changes.RemoteWigos[uuid] = remoteWigo
+				}
+			} else {
+				changes.RemovedWigos = append(changes.RemovedWigos, uuid)
+			}
+		}
+	}
+
+	return
+}
+
+// Build the new state of a remote wigo from its previous
+// state and the changes it returned
+func (this *Wigo) ApplyChanges(changes *ApiChanges, checkRemotesDepth int) (wigo *Wigo) {
+	wigo = new(Wigo)
+	wigo.Uuid = changes.Uuid
+	wigo.Version = changes.Version
+	wigo.Hostname = changes.Hostname
+	wigo.IsAlive = changes.IsAlive
+	wigo.GlobalStatus = changes.GlobalStatus
+	wigo.GlobalMessage = changes.GlobalMessage
+	wigo.LastUpdate = changes.LastUpdate
+	wigo.Epoch = changes.Epoch
+	wigo.Revision = changes.Revision
+
+	wigo.LocalHost = NewHost()
+	if changes.LocalHost != nil {
+		wigo.LocalHost.Name = changes.LocalHost.Name
+		wigo.LocalHost.Group = changes.LocalHost.Group
+		wigo.LocalHost.Status = changes.LocalHost.Status
+	}
+
+	for item := range this.LocalHost.Probes.IterBuffered() {
+		wigo.LocalHost.Probes.Set(item.Key, item.Val)
+	}
+	if changes.LocalHost != nil {
+		for item := range changes.LocalHost.Probes.IterBuffered() {
+			wigo.LocalHost.Probes.Set(item.Key, item.Val)
+		}
+	}
+	for _, name := range changes.RemovedProbes {
+		wigo.LocalHost.Probes.Remove(name)
+	}
+
+	wigo.RemoteWigos = NewConcurrentMapWigos()
+	for item := range this.RemoteWigos.IterBuffered() {
+		wigo.RemoteWigos.Set(item.Key, item.Val)
+	}
+	for uuid, remoteWigo := range changes.RemoteWigos {
+		wigo.RemoteWigos.Set(uuid, remoteWigo)
+	}
+	for _, uuid := range changes.RemovedWigos {
+		wigo.RemoteWigos.Remove(uuid)
+	}
+
+	if checkRemotesDepth != 0 {
+		wigo = wigo.EraseRemoteWigos(checkRemotesDepth)
+	}
+
+	wigo.SetParentHostsInProbes()
+	wigo.LocalHost.SetParentWigo(wigo)
+
+	return
+}
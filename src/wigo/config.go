@@ -5,12 +5,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
 
+	// Configuration files included after this one
+	Include []string
+
 	// General params
 	Global *GeneralConfig
 
@@ -26,15 +27,46 @@ type Config struct {
 	// Remmote wigos params
 	RemoteWigos  *RemoteWigoConfig
 	AdvancedList []AdvancedRemoteWigoConfig
+	Discovery    []DiscoveryConfig
 
 	// Noticications
 	Notifications *NotificationConfig
 
 	// OpenTSDB params
 	OpenTSDB *OpenTSDBConfig
+
+	// Keys of the configuration files matching no setting
+	undecoded []string
+
+	// Files read and settings overridden by the environment
+	files       []string
+	environment []string
 }
 
 func NewConfig(configFile string) (this *Config) {
+	this, err := LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	problems := this.Validate()
+	for _, problem := range problems {
+		log.Printf("Configuration file %s : %s", configFile, problem)
+	}
+	if HasConfigErrors(problems) {
+		log.Fatalf("Invalid configuration file %s, run wigo --check-config for details", configFile)
+	}
+	for _, problem := range this.ValidateProbesConfig() {
+		log.Printf("Configuration file %s : %s", configFile, problem)
+	}
+
+	os.Setenv("WIGO_PROBE_CONFIG_ROOT", this.Global.ProbesConfigDirectory)
+
+	return
+}
+
+// Read the configuration file over the default settings
+func LoadConfig(configFile string) (this *Config, err error) {
 
 	// General params
 	this = new(Config)
@@ -53,7 +85,10 @@ func NewConfig(configFile string) (this *Config) {
 	this.Global.LogFile = "/var/log/wigo.log"
 	this.Global.UuidFile = "/var/lib/wigo/uuid"
 	this.Global.Database = "/var/lib/wigo/wigo.db"
+	this.Global.DisabledProbesFile = "/var/lib/wigo/disabled_probes"
+	this.Global.DisabledProbesRetry = 3600
 	this.Global.AliveTimeout = 60
+	this.Global.CertExpiryWarning = 30
 	this.Global.ConfigFile = configFile
 	this.Global.Debug = false
 	this.Global.Trace = false
@@ -67,7 +102,12 @@ func NewConfig(configFile string) (this *Config) {
 	this.Http.SslKey = "/etc/wigo/ssl/wigo.key"
 	this.Http.Login = ""
 	this.Http.Password = ""
+	this.Http.UsersFile = "/var/lib/wigo/users"
+	this.Http.SslClientCa = ""
+	this.Http.SslClientCertRequired = false
+	this.Http.ClientCerts = nil
 	this.Http.Gzip = true
+	this.Http.AnonymousRole = "viewer"
 
 	// Push server
 	this.PushServer.Enabled = false
@@ -79,6 +119,20 @@ func NewConfig(configFile string) (this *Config) {
 	this.PushServer.AllowedClientsFile = "/var/lib/wigo/allowed"
 	this.PushServer.MaxWaitingClients = 100
 	this.PushServer.AutoAcceptClients = false
+	this.PushServer.AcceptPolicies = nil
+	this.PushServer.Peers = nil
+	this.PushServer.SessionTokenTtl = 300
+	this.PushServer.MaxConnectionsPerIp = 10
+	this.PushServer.MaxRequestsPerClient = 120
+	this.PushServer.MaxRequests = 0
+	this.PushServer.MaxPayloadSize = 16777216
+	this.PushServer.MaxProbesPerClient = 10000
+	this.PushServer.ClientCertEnrollment = true
+	this.PushServer.ClientCertValidity = 168
+	this.PushServer.RequireClientCert = false
+	this.PushServer.EnrolledClientsFile = "/var/lib/wigo/enrolled_clients"
+	this.PushServer.RevokedCertsFile = "/var/lib/wigo/revoked_certs"
+	this.PushServer.EnrollmentTokensFile = "/var/lib/wigo/enrollment_tokens"
 
 	// Push client
 	this.PushClient.Enabled = false
@@ -88,11 +142,30 @@ func NewConfig(configFile string) (this *Config) {
 	this.PushClient.SslCert = "/etc/wigo/ssl/wigo.crt"
 	this.PushClient.UuidSig = "/etc/wigo/ssl/uuid.sig"
 	this.PushClient.PushInterval = 15
+	this.PushClient.FullPushInterval = 300
+	this.PushClient.JournalFile = "/var/lib/wigo/push_journal"
+	this.PushClient.JournalSize = 10000
+	this.PushClient.ClientCertEnrollment = true
+	this.PushClient.SslClientCert = "/var/lib/wigo/push_client.crt"
+	this.PushClient.SslClientKey = "/var/lib/wigo/push_client.key"
+	this.PushClient.EnrollmentToken = ""
+	this.PushClient.Mode = PUSH_MODE_FANOUT
+	this.PushClient.FailbackInterval = 60
+	this.PushClient.Targets = nil
 
 	// Remote Wigos
 	this.RemoteWigos.List = nil
 	this.RemoteWigos.CheckInterval = 10
+	this.RemoteWigos.Timeout = 5
+	this.RemoteWigos.Workers = 32
+	this.RemoteWigos.MaxBackoff = 300
+	this.RemoteWigos.Jitter = 10
+	this.RemoteWigos.RemotesFile = "/var/lib/wigo/remotes"
+	this.RemoteWigos.SslCa = ""
+	this.RemoteWigos.SslCert = ""
+	this.RemoteWigos.SslKey = ""
 	this.AdvancedList = nil
+	this.Discovery = nil
 
 	// Notifications
 	this.Notifications.MinLevelToSend = 101
@@ -118,11 +191,26 @@ func NewConfig(configFile string) (this *Config) {
 	this.OpenTSDB.BufferSize = 10000
 	this.OpenTSDB.Tags = make(map[string]string)
 
-	log.Printf("Loading configuration file %s\n", this.Global.ConfigFile)
+	// Included files, relative to the directory of the config file
+	this.Include = []string{"wigo.conf.d/*.toml"}
+
+	// Override with config file, the included files and the environment
+	if err = this.decodeFile(configFile, true); err != nil {
+		return
+	}
+
+	includes, err := this.includedFiles(configFile)
+	if err != nil {
+		return
+	}
+	for _, file := range includes {
+		if err = this.decodeFile(file, false); err != nil {
+			return
+		}
+	}
 
-	// Override with config file
-	if _, err := toml.DecodeFile(this.Global.ConfigFile, &this); err != nil {
-		log.Printf("Failed to load configuration file %s : %s\n", this.Global.ConfigFile, err)
+	if err = this.applyEnvironment(os.Environ()); err != nil {
+		return
 	}
 
 	// Compatiblity with old RemoteWigos lists
@@ -159,7 +247,13 @@ func NewConfig(configFile string) (this *Config) {
 	this.RemoteWigos.AdvancedList = this.AdvancedList
 	this.AdvancedList = nil
 
-	os.Setenv("WIGO_PROBE_CONFIG_ROOT", this.Global.ProbesConfigDirectory)
+	for i := range this.Discovery {
+		if this.Discovery[i].RefreshInterval == 0 {
+			this.Discovery[i].RefreshInterval = 60
+		}
+	}
+	this.RemoteWigos.Discovery = this.Discovery
+	this.Discovery = nil
 
 	return
 }
@@ -177,6 +271,30 @@ type GeneralConfig struct {
 	Group                 string
 	Database              string
 	AliveTimeout          int
+
+	// Days before the expiry of a configured certificate to warn about it, 0 disables
+	CertExpiryWarning int
+
+	// Probes disabled through the api or by exit code 13, and seconds
+	// between two runs of the latter to enable them again, 0 disables
+	DisabledProbesFile  string
+	DisabledProbesRetry int
+}
+
+func (this *GeneralConfig) SetDefaultHostnameAndGroup() {
+	if this.Hostname == "" {
+		localHostname, err := os.Hostname()
+		if err == nil {
+			this.Hostname = localHostname
+		} else {
+			log.Println("Couldn't get hostname for local machine, using localhost")
+			this.Hostname = "localhost"
+		}
+	}
+
+	if this.Group == "" {
+		this.Group = "local"
+	}
 }
 
 type HttpConfig struct {
@@ -188,7 +306,24 @@ type HttpConfig struct {
 	SslKey     string
 	Login      string
 	Password   string
+	UsersFile  string
 	Gzip       bool
+
+	// Role granted when no credentials are configured
+	AnonymousRole string
+
+	// Mutual tls
+	SslClientCa           string
+	SslClientCertRequired bool
+	ClientCerts           []ClientCertConfig
+}
+
+// Role and groups granted to client certificates whose
+// common name or alternative names match the pattern
+type ClientCertConfig struct {
+	Pattern string
+	Role    string
+	Groups  []string
 }
 
 type PushServerConfig struct {
@@ -201,6 +336,50 @@ type PushServerConfig struct {
 	AllowedClientsFile string
 	AutoAcceptClients  bool
 	MaxWaitingClients  int
+
+	// Validity of the session tokens in seconds, 0 never expires
+	SessionTokenTtl int
+
+	// Limits of the clients, 0 is unlimited, see push_limits.go
+	MaxConnectionsPerIp  int
+	MaxRequestsPerClient int
+	MaxRequests          int
+	MaxPayloadSize       int
+	MaxProbesPerClient   int
+
+	// Client certificates, see enrollment.go
+	ClientCertEnrollment bool
+	ClientCertValidity   int
+	RequireClientCert    bool
+	EnrolledClientsFile  string
+	RevokedCertsFile     string
+
+	// Enrollment tokens, see enrollment_tokens.go
+	EnrollmentTokensFile string
+
+	// Policies deciding what to do with new clients, see accept_policies.go
+	AcceptPolicies       []AcceptPolicyConfig
+	RegistrationClientCa string
+
+	// Push servers sharing the state, see push_peers.go
+	Peers []PushPeerConfig
+}
+
+// A push server peer, the port defaults to the one of this push server
+type PushPeerConfig struct {
+	Name    string
+	Address string
+	Port    int
+}
+
+// Registering clients whose hostname, address and certificate subject
+// match the policy are accepted, rejected or queued for an admin
+type AcceptPolicyConfig struct {
+	Name        string
+	Hostname    string
+	Networks    []string
+	CertSubject string
+	Action      string
 }
 
 type PushClientConfig struct {
@@ -211,17 +390,69 @@ type PushClientConfig struct {
 	SslCert      string
 	UuidSig      string
 	PushInterval int
+
+	// Push protocol v2 sends only changes, plus a full snapshot every FullPushInterval seconds
+	FullPushInterval int
+
+	// Probe changes journaled while disconnected, 0 disables the journal
+	JournalFile string
+	JournalSize int
+
+	// Client certificate, see enrollment.go
+	ClientCertEnrollment bool
+	SslClientCert        string
+	SslClientKey         string
+
+	// Matched by the accept policies of the server until a client certificate is enrolled
+	SslRegistrationCert string
+	SslRegistrationKey  string
+
+	// Presented when registering to be allowed without an admin action
+	EnrollmentToken string
+
+	// Push to every target (fanout) or to the first reachable one (failover)
+	Mode             string
+	FailbackInterval int
+	Targets          []PushTargetConfig
+}
+
+// A push server, settings default to the ones of the [PushClient]
+// section, files default to per target names derived from them
+type PushTargetConfig struct {
+	Name            string
+	Address         string
+	Port            int
+	SslEnabled      bool
+	SslCert         string
+	SslClientCert   string
+	SslClientKey    string
+	UuidSig         string
+	JournalFile     string
+	EnrollmentToken string
 }
 
 type RemoteWigoConfig struct {
 	CheckInterval int
+	Timeout       int
+
+	// Polling scheduler
+	Workers    int
+	MaxBackoff int
+	Jitter     int
 
 	SslEnabled bool
+	SslCa      string
+	SslCert    string
+	SslKey     string
 	Login      string
 	Password   string
 
+	// Remotes added or removed through the api
+	RemotesFile string
+
 	List         []string
 	AdvancedList []AdvancedRemoteWigoConfig
+	Discovery    []DiscoveryConfig
 }
 
 type NotificationConfig struct {
@@ -244,13 +475,38 @@ type NotificationConfig struct {
 type AdvancedRemoteWigoConfig struct {
 	Hostname          string
 	Port              int
+	Group             string
 	CheckRemotesDepth int
 	CheckInterval     int
+	Timeout           int
 	SslEnabled        bool
+	SslCa             string
+	SslCert           string
+	SslKey            string
 	Login             string
 	Password          string
 }
 
+// Discovery of remote wigos, the remote settings are
+// the defaults of every discovered remote
+type DiscoveryConfig struct {
+	Name            string
+	Type            string
+	RefreshInterval int
+
+	// file
+	Files []string
+
+	// dns
+	Names    []string
+	Resolver string
+
+	// static
+	Targets []string
+
+	AdvancedRemoteWigoConfig
+}
+
 type OpenTSDBConfig struct {
 	Enabled       bool
 	Address       []string
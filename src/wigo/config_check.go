@@ -0,0 +1,392 @@
+package wigo
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validation of the configuration, done at startup, on reload
+// and by wigo --check-config.
+//
+// Errors prevent wigo from starting and a reload from being
+// applied : unknown settings, invalid values, missing files
+// and contradictory settings. Warnings are only logged, like
+// invalid probes configuration files which only break their
+// probe.
+
+type ConfigProblem struct {
+	Error   bool
+	Message string
+}
+
+func (this *ConfigProblem) String() string {
+	if this.Error {
+		return "error : " + this.Message
+	}
+	return "warning : " + this.Message
+}
+
+func HasConfigErrors(problems []*ConfigProblem) bool {
+	for _, problem := range problems {
+		if problem.Error {
+			return true
+		}
+	}
+	return false
+}
+
+type configChecker struct {
+	problems []*ConfigProblem
+}
+
+func (this *configChecker) error(format string, args ...interface{}) {
+	this.problems = append(this.problems, &ConfigProblem{Error: true, Message: fmt.Sprintf(format, args...)})
+}
+
+func (this *configChecker) warning(format string, args ...interface{}) {
+	this.problems = append(this.problems, &ConfigProblem{Error: false, Message: fmt.Sprintf(format, args...)})
+}
+
+func (this *configChecker) port(setting string, port int) {
+	if port <= 0 || port > 65535 {
+		this.error("Invalid %s %d", setting, port)
+	}
+}
+
+func (this *configChecker) positive(setting string, value int) {
+	if value < 0 {
+		this.error("Invalid %s %d, must not be negative", setting, value)
+	}
+}
+
+// A file wigo reads
+func (this *configChecker) file(setting string, file string) {
+	if file == "" {
+		this.error("Missing %s", setting)
+	} else if _, err := os.Stat(file); err != nil {
+		this.error("%s %s : %s", setting, file, err)
+	}
+}
+
+// A file wigo writes, its directory must exist
+func (this *configChecker) writable(setting string, file string) {
+	if file == "" {
+		this.error("Missing %s", setting)
+	} else if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+		this.error("%s %s : directory %s does not exist", setting, file, filepath.Dir(file))
+	}
+}
+
+// A file wigo only writes on changes done through the api
+func (this *configChecker) saved(setting string, file string) {
+	if file == "" {
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+		this.warning("%s %s : directory %s does not exist, changes can't be saved", setting, file, filepath.Dir(file))
+	}
+}
+
+func (this *configChecker) keyPair(section string, cert string, key string) {
+	count := len(this.problems)
+	this.file(section+".SslCert", cert)
+	this.file(section+".SslKey", key)
+	if len(this.problems) > count {
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+		this.error("Invalid %s.SslCert %s or SslKey %s : %s", section, cert, key, err)
+	}
+}
+
+// Check every setting, stopping at the first error is not
+// helpful when the configuration has several typos
+func (this *Config) Validate() []*ConfigProblem {
+	checker := new(configChecker)
+
+	for _, key := range this.undecoded {
+		checker.error("Unknown setting %s", key)
+	}
+
+	// Global
+	if info, err := os.Stat(this.Global.ProbesDirectory); err != nil || !info.IsDir() {
+		checker.error("Global.ProbesDirectory %s is not a directory", this.Global.ProbesDirectory)
+	}
+	checker.writable("Global.UuidFile", this.Global.UuidFile)
+	checker.writable("Global.Database", this.Global.Database)
+	checker.writable("Global.LogFile", this.Global.LogFile)
+	if this.Global.AliveTimeout <= 0 {
+		checker.error("Invalid Global.AliveTimeout %d", this.Global.AliveTimeout)
+	}
+	checker.positive("Global.CertExpiryWarning", this.Global.CertExpiryWarning)
+	checker.saved("Global.DisabledProbesFile", this.Global.DisabledProbesFile)
+	checker.positive("Global.DisabledProbesRetry", this.Global.DisabledProbesRetry)
+	if this.Global.Trace && !this.Global.Debug {
+		checker.warning("Global.Trace has no effect without Global.Debug")
+	}
+
+	// Http
+	if this.Http.Enabled {
+		checker.port("Http.Port", this.Http.Port)
+		if this.Http.SslEnabled {
+			checker.keyPair("Http", this.Http.SslCert, this.Http.SslKey)
+		}
+	}
+	if (this.Http.Login == "") != (this.Http.Password == "") {
+		checker.error("Http.Login and Http.Password must be set together")
+	}
+	if !IsValidRole(this.Http.AnonymousRole) {
+		checker.error("Invalid Http.AnonymousRole %s", this.Http.AnonymousRole)
+	}
+	if this.Http.SslClientCa != "" {
+		if !this.Http.SslEnabled {
+			checker.error("Http.SslClientCa needs Http.SslEnabled")
+		}
+		if _, err := LoadCertPool(this.Http.SslClientCa); err != nil {
+			checker.error("Http.SslClientCa : %s", err)
+		}
+	} else {
+		if this.Http.SslClientCertRequired {
+			checker.error("Http.SslClientCertRequired needs a Http.SslClientCa bundle")
+		}
+		if len(this.Http.ClientCerts) > 0 {
+			checker.warning("Http.ClientCerts have no effect without Http.SslClientCa")
+		}
+	}
+	if err := ValidateClientCerts(this.Http.ClientCerts); err != nil {
+		checker.error("Http.ClientCerts : %s", err)
+	}
+	checker.saved("Http.UsersFile", this.Http.UsersFile)
+
+	// Push server
+	if this.PushServer.Enabled {
+		checker.port("PushServer.Port", this.PushServer.Port)
+		if this.Http.Enabled && this.Http.Port == this.PushServer.Port {
+			checker.error("Http.Port and PushServer.Port are both %d", this.Http.Port)
+		}
+		if this.PushServer.SslEnabled {
+			checker.keyPair("PushServer", this.PushServer.SslCert, this.PushServer.SslKey)
+		} else {
+			if this.PushServer.RequireClientCert {
+				checker.error("PushServer.RequireClientCert needs PushServer.SslEnabled")
+			}
+			if len(this.PushServer.Peers) > 0 {
+				checker.error("PushServer.Peers need PushServer.SslEnabled")
+			}
+		}
+		if this.PushServer.RequireClientCert && !this.PushServer.ClientCertEnrollment {
+			checker.error("PushServer.RequireClientCert needs PushServer.ClientCertEnrollment")
+		}
+		if _, err := NewAcceptPolicies(this.PushServer.AcceptPolicies); err != nil {
+			checker.error("PushServer.AcceptPolicies : %s", err)
+		}
+		if this.PushServer.RegistrationClientCa != "" {
+			if !this.PushServer.SslEnabled {
+				checker.error("PushServer.RegistrationClientCa needs PushServer.SslEnabled")
+			}
+			if _, err := LoadCertPool(this.PushServer.RegistrationClientCa); err != nil {
+				checker.error("PushServer.RegistrationClientCa : %s", err)
+			}
+		}
+		for i, peer := range this.PushServer.Peers {
+			if peer.Address == "" {
+				checker.error("Missing address for push server peer %d", i)
+			}
+			if peer.Port != 0 {
+				checker.port("port of push server peer "+peer.Address, peer.Port)
+			}
+		}
+		checker.positive("PushServer.MaxWaitingClients", this.PushServer.MaxWaitingClients)
+		checker.positive("PushServer.SessionTokenTtl", this.PushServer.SessionTokenTtl)
+		checker.positive("PushServer.MaxConnectionsPerIp", this.PushServer.MaxConnectionsPerIp)
+		checker.positive("PushServer.MaxRequestsPerClient", this.PushServer.MaxRequestsPerClient)
+		checker.positive("PushServer.MaxRequests", this.PushServer.MaxRequests)
+		checker.positive("PushServer.MaxPayloadSize", this.PushServer.MaxPayloadSize)
+		checker.positive("PushServer.MaxProbesPerClient", this.PushServer.MaxProbesPerClient)
+		if this.PushServer.ClientCertValidity <= 0 {
+			checker.error("Invalid PushServer.ClientCertValidity %d", this.PushServer.ClientCertValidity)
+		}
+	}
+
+	// Push client
+	if this.PushClient.Enabled {
+		switch this.PushClient.Mode {
+		case PUSH_MODE_FANOUT, PUSH_MODE_FAILOVER:
+		default:
+			checker.error("Invalid PushClient.Mode %s", this.PushClient.Mode)
+		}
+		if this.PushClient.PushInterval <= 0 {
+			checker.error("Invalid PushClient.PushInterval %d", this.PushClient.PushInterval)
+		}
+		checker.positive("PushClient.FullPushInterval", this.PushClient.FullPushInterval)
+		checker.positive("PushClient.JournalSize", this.PushClient.JournalSize)
+		if len(this.PushClient.Targets) == 0 {
+			checker.port("PushClient.Port", this.PushClient.Port)
+		}
+
+		// The certificate of the push server is saved on first connection
+		if this.PushClient.SslEnabled {
+			checker.writable("PushClient.SslCert", this.PushClient.SslCert)
+		}
+		checker.writable("PushClient.UuidSig", this.PushClient.UuidSig)
+		if this.PushClient.SslRegistrationCert != "" {
+			if _, err := tls.LoadX509KeyPair(this.PushClient.SslRegistrationCert, this.PushClient.SslRegistrationKey); err != nil {
+				checker.error("Invalid PushClient.SslRegistrationCert %s or SslRegistrationKey %s : %s", this.PushClient.SslRegistrationCert, this.PushClient.SslRegistrationKey, err)
+			}
+		}
+
+		names := make(map[string]bool)
+		for i, target := range this.PushClient.Targets {
+			if target.Address == "" {
+				checker.error("Missing address for push target %d", i)
+			}
+			if target.Port != 0 {
+				checker.port("port of push target "+target.Address, target.Port)
+			}
+			if target.Name != "" {
+				if names[target.Name] {
+					checker.error("Duplicate push target %s", target.Name)
+				}
+				names[target.Name] = true
+			}
+		}
+	}
+
+	// Remote wigos
+	checker.saved("RemoteWigos.RemotesFile", this.RemoteWigos.RemotesFile)
+	if this.RemoteWigos.CheckInterval <= 0 {
+		checker.error("Invalid RemoteWigos.CheckInterval %d", this.RemoteWigos.CheckInterval)
+	}
+	if this.RemoteWigos.Workers <= 0 {
+		checker.error("Invalid RemoteWigos.Workers %d", this.RemoteWigos.Workers)
+	}
+	checker.positive("RemoteWigos.Timeout", this.RemoteWigos.Timeout)
+	checker.positive("RemoteWigos.MaxBackoff", this.RemoteWigos.MaxBackoff)
+	checker.positive("RemoteWigos.Jitter", this.RemoteWigos.Jitter)
+	checkRemoteTls(checker, "RemoteWigos", this.RemoteWigos.SslCa, this.RemoteWigos.SslCert, this.RemoteWigos.SslKey)
+
+	for _, remote := range this.RemoteWigos.AdvancedList {
+		if remote.Hostname == "" {
+			checker.error("Missing hostname of remote wigo")
+			continue
+		}
+		if remote.Port != 0 {
+			checker.port("port of remote wigo "+remote.Hostname, remote.Port)
+		}
+		checker.positive("check interval of remote wigo "+remote.Hostname, remote.CheckInterval)
+		checker.positive("timeout of remote wigo "+remote.Hostname, remote.Timeout)
+		checkRemoteTls(checker, "remote wigo "+remote.Hostname, remote.SslCa, remote.SslCert, remote.SslKey)
+	}
+	for _, discovery := range this.RemoteWigos.Discovery {
+		if _, err := NewDiscovery(discovery, nil); err != nil {
+			checker.error("Discovery : %s", err)
+		}
+	}
+
+	// Notifications
+	if this.Notifications.HttpEnabled != 0 && this.Notifications.HttpUrl == "" {
+		checker.error("Notifications.HttpEnabled needs Notifications.HttpUrl")
+	}
+	if this.Notifications.EmailEnabled < 0 || this.Notifications.EmailEnabled > 2 {
+		checker.error("Invalid Notifications.EmailEnabled %d", this.Notifications.EmailEnabled)
+	}
+	if this.Notifications.EmailEnabled != 0 {
+		if this.Notifications.EmailSmtpServer == "" {
+			checker.error("Notifications.EmailEnabled needs Notifications.EmailSmtpServer")
+		}
+		if len(this.Notifications.EmailRecipients) == 0 {
+			checker.error("Notifications.EmailEnabled needs Notifications.EmailRecipients")
+		}
+	}
+	if this.Notifications.EmailEnabled == 2 && this.Notifications.HttpEnabled == 0 {
+		checker.warning("Notifications.EmailEnabled = 2 only sends emails when http notifications fail, but Notifications.HttpEnabled is 0")
+	}
+
+	// OpenTSDB
+	if this.OpenTSDB.Enabled && len(this.OpenTSDB.Address) == 0 {
+		checker.error("OpenTSDB.Enabled needs OpenTSDB.Address")
+	}
+
+	return checker.problems
+}
+
+func checkRemoteTls(checker *configChecker, name string, ca string, cert string, key string) {
+	if ca != "" {
+		if _, err := LoadCertPool(ca); err != nil {
+			checker.error("SslCa of %s : %s", name, err)
+		}
+	}
+	if cert != "" || key != "" {
+		checker.keyPair(name, cert, key)
+	}
+}
+
+// Probes configuration files are json objects named <probe>.conf
+func (this *Config) ValidateProbesConfig() []*ConfigProblem {
+	checker := new(configChecker)
+
+	files, err := filepath.Glob(filepath.Join(this.Global.ProbesConfigDirectory, "*.conf"))
+	if err != nil || len(files) == 0 {
+		if _, err := os.Stat(this.Global.ProbesConfigDirectory); err != nil {
+			checker.warning("Global.ProbesConfigDirectory %s : %s", this.Global.ProbesConfigDirectory, err)
+		}
+		return checker.problems
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			checker.warning("Probe configuration %s : %s", file, err)
+			continue
+		}
+
+		if err = ValidateProbeConfig(content); err != nil {
+			checker.warning("Probe configuration %s : %s", file, err)
+		}
+	}
+
+	return checker.problems
+}
+
+// Print the problems of a configuration file and of the probes
+// configuration files, the exit code is 1 if there are any
+func CheckConfig(configFile string) int {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		fmt.Printf("error : %s\n", err)
+		return 1
+	}
+
+	problems := append(config.Validate(), config.ValidateProbesConfig()...)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		errors := 0
+		for _, problem := range problems {
+			if problem.Error {
+				errors++
+			}
+		}
+		fmt.Printf("Configuration file %s : %d errors, %d warnings\n", configFile, errors, len(problems)-errors)
+		return 1
+	}
+
+	fmt.Printf("Configuration file %s is valid\n", configFile)
+	return 0
+}
+
+func formatConfigProblems(problems []*ConfigProblem) string {
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		if problem.Error {
+			messages = append(messages, problem.Message)
+		}
+	}
+	return strings.Join(messages, ", ")
+}
@@ -0,0 +1,233 @@
+package wigo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The configuration is read from the config file, then from the
+// files matching its Include patterns (wigo.conf.d/*.toml next to
+// it by default) in order, then from the environment.
+//
+// Settings of an included file override the previous ones, the
+// arrays of tables ([[AdvancedList]], [[Http.ClientCerts]]...)
+// are appended to the previous ones so every file can add its
+// own remote wigos, discoveries or policies.
+//
+// Environment variables named WIGO_<SECTION>_<SETTING> override
+// the settings of the files, like WIGO_HTTP_PORT=4001. Lists are
+// comma-separated and maps are comma-separated key=value pairs,
+// like WIGO_NOTIFICATIONS_EMAILRECIPIENTS=a@b.c,d@e.f.
+
+// Masked in the configuration returned by the api
+var secretSettings = map[string]bool{
+	"Password":        true,
+	"EnrollmentToken": true,
+}
+
+// Effective configuration, as returned by the api
+type ConfigSources struct {
+	Files       []string
+	Environment []string
+	Config      interface{}
+}
+
+func (this *Config) decodeFile(file string, main bool) (err error) {
+	log.Printf("Loading configuration file %s\n", file)
+
+	arrays := this.tableArrays()
+	previous := make([]reflect.Value, len(arrays))
+	for i, array := range arrays {
+		value := reflect.ValueOf(array).Elem()
+		previous[i] = reflect.ValueOf(value.Interface())
+		value.Set(reflect.Zero(value.Type()))
+	}
+	include := this.Include
+
+	meta, err := toml.DecodeFile(file, this)
+	if err != nil {
+		return fmt.Errorf("Failed to load configuration file %s : %s", file, err)
+	}
+
+	for i, array := range arrays {
+		value := reflect.ValueOf(array).Elem()
+		value.Set(reflect.AppendSlice(previous[i], value))
+	}
+
+	if !main && meta.IsDefined("Include") {
+		this.Include = include
+		return fmt.Errorf("Include is only allowed in the main configuration file, not in %s", file)
+	}
+
+	for _, key := range meta.Undecoded() {
+		this.undecoded = append(this.undecoded, key.String()+" in "+file)
+	}
+	this.files = append(this.files, file)
+
+	return
+}
+
+func (this *Config) tableArrays() []interface{} {
+	return []interface{}{
+		&this.AdvancedList,
+		&this.Discovery,
+		&this.Http.ClientCerts,
+		&this.PushServer.AcceptPolicies,
+		&this.PushServer.Peers,
+		&this.PushClient.Targets,
+	}
+}
+
+// Files matching the Include patterns, sorted by pattern then by name
+func (this *Config) includedFiles(configFile string) (files []string, err error) {
+	for _, pattern := range this.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Include pattern %s : %s", pattern, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return
+}
+
+func (this *Config) applyEnvironment(environment []string) (err error) {
+	settings := make(map[string]reflect.Value)
+
+	config := reflect.ValueOf(this).Elem()
+	for i := 0; i < config.NumField(); i++ {
+		if config.Field(i).Kind() != reflect.Ptr {
+			continue
+		}
+		section := config.Field(i).Elem()
+		for j := 0; j < section.NumField(); j++ {
+			name := "WIGO_" + strings.ToUpper(config.Type().Field(i).Name+"_"+section.Type().Field(j).Name)
+			settings[name] = section.Field(j)
+		}
+	}
+
+	for _, variable := range environment {
+		name, value, _ := strings.Cut(variable, "=")
+		setting, ok := settings[name]
+		if !ok {
+			continue
+		}
+		if err = setFromString(setting, value); err != nil {
+			return fmt.Errorf("Invalid environment variable %s : %s", name, err)
+		}
+		this.environment = append(this.environment, name)
+	}
+	sort.Strings(this.environment)
+
+	return
+}
+
+func setFromString(setting reflect.Value, value string) (err error) {
+	switch setting.Kind() {
+	case reflect.String:
+		setting.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s is not an integer", value)
+		}
+		setting.SetInt(int64(number))
+	case reflect.Bool:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s is not a boolean", value)
+		}
+		setting.SetBool(boolean)
+	case reflect.Slice:
+		if setting.Type().Elem().Kind() != reflect.String {
+			return errors.New("this setting can't be set from the environment")
+		}
+		list := reflect.MakeSlice(setting.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item))
+			}
+		}
+		setting.Set(list)
+	case reflect.Map:
+		if setting.Type().Key().Kind() != reflect.String || setting.Type().Elem().Kind() != reflect.String {
+			return errors.New("this setting can't be set from the environment")
+		}
+		pairs := reflect.MakeMap(setting.Type())
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s is not a key=value pair", pair)
+			}
+			pairs.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), reflect.ValueOf(strings.TrimSpace(value)))
+		}
+		setting.Set(pairs)
+	default:
+		return errors.New("this setting can't be set from the environment")
+	}
+
+	return nil
+}
+
+// The files and environment variables the configuration was read
+// from, and the settings without their secrets
+func (this *Config) Sources() (sources *ConfigSources, err error) {
+	content, err := json.Marshal(this)
+	if err != nil {
+		return nil, err
+	}
+
+	var config interface{}
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+
+	sources = new(ConfigSources)
+	sources.Files = this.files
+	sources.Environment = this.environment
+	sources.Config = maskSecrets(config)
+
+	return
+}
+
+func maskSecrets(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if secret, ok := item.(string); ok && secret != "" && secretSettings[key] {
+				value[key] = "********"
+			} else {
+				value[key] = maskSecrets(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = maskSecrets(item)
+		}
+	case string:
+		// Credentials of urls, like the one of http notifications
+		if strings.Contains(value, "://") {
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				return u.Redacted()
+			}
+		}
+	}
+	return value
+}
@@ -0,0 +1,177 @@
+package wigo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Probes are disabled through the api or when they exit with the
+// special exit code 13, meaning they can't run on this host (like
+// a mysql probe without mysql). Disabled probes are saved in the
+// disabled probes file so they stay disabled after a restart.
+//
+// Probes disabled by exit code 13 are run again every
+// Global.DisabledProbesRetry seconds, and enabled again as soon as
+// they exit with another code, so a probe whose prerequisite is
+// installed later gets picked up. Probes disabled through the api
+// stay disabled until they are enabled through the api.
+
+const DISABLED_BY_EXIT_CODE = "exit code 13"
+
+var errProbeNotDisabled = errors.New("This probe is not disabled")
+
+type DisabledProbe struct {
+	Name       string
+	Reason     string
+	DisabledBy string
+	Date       int64
+	Automatic  bool
+
+	// Last time a probe disabled by exit code 13 was run again
+	lastRetry time.Time
+}
+
+type disabledProbesFile struct {
+	Probes []*DisabledProbe
+}
+
+type DisabledProbesStore struct {
+	file   string
+	locker *sync.RWMutex
+	probes map[string]*DisabledProbe
+}
+
+func NewDisabledProbesStore(file string) (this *DisabledProbesStore) {
+	this = new(DisabledProbesStore)
+	this.file = file
+	this.locker = new(sync.RWMutex)
+	this.probes = make(map[string]*DisabledProbe)
+
+	if err := this.load(); err != nil {
+		log.Printf("Disabled probes : %s", err)
+	}
+
+	return
+}
+
+func (this *DisabledProbesStore) load() (err error) {
+	if _, err = os.Stat(this.file); err != nil {
+		return nil
+	}
+
+	content := new(disabledProbesFile)
+	if _, err = toml.DecodeFile(this.file, content); err != nil {
+		return fmt.Errorf("Unable to load disabled probes file %s : %s", this.file, err)
+	}
+
+	for _, probe := range content.Probes {
+		if probe.Name != "" {
+			this.probes[probe.Name] = probe
+		}
+	}
+
+	return
+}
+
+// Must be called with the lock held
+func (this *DisabledProbesStore) save() (err error) {
+	if this.file == "" {
+		return nil
+	}
+
+	content := new(disabledProbesFile)
+	content.Probes = this.list()
+
+	tmp := this.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to write disabled probes file %s : %s", tmp, err)
+	}
+
+	if err = toml.NewEncoder(f).Encode(content); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to encode disabled probes file : %s", err)
+	}
+	f.Close()
+
+	return os.Rename(tmp, this.file)
+}
+
+// Must be called with the lock held
+func (this *DisabledProbesStore) list() (probes []*DisabledProbe) {
+	probes = make([]*DisabledProbe, 0, len(this.probes))
+	for _, probe := range this.probes {
+		probes = append(probes, probe)
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].Name < probes[j].Name })
+	return
+}
+
+func (this *DisabledProbesStore) List() []*DisabledProbe {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	return this.list()
+}
+
+func (this *DisabledProbesStore) Get(name string) *DisabledProbe {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	return this.probes[name]
+}
+
+// Disable a probe, returns false if it was already disabled. A probe
+// disabled through the api is not changed by exit code 13.
+func (this *DisabledProbesStore) Disable(name string, reason string, by string) (disabled bool, err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	automatic := by == DISABLED_BY_EXIT_CODE
+	if previous, ok := this.probes[name]; ok && (automatic || !previous.Automatic) {
+		return false, nil
+	}
+
+	probe := &DisabledProbe{Name: name, Reason: reason, DisabledBy: by, Date: time.Now().Unix(), Automatic: automatic}
+	probe.lastRetry = time.Now()
+	this.probes[name] = probe
+
+	return true, this.save()
+}
+
+func (this *DisabledProbesStore) Enable(name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if _, ok := this.probes[name]; !ok {
+		return errProbeNotDisabled
+	}
+	delete(this.probes, name)
+
+	return this.save()
+}
+
+// Whether a probe disabled by exit code 13 should be run again to
+// check if it can be enabled
+func (this *DisabledProbesStore) Retry(name string, interval int) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	probe, ok := this.probes[name]
+	if !ok || !probe.Automatic || interval <= 0 {
+		return false
+	}
+	if time.Since(probe.lastRetry) < time.Duration(interval)*time.Second {
+		return false
+	}
+
+	probe.lastRetry = time.Now()
+	return true
+}
@@ -0,0 +1,370 @@
+package wigo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/howeyc/fsnotify"
+)
+
+// Discovery providers feed the remote wigos list from a targets
+// file, from dns records or from a static list. Every provider
+// is refreshed periodically and its remotes are replaced as a
+// whole, remotes which disappeared are removed.
+//
+// The remote settings of a [[Discovery]] section (port, group,
+// tls, credentials, ...) are the defaults of its targets.
+//
+// Targets files are json or toml, like Prometheus file_sd :
+//
+//	[ { "targets": [ "host1:4000", "host2" ], "group": "web" } ]
+//
+//	[[TargetGroups]]
+//	Targets = [ "host1:4000", "host2" ]
+//	Group   = "web"
+//
+// Dns names starting with an underscore are resolved as SRV
+// records, giving both hosts and ports, others as A/AAAA records.
+
+// Discovery types
+const (
+	DISCOVERY_FILE   = "file"
+	DISCOVERY_DNS    = "dns"
+	DISCOVERY_STATIC = "static"
+)
+
+const REMOTE_SOURCE_DISCOVERY = "discovery:"
+
+type discoveryProvider interface {
+	Discover() ([]AdvancedRemoteWigoConfig, error)
+}
+
+// A group of targets sharing the same settings
+type DiscoveryTargetGroup struct {
+	Targets []string
+	AdvancedRemoteWigoConfig
+}
+
+type targetsFile struct {
+	TargetGroups []DiscoveryTargetGroup
+}
+
+type Discovery struct {
+	config   DiscoveryConfig
+	source   string
+	provider discoveryProvider
+	remotes  *RemotesManager
+	refresh  chan struct{}
+}
+
+func NewDiscovery(config DiscoveryConfig, remotes *RemotesManager) (this *Discovery, err error) {
+	this = new(Discovery)
+	this.config = config
+	this.source = REMOTE_SOURCE_DISCOVERY + config.Name
+	this.remotes = remotes
+	this.refresh = make(chan struct{}, 1)
+
+	if config.Name == "" {
+		return nil, errors.New("Missing discovery name")
+	}
+	if config.RefreshInterval <= 0 {
+		return nil, fmt.Errorf("Invalid refresh interval %d for discovery %s", config.RefreshInterval, config.Name)
+	}
+
+	switch config.Type {
+	case DISCOVERY_FILE:
+		if len(config.Files) == 0 {
+			return nil, fmt.Errorf("Missing Files for discovery %s", config.Name)
+		}
+		for _, pattern := range config.Files {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid file pattern %s for discovery %s : %s", pattern, config.Name, err)
+			}
+		}
+		this.provider = &fileDiscovery{files: config.Files, defaults: config.AdvancedRemoteWigoConfig}
+	case DISCOVERY_DNS:
+		if len(config.Names) == 0 {
+			return nil, fmt.Errorf("Missing Names for discovery %s", config.Name)
+		}
+		this.provider = &dnsDiscovery{names: config.Names, defaults: config.AdvancedRemoteWigoConfig, resolver: NewDiscoveryResolver(config.Resolver)}
+	case DISCOVERY_STATIC:
+		this.provider = &staticDiscovery{targets: config.Targets, defaults: config.AdvancedRemoteWigoConfig}
+	default:
+		return nil, fmt.Errorf("Unknown discovery type %s for discovery %s", config.Type, config.Name)
+	}
+
+	return
+}
+
+func (this *Discovery) Start() {
+	log.Printf("Discovery %s : starting %s discovery", this.config.Name, this.config.Type)
+
+	if provider, ok := this.provider.(*fileDiscovery); ok {
+		go provider.watch(this.refresh)
+	}
+
+	go func() {
+		for {
+			this.Refresh()
+
+			select {
+			case <-this.refresh:
+			case <-time.After(time.Duration(this.config.RefreshInterval) * time.Second):
+			}
+		}
+	}()
+}
+
+// Discover targets and update the remote wigos list. On errors
+// the previously discovered remotes are kept.
+func (this *Discovery) Refresh() {
+	remotes, err := this.provider.Discover()
+	if err != nil {
+		log.Printf("Discovery %s : %s", this.config.Name, err)
+		return
+	}
+
+	this.remotes.Sync(this.source, remotes)
+}
+
+// Merge the settings of a target group over the discovery defaults
+func mergeRemoteConfig(defaults AdvancedRemoteWigoConfig, override AdvancedRemoteWigoConfig) AdvancedRemoteWigoConfig {
+	merged := defaults
+	if override.Group != "" {
+		merged.Group = override.Group
+	}
+	if override.Port != 0 {
+		merged.Port = override.Port
+	}
+	if override.CheckInterval != 0 {
+		merged.CheckInterval = override.CheckInterval
+	}
+	if override.Timeout != 0 {
+		merged.Timeout = override.Timeout
+	}
+	if override.CheckRemotesDepth != 0 {
+		merged.CheckRemotesDepth = override.CheckRemotesDepth
+	}
+	if override.SslEnabled {
+		merged.SslEnabled = true
+	}
+	if override.SslCa != "" {
+		merged.SslCa = override.SslCa
+	}
+	if override.SslCert != "" {
+		merged.SslCert = override.SslCert
+		merged.SslKey = override.SslKey
+	}
+	if override.Login != "" {
+		merged.Login = override.Login
+		merged.Password = override.Password
+	}
+	return merged
+}
+
+// Build the remote of a "host" or "host:port" target
+func targetToRemoteConfig(target string, defaults AdvancedRemoteWigoConfig) (remote AdvancedRemoteWigoConfig, err error) {
+	remote = defaults
+	remote.Hostname = target
+
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		remote.Hostname = host
+		if remote.Port, err = strconv.Atoi(port); err != nil {
+			return remote, fmt.Errorf("Invalid port in target %s", target)
+		}
+	}
+
+	if remote.Hostname == "" {
+		return remote, fmt.Errorf("Invalid target %s", target)
+	}
+
+	return
+}
+
+func targetGroupsToRemoteConfigs(groups []DiscoveryTargetGroup, defaults AdvancedRemoteWigoConfig) (remotes []AdvancedRemoteWigoConfig, err error) {
+	for _, group := range groups {
+		settings := mergeRemoteConfig(defaults, group.AdvancedRemoteWigoConfig)
+		for _, target := range group.Targets {
+			remote, err := targetToRemoteConfig(target, settings)
+			if err != nil {
+				return nil, err
+			}
+			remotes = append(remotes, remote)
+		}
+	}
+	return
+}
+
+// Static list
+
+type staticDiscovery struct {
+	targets  []string
+	defaults AdvancedRemoteWigoConfig
+}
+
+func (this *staticDiscovery) Discover() ([]AdvancedRemoteWigoConfig, error) {
+	return targetGroupsToRemoteConfigs([]DiscoveryTargetGroup{{Targets: this.targets}}, this.defaults)
+}
+
+// Targets files
+
+type fileDiscovery struct {
+	files    []string
+	defaults AdvancedRemoteWigoConfig
+}
+
+func (this *fileDiscovery) Discover() (remotes []AdvancedRemoteWigoConfig, err error) {
+	for _, pattern := range this.files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			groups, err := readTargetsFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			fileRemotes, err := targetGroupsToRemoteConfigs(groups, this.defaults)
+			if err != nil {
+				return nil, fmt.Errorf("%s : %s", file, err)
+			}
+			remotes = append(remotes, fileRemotes...)
+		}
+	}
+
+	return
+}
+
+func readTargetsFile(file string) (groups []DiscoveryTargetGroup, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read targets file %s : %s", file, err)
+	}
+
+	if strings.HasSuffix(file, ".toml") {
+		targets := new(targetsFile)
+		if _, err = toml.Decode(string(content), targets); err != nil {
+			return nil, fmt.Errorf("Unable to decode targets file %s : %s", file, err)
+		}
+		return targets.TargetGroups, nil
+	}
+
+	if err = json.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("Unable to decode targets file %s : %s", file, err)
+	}
+
+	return
+}
+
+// Ask for a refresh when something changes in the
+// directories of the targets files
+func (this *fileDiscovery) watch(refresh chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Discovery : unable to watch targets files, falling back to periodic refresh : %s", err)
+		return
+	}
+
+	directories := make(map[string]bool)
+	for _, pattern := range this.files {
+		directory := filepath.Dir(pattern)
+		if directories[directory] {
+			continue
+		}
+		directories[directory] = true
+
+		if err = watcher.Watch(directory); err != nil {
+			log.Printf("Discovery : unable to watch %s : %s", directory, err)
+		}
+	}
+
+	for {
+		select {
+		case <-watcher.Event:
+			select {
+			case refresh <- struct{}{}:
+			default:
+			}
+		case err := <-watcher.Error:
+			log.Printf("Discovery : error watching targets files : %s", err)
+		}
+	}
+}
+
+// Dns
+
+// Subset of net.Resolver used by the dns discovery
+type DiscoveryResolver interface {
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Use the system resolver, or the given "ip:port" dns server
+func NewDiscoveryResolver(server string) DiscoveryResolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: 5 * time.Second}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+type dnsDiscovery struct {
+	names    []string
+	defaults AdvancedRemoteWigoConfig
+	resolver DiscoveryResolver
+}
+
+func (this *dnsDiscovery) Discover() (remotes []AdvancedRemoteWigoConfig, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, name := range this.names {
+		if strings.HasPrefix(name, "_") {
+			_, records, err := this.resolver.LookupSRV(ctx, "", "", name)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to resolve SRV %s : %s", name, err)
+			}
+
+			for _, record := range records {
+				remote := this.defaults
+				remote.Hostname = strings.TrimSuffix(record.Target, ".")
+				remote.Port = int(record.Port)
+				remotes = append(remotes, remote)
+			}
+		} else {
+			addresses, err := this.resolver.LookupHost(ctx, name)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to resolve %s : %s", name, err)
+			}
+
+			sort.Strings(addresses)
+			for _, address := range addresses {
+				remote := this.defaults
+				remote.Hostname = address
+				remotes = append(remotes, remote)
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,303 @@
+package wigo
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Resolver answering from fixed SRV and A records
+type stubResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (this *stubResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	records, ok := this.srv[name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, records, nil
+}
+
+func (this *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addresses, ok := this.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addresses, nil
+}
+
+func TestMergeRemoteConfig(t *testing.T) {
+	defaults := AdvancedRemoteWigoConfig{Port: 4000, Group: "default", CheckInterval: 10, SslCa: "/etc/wigo/ca.crt", Login: "user", Password: "pass"}
+
+	tests := []struct {
+		name     string
+		override AdvancedRemoteWigoConfig
+		expected AdvancedRemoteWigoConfig
+	}{
+		{
+			name:     "no override",
+			expected: defaults,
+		},
+		{
+			name:     "group and port",
+			override: AdvancedRemoteWigoConfig{Group: "web", Port: 4001},
+			expected: AdvancedRemoteWigoConfig{Port: 4001, Group: "web", CheckInterval: 10, SslCa: "/etc/wigo/ca.crt", Login: "user", Password: "pass"},
+		},
+		{
+			name:     "tls",
+			override: AdvancedRemoteWigoConfig{SslEnabled: true, SslCert: "/etc/wigo/client.crt", SslKey: "/etc/wigo/client.key"},
+			expected: AdvancedRemoteWigoConfig{Port: 4000, Group: "default", CheckInterval: 10, SslEnabled: true, SslCa: "/etc/wigo/ca.crt", SslCert: "/etc/wigo/client.crt", SslKey: "/etc/wigo/client.key", Login: "user", Password: "pass"},
+		},
+		{
+			name:     "credentials are replaced together",
+			override: AdvancedRemoteWigoConfig{Login: "other"},
+			expected: AdvancedRemoteWigoConfig{Port: 4000, Group: "default", CheckInterval: 10, SslCa: "/etc/wigo/ca.crt", Login: "other"},
+		},
+	}
+
+	for _, test := range tests {
+		if merged := mergeRemoteConfig(defaults, test.override); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s : expected %+v, got %+v", test.name, test.expected, merged)
+		}
+	}
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	defaults := AdvancedRemoteWigoConfig{Port: 4000, Group: "static", SslEnabled: true}
+
+	tests := []struct {
+		name     string
+		targets  []string
+		expected []AdvancedRemoteWigoConfig
+		err      bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "hosts and ports",
+			targets: []string{"host1", "host2:4001", "[::1]:4002"},
+			expected: []AdvancedRemoteWigoConfig{
+				{Hostname: "host1", Port: 4000, Group: "static", SslEnabled: true},
+				{Hostname: "host2", Port: 4001, Group: "static", SslEnabled: true},
+				{Hostname: "::1", Port: 4002, Group: "static", SslEnabled: true},
+			},
+		},
+		{
+			name:    "invalid port",
+			targets: []string{"host1:http"},
+			err:     true,
+		},
+		{
+			name:    "missing host",
+			targets: []string{":4000"},
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		discovery, err := NewDiscovery(DiscoveryConfig{Name: "test", Type: DISCOVERY_STATIC, RefreshInterval: 60, Targets: test.targets, AdvancedRemoteWigoConfig: defaults}, nil)
+		if err != nil {
+			t.Fatalf("%s : %s", test.name, err)
+		}
+
+		remotes, err := discovery.provider.Discover()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s : expected an error, got %+v", test.name, remotes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : %s", test.name, err)
+		} else if !reflect.DeepEqual(remotes, test.expected) {
+			t.Errorf("%s : expected %+v, got %+v", test.name, test.expected, remotes)
+		}
+	}
+}
+
+func TestDnsDiscovery(t *testing.T) {
+	resolver := &stubResolver{
+		srv: map[string][]*net.SRV{
+			"_wigo._tcp.example.com": {
+				{Target: "host1.example.com.", Port: 4000},
+				{Target: "host2.example.com.", Port: 4001},
+			},
+		},
+		hosts: map[string][]string{
+			"web.example.com": {"10.0.0.2", "10.0.0.1"},
+		},
+	}
+	defaults := AdvancedRemoteWigoConfig{Port: 4000, Group: "dns", Timeout: 5}
+
+	tests := []struct {
+		name     string
+		names    []string
+		expected []AdvancedRemoteWigoConfig
+		err      bool
+	}{
+		{
+			name:  "srv records",
+			names: []string{"_wigo._tcp.example.com"},
+			expected: []AdvancedRemoteWigoConfig{
+				{Hostname: "host1.example.com", Port: 4000, Group: "dns", Timeout: 5},
+				{Hostname: "host2.example.com", Port: 4001, Group: "dns", Timeout: 5},
+			},
+		},
+		{
+			name:  "a records use the default port",
+			names: []string{"web.example.com"},
+			expected: []AdvancedRemoteWigoConfig{
+				{Hostname: "10.0.0.1", Port: 4000, Group: "dns", Timeout: 5},
+				{Hostname: "10.0.0.2", Port: 4000, Group: "dns", Timeout: 5},
+			},
+		},
+		{
+			name:  "unknown srv name",
+			names: []string{"_wigo._tcp.example.com", "_wigo._tcp.unknown.com"},
+			err:   true,
+		},
+		{
+			name:  "unknown name",
+			names: []string{"unknown.example.com"},
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		discovery, err := NewDiscovery(DiscoveryConfig{Name: "test", Type: DISCOVERY_DNS, RefreshInterval: 60, Names: test.names, AdvancedRemoteWigoConfig: defaults}, nil)
+		if err != nil {
+			t.Fatalf("%s : %s", test.name, err)
+		}
+		discovery.provider.(*dnsDiscovery).resolver = resolver
+
+		remotes, err := discovery.provider.Discover()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s : expected an error, got %+v", test.name, remotes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : %s", test.name, err)
+		} else if !reflect.DeepEqual(remotes, test.expected) {
+			t.Errorf("%s : expected %+v, got %+v", test.name, test.expected, remotes)
+		}
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	defaults := AdvancedRemoteWigoConfig{Port: 4000, Group: "file"}
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected []AdvancedRemoteWigoConfig
+		err      bool
+	}{
+		{
+			name:    "json",
+			file:    "targets.json",
+			content: `[ { "targets": [ "host1:4001", "host2" ], "group": "web" }, { "targets": [ "host3" ] } ]`,
+			expected: []AdvancedRemoteWigoConfig{
+				{Hostname: "host1", Port: 4001, Group: "web"},
+				{Hostname: "host2", Port: 4000, Group: "web"},
+				{Hostname: "host3", Port: 4000, Group: "file"},
+			},
+		},
+		{
+			name:    "toml",
+			file:    "targets.toml",
+			content: "[[TargetGroups]]\nTargets = [ \"host1\" ]\nGroup = \"db\"\nSslEnabled = true\n",
+			expected: []AdvancedRemoteWigoConfig{
+				{Hostname: "host1", Port: 4000, Group: "db", SslEnabled: true},
+			},
+		},
+		{
+			name:    "invalid json",
+			file:    "targets.json",
+			content: `[ { "targets": `,
+			err:     true,
+		},
+		{
+			name:    "invalid target",
+			file:    "targets.json",
+			content: `[ { "targets": [ "host1:http" ] } ]`,
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		directory := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(directory, test.file), []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		discovery, err := NewDiscovery(DiscoveryConfig{Name: "test", Type: DISCOVERY_FILE, RefreshInterval: 60, Files: []string{filepath.Join(directory, "*")}, AdvancedRemoteWigoConfig: defaults}, nil)
+		if err != nil {
+			t.Fatalf("%s : %s", test.name, err)
+		}
+
+		remotes, err := discovery.provider.Discover()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s : expected an error, got %+v", test.name, remotes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : %s", test.name, err)
+		} else if !reflect.DeepEqual(remotes, test.expected) {
+			t.Errorf("%s : expected %+v, got %+v", test.name, test.expected, remotes)
+		}
+	}
+}
+
+func TestFileDiscoveryReloadsOnChange(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, "targets.json")
+	if err := ioutil.WriteFile(file, []byte(`[ { "targets": [ "host1" ] } ]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &fileDiscovery{files: []string{filepath.Join(directory, "*.json")}, defaults: AdvancedRemoteWigoConfig{Port: 4000}}
+	refresh := make(chan struct{}, 1)
+	go provider.watch(refresh)
+
+	remotes, err := provider.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 1 || remotes[0].Hostname != "host1" {
+		t.Fatalf("expected host1, got %+v", remotes)
+	}
+
+	// Leave the watcher some time to start
+	time.Sleep(100 * time.Millisecond)
+	if err := ioutil.WriteFile(file, []byte(`[ { "targets": [ "host2", "host3" ] } ]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-refresh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no refresh after the targets file changed")
+	}
+
+	remotes, err = provider.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AdvancedRemoteWigoConfig{{Hostname: "host2", Port: 4000}, {Hostname: "host3", Port: 4000}}
+	if !reflect.DeepEqual(remotes, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, remotes)
+	}
+}
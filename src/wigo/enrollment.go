@@ -0,0 +1,304 @@
+package wigo
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Push clients may enroll a client certificate instead of using a
+// uuid signature. The client generates a key and sends a certificate
+// signing request, once the client is allowed the authority signs a
+// short-lived certificate whose common name is the client's uuid.
+// Subsequent connections use mutual tls.
+//
+// A client enrolls once, then renews its certificate over a mutual
+// tls connection before it expires. The certificate it replaces is
+// revoked. Revoking a client revokes its certificate, the revocation
+// list is checked on every connection. A client which lost its
+// certificate has to be revoked and allowed again to enroll.
+
+// The certificate issued to a client, or revoked
+type ClientCertificate struct {
+	Uuid     string
+	Serial   string
+	NotAfter int64
+}
+
+func (this *Authority) loadClientCertificates(file string) (certificates map[string]*ClientCertificate) {
+	certificates = make(map[string]*ClientCertificate)
+
+	handle, err := os.Open(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("Authority : Error opening %s : %s", file, err)
+		}
+		return
+	}
+	defer handle.Close()
+
+	// Format is "serial uuid notafter"
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			log.Printf("Authority : Ignoring invalid line in %s : %s", file, scanner.Text())
+			continue
+		}
+		notAfter, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			log.Printf("Authority : Ignoring invalid line in %s : %s", file, scanner.Text())
+			continue
+		}
+		certificates[fields[0]] = &ClientCertificate{Serial: fields[0], Uuid: fields[1], NotAfter: notAfter}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Authority : Error while loading %s : %s", file, err)
+	}
+
+	return
+}
+
+func (this *Authority) saveClientCertificates(file string, certificates map[string]*ClientCertificate) (err error) {
+	handle, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Authority : Failed to save %s : %s", file, err)
+	}
+	defer handle.Close()
+
+	now := time.Now().Unix()
+	for serial, certificate := range certificates {
+		// Expired certificates don't need to be revoked anymore
+		if certificate.NotAfter < now {
+			delete(certificates, serial)
+			continue
+		}
+		fmt.Fprintf(handle, "%s %s %d\n", certificate.Serial, certificate.Uuid, certificate.NotAfter)
+	}
+	return
+}
+
+// Check if a certificate has already been issued to the client
+func (this *Authority) IsEnrolled(uuid string) bool {
+	this.certLocker.Lock()
+	defer this.certLocker.Unlock()
+
+	return this.enrolledCertificate(uuid) != nil
+}
+
+func (this *Authority) enrolledCertificate(uuid string) *ClientCertificate {
+	for _, certificate := range this.Enrolled {
+		if certificate.Uuid == uuid {
+			return certificate
+		}
+	}
+	return nil
+}
+
+// Sign the certificate signing request of a client
+func (this *Authority) IssueClientCertificate(uuid string, hostname string, csrPem []byte) (certPem []byte, err error) {
+	block, _ := pem.Decode(csrPem)
+	if block == nil {
+		return nil, errors.New("INVALID CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.New("INVALID CSR")
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.New("INVALID CSR")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	validity := time.Duration(this.config.ClientCertValidity) * time.Hour
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   uuid,
+			Organization: []string{"wigo"},
+		},
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, this.certificate, csr.PublicKey, this.privateKey)
+	if err != nil {
+		log.Printf("Authority : Failed to sign client certificate for %s : %s", hostname, err)
+		return nil, errors.New("CANNOT SIGN")
+	}
+
+	this.certLocker.Lock()
+	defer this.certLocker.Unlock()
+
+	// The previous certificate of the client is replaced
+	if previous := this.enrolledCertificate(uuid); previous != nil {
+		delete(this.Enrolled, previous.Serial)
+		this.Revoked[previous.Serial] = previous
+		this.replicate(PEER_REPLICATE_CERTIFICATE, &replicatedCertificate{ClientCertificate: *previous, Revoked: true})
+	}
+	certificate := &ClientCertificate{Uuid: uuid, Serial: serial.Text(16), NotAfter: template.NotAfter.Unix()}
+	this.Enrolled[certificate.Serial] = certificate
+	if err = this.saveCertificateLists(); err != nil {
+		log.Println(err)
+	}
+	this.replicate(PEER_REPLICATE_CERTIFICATE, &replicatedCertificate{ClientCertificate: *certificate})
+
+	this.store.Audit(uuid, hostname, "certificate issued", "", serial.Text(16))
+
+	message := fmt.Sprintf("Client certificate issued to %s, valid until %s", hostname, template.NotAfter.Format(time.RFC3339))
+	log.Printf("Authority : %s", message)
+	LocalWigo.AddLog(LocalWigo, INFO, message)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func (this *Authority) saveCertificateLists() (err error) {
+	if err = this.saveClientCertificates(this.config.EnrolledClientsFile, this.Enrolled); err != nil {
+		return
+	}
+	return this.saveClientCertificates(this.config.RevokedCertsFile, this.Revoked)
+}
+
+// Revoke the certificate issued to a client
+func (this *Authority) RevokeClientCertificate(uuid string) {
+	this.certLocker.Lock()
+	defer this.certLocker.Unlock()
+
+	if certificate := this.enrolledCertificate(uuid); certificate != nil {
+		delete(this.Enrolled, certificate.Serial)
+		this.Revoked[certificate.Serial] = certificate
+		if err := this.saveCertificateLists(); err != nil {
+			log.Println(err)
+		}
+		this.replicate(PEER_REPLICATE_CERTIFICATE, &replicatedCertificate{ClientCertificate: *certificate, Revoked: true})
+		this.store.Audit(uuid, this.GetHostname(uuid), "certificate revoked", "", certificate.Serial)
+		log.Printf("Authority : certificate %s of %s revoked", certificate.Serial, uuid)
+	}
+}
+
+// Apply a certificate issued or revoked by a push server peer
+func (this *Authority) ReplicateClientCertificate(certificate *ClientCertificate, revoked bool) {
+	this.certLocker.Lock()
+	defer this.certLocker.Unlock()
+
+	if revoked {
+		delete(this.Enrolled, certificate.Serial)
+		this.Revoked[certificate.Serial] = certificate
+	} else if _, ok := this.Revoked[certificate.Serial]; !ok {
+		this.Enrolled[certificate.Serial] = certificate
+	}
+	if err := this.saveCertificateLists(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Serials of the enrolled certificates by uuid, and
+// uuids of the revoked certificates by serial
+func (this *Authority) ListClientCertificates() (enrolled map[string]string, revoked map[string]string) {
+	this.certLocker.Lock()
+	defer this.certLocker.Unlock()
+
+	enrolled = make(map[string]string)
+	for serial, certificate := range this.Enrolled {
+		enrolled[certificate.Uuid] = serial
+	}
+	revoked = make(map[string]string)
+	for serial, certificate := range this.Revoked {
+		revoked[serial] = certificate.Uuid
+	}
+	return
+}
+
+// Verify a client certificate presented on a new connection,
+// the chain has already been verified by the tls handshake
+func (this *Authority) VerifyClientCertificate(cert *x509.Certificate) (err error) {
+	this.certLocker.Lock()
+	_, revoked := this.Revoked[cert.SerialNumber.Text(16)]
+	this.certLocker.Unlock()
+
+	if revoked {
+		return fmt.Errorf("certificate %s of %s is revoked", cert.SerialNumber.Text(16), cert.Subject.CommonName)
+	}
+	if isPeerCertificate(cert) {
+		return
+	}
+	if !this.IsAllowed(cert.Subject.CommonName) {
+		return fmt.Errorf("client %s is not allowed", cert.Subject.CommonName)
+	}
+	return
+}
+
+// Client side
+
+// Load the client certificate, if it exists and has not expired
+func loadClientCertificate(certFile string, keyFile string) (pair tls.Certificate, certificate *x509.Certificate, err error) {
+	if pair, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return
+	}
+	if certificate, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return
+	}
+	if time.Now().After(certificate.NotAfter) {
+		err = fmt.Errorf("client certificate %s expired on %s", certFile, certificate.NotAfter.Format(time.RFC3339))
+	}
+	return
+}
+
+// Load the client key or generate it
+func loadOrCreateClientKey(keyFile string) (key *ecdsa.PrivateKey, err error) {
+	if keyPem, err := ioutil.ReadFile(keyFile); err == nil {
+		block, _ := pem.Decode(keyPem)
+		if block == nil {
+			return nil, fmt.Errorf("Unable to decode pem key from %s", keyFile)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	log.Printf("Push client : generating client key %s", keyFile)
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return
+}
+
+func newClientCsr(key *ecdsa.PrivateKey) (csrPem []byte, err error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: LocalWigo.Uuid},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// Renew when less than a third of the validity remains
+func clientCertificateNeedsRenewal(certificate *x509.Certificate) bool {
+	validity := certificate.NotAfter.Sub(certificate.NotBefore)
+	return time.Until(certificate.NotAfter) < validity/3
+}
@@ -0,0 +1,356 @@
+package wigo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Enrollment tokens let provisioning pipelines onboard push clients
+// without an admin action. A client presenting a valid token when it
+// registers is allowed at once. Tokens have a limited number of uses,
+// may expire and may be restricted to hostnames matching a pattern.
+// Clients allowed by a token without a group are put in its group.
+//
+// Like api tokens, a token is made of the token name and a random
+// secret separated by a dot, only a bcrypt hash of the secret is kept.
+
+type EnrollmentToken struct {
+	Name            string
+	MaxUses         int
+	Uses            int
+	Expires         int64  `toml:",omitempty" json:",omitempty"`
+	HostnamePattern string `toml:",omitempty" json:",omitempty"`
+	Group           string `toml:",omitempty" json:",omitempty"`
+	Created         int64
+	LastUsed        int64 `toml:",omitempty" json:",omitempty"`
+
+	SecretHash string `json:"-"`
+}
+
+type enrollmentTokensFile struct {
+	Tokens []*EnrollmentToken
+
+	// Group of the clients allowed with a token, by uuid
+	Groups map[string]string
+}
+
+type EnrollmentTokens struct {
+	file   string
+	locker *sync.Mutex
+
+	tokens map[string]*EnrollmentToken
+	groups map[string]string
+
+	// Sends the changes to the push server peers
+	replicate func(kind string, value interface{})
+}
+
+func NewEnrollmentTokens(file string) (this *EnrollmentTokens) {
+	this = new(EnrollmentTokens)
+	this.file = file
+	this.locker = new(sync.Mutex)
+	this.tokens = make(map[string]*EnrollmentToken)
+	this.groups = make(map[string]string)
+
+	if err := this.load(); err != nil {
+		log.Fatalf("Authority : %s", err)
+	}
+
+	return
+}
+
+func (this *EnrollmentTokens) load() (err error) {
+	if _, err = os.Stat(this.file); err != nil {
+		return nil
+	}
+
+	content := new(enrollmentTokensFile)
+	if _, err = toml.DecodeFile(this.file, content); err != nil {
+		return fmt.Errorf("Unable to load enrollment tokens file %s : %s", this.file, err)
+	}
+
+	for _, token := range content.Tokens {
+		this.tokens[token.Name] = token
+	}
+	for uuid, group := range content.Groups {
+		this.groups[uuid] = group
+	}
+
+	return
+}
+
+// Must be called with the lock held
+func (this *EnrollmentTokens) save() (err error) {
+	content, err := this.encodeLocked()
+	if err != nil {
+		return
+	}
+	if err = this.write(content); err != nil {
+		return
+	}
+
+	this.replicate(PEER_REPLICATE_TOKENS, string(content))
+	return
+}
+
+func (this *EnrollmentTokens) encode() (content []byte, err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	return this.encodeLocked()
+}
+
+// Must be called with the lock held
+func (this *EnrollmentTokens) encodeLocked() (content []byte, err error) {
+	file := new(enrollmentTokensFile)
+	for _, token := range this.tokens {
+		file.Tokens = append(file.Tokens, token)
+	}
+	file.Groups = this.groups
+
+	buffer := new(bytes.Buffer)
+	if err = toml.NewEncoder(buffer).Encode(file); err != nil {
+		return nil, fmt.Errorf("Unable to encode enrollment tokens file : %s", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (this *EnrollmentTokens) write(content []byte) (err error) {
+	tmp := this.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("Unable to write enrollment tokens file %s : %s", tmp, err)
+	}
+	return os.Rename(tmp, this.file)
+}
+
+// Replace the tokens by the ones sent by a push server peer
+func (this *EnrollmentTokens) Replace(content []byte) (err error) {
+	file := new(enrollmentTokensFile)
+	if _, err = toml.Decode(string(content), file); err != nil {
+		return fmt.Errorf("Unable to decode enrollment tokens : %s", err)
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.tokens = make(map[string]*EnrollmentToken)
+	for _, token := range file.Tokens {
+		this.tokens[token.Name] = token
+	}
+	this.groups = make(map[string]string)
+	for uuid, group := range file.Groups {
+		this.groups[uuid] = group
+	}
+	return this.write(content)
+}
+
+// Create a new enrollment token valid for maxUses registrations
+// (at least one) and ttl seconds (0 never expires). The token
+// is returned only once, only its hash is kept.
+func (this *EnrollmentTokens) Create(name string, maxUses int, ttl int64, hostnamePattern string, group string) (token string, err error) {
+	if name == "" || strings.ContainsAny(name, ":. ") {
+		return "", errors.New("Invalid enrollment token name " + name)
+	}
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	if ttl < 0 {
+		return "", fmt.Errorf("Invalid enrollment token ttl %d", ttl)
+	}
+	if _, err = path.Match(hostnamePattern, ""); err != nil {
+		return "", errors.New("Invalid hostname pattern " + hostnamePattern)
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", err
+	}
+	token = name + "." + hex.EncodeToString(secret)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	enrollmentToken := &EnrollmentToken{
+		Name:            name,
+		MaxUses:         maxUses,
+		HostnamePattern: hostnamePattern,
+		Group:           group,
+		Created:         time.Now().Unix(),
+		SecretHash:      string(hash),
+	}
+	if ttl > 0 {
+		enrollmentToken.Expires = time.Now().Unix() + ttl
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if _, ok := this.tokens[name]; ok {
+		return "", errors.New("Enrollment token " + name + " already exists")
+	}
+	this.tokens[name] = enrollmentToken
+
+	if err = this.save(); err != nil {
+		delete(this.tokens, name)
+		return "", err
+	}
+
+	return
+}
+
+func (this *EnrollmentTokens) Delete(name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	token, ok := this.tokens[name]
+	if !ok {
+		return errors.New("Unknown enrollment token " + name)
+	}
+	delete(this.tokens, name)
+
+	if err = this.save(); err != nil {
+		this.tokens[name] = token
+	}
+
+	return
+}
+
+func (this *EnrollmentTokens) List() (list []*EnrollmentToken) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	list = make([]*EnrollmentToken, 0)
+	for _, token := range this.tokens {
+		copy := *token
+		list = append(list, &copy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return
+}
+
+// Verify a token presented by a client and count its use
+func (this *EnrollmentTokens) Use(token string, hostname string) (enrollmentToken *EnrollmentToken, err error) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return nil, errors.New("invalid enrollment token")
+	}
+	name := token[:i]
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	enrollmentToken, ok := this.tokens[name]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(enrollmentToken.SecretHash), []byte(token[i+1:])) != nil {
+		return nil, errors.New("invalid enrollment token " + name)
+	}
+	if enrollmentToken.Expires != 0 && time.Now().Unix() > enrollmentToken.Expires {
+		return nil, errors.New("enrollment token " + name + " has expired")
+	}
+	if enrollmentToken.Uses >= enrollmentToken.MaxUses {
+		return nil, errors.New("enrollment token " + name + " has already been used")
+	}
+	if enrollmentToken.HostnamePattern != "" {
+		if ok, _ := path.Match(enrollmentToken.HostnamePattern, hostname); !ok {
+			return nil, errors.New("enrollment token " + name + " is not valid for " + hostname)
+		}
+	}
+
+	enrollmentToken.Uses++
+	enrollmentToken.LastUsed = time.Now().Unix()
+	if err = this.save(); err != nil {
+		enrollmentToken.Uses--
+		return nil, err
+	}
+
+	copy := *enrollmentToken
+	return &copy, nil
+}
+
+// Group given to a client allowed with a token
+func (this *EnrollmentTokens) Group(uuid string) string {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	return this.groups[uuid]
+}
+
+func (this *EnrollmentTokens) SetGroup(uuid string, group string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if group == "" {
+		if _, ok := this.groups[uuid]; !ok {
+			return
+		}
+		delete(this.groups, uuid)
+	} else {
+		this.groups[uuid] = group
+	}
+	return this.save()
+}
+
+// Allow a client presenting a valid enrollment token. Every use
+// of a token, successful or not, is logged and audited.
+func (this *Authority) AllowClientWithToken(uuid string, hostname string, address net.IP, token string) (err error) {
+	enrollmentToken, err := this.EnrollmentTokens.Use(token, hostname)
+	if err != nil {
+		this.store.Audit(uuid, hostname, "enrollment token refused", "", err.Error())
+		message := fmt.Sprintf("Enrollment token refused for %s : %s", hostname, err)
+		log.Printf("Authority : %s", message)
+		LocalWigo.AddLog(LocalWigo, WARNING, message)
+		return
+	}
+
+	if err := this.EnrollmentTokens.SetGroup(uuid, enrollmentToken.Group); err != nil {
+		log.Printf("Authority : %s", err)
+	}
+
+	approver := "enrollment token " + enrollmentToken.Name
+	uses := fmt.Sprintf("%d/%d uses", enrollmentToken.Uses, enrollmentToken.MaxUses)
+	_, err = this.store.Update(uuid, hostname, "allowed", approver, uses, func(client *AuthorityClient) error {
+		client.State = CLIENT_ALLOWED
+		client.Hostname = hostname
+		client.Address = address.String()
+		client.Approver = approver
+		client.Approved = time.Now().Unix()
+		client.Revoked = 0
+		client.RevocationReason = ""
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	message := fmt.Sprintf("%s added to allowed list with enrollment token %s (%s)", hostname, enrollmentToken.Name, uses)
+	log.Printf("Authority : %s", message)
+	LocalWigo.AddLog(LocalWigo, INFO, message)
+	return
+}
+
+// Put a client allowed with a token in the token's group if it has none
+func (this *Authority) SetDefaultGroup(wigo *Wigo) {
+	if wigo.LocalHost != nil && (wigo.LocalHost.Group == "" || wigo.LocalHost.Group == "none") {
+		if group := this.EnrollmentTokens.Group(wigo.Uuid); group != "" {
+			wigo.LocalHost.Group = group
+		}
+	}
+}
@@ -8,9 +8,9 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"container/list"
 	"errors"
 	"io/ioutil"
 	"path/filepath"
@@ -36,21 +36,34 @@ type Wigo struct {
 	GlobalStatus  int
 	GlobalMessage string
 
+	// Revision of the state, see changes.go
+	Epoch    string
+	Revision uint64
+
 	LocalHost   *Host
 	RemoteWigos *concurrentMapWigos
 
 	Hostname       string
-	config         *Config
 	locker         *sync.RWMutex
 	logfilehandle  *os.File
-	gopentsdb      *gopentsdb.OpenTsdb
-	disabledProbes *list.List
+	disabledProbes *DisabledProbesStore
 	uuidObj        *uuid.UUID
 	sqlLiteConn    *sql.DB
 	sqlLiteLock    *sync.Mutex
 
 	push       *PushServer
+	pushClient *PushTargets
+	users      *UsersStore
+	remotes    *RemotesManager
+	changes    *changesJournal
 	LastUpdate int64
+
+	// Replaced as a whole when the configuration is reloaded, see reload.go
+	config    atomic.Pointer[Config]
+	gopentsdb atomic.Pointer[gopentsdb.OpenTsdb]
+
+	// Push server peer this remote wigo is replicated from, see push_peers.go
+	peer string
 }
 
 var Version = "##VERSION##"
@@ -58,7 +71,7 @@ var Version = "##VERSION##"
 func NewWigo(config *Config) (this *Wigo, err error) {
 	this = new(Wigo)
 
-	this.config = config
+	this.config.Store(config)
 
 	this.IsAlive = true
 	this.Version = Version
@@ -67,8 +80,8 @@ func NewWigo(config *Config) (this *Wigo, err error) {
 	log.Printf("Wigo version is : %s", this.Version)
 
 	// Load uuid
-	if _, err = os.Stat(this.config.Global.UuidFile); err == nil {
-		if uuidBytes, err := ioutil.ReadFile(this.config.Global.UuidFile); err == nil {
+	if _, err = os.Stat(config.Global.UuidFile); err == nil {
+		if uuidBytes, err := ioutil.ReadFile(config.Global.UuidFile); err == nil {
 			this.Uuid = string(uuidBytes)
 		} else {
 			log.Fatalf("Unable to read uuid file : %s", err)
@@ -84,7 +97,7 @@ func NewWigo(config *Config) (this *Wigo, err error) {
 		}
 
 		// Save UUID
-		uuidFile, err := os.OpenFile(this.config.Global.UuidFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		uuidFile, err := os.OpenFile(config.Global.UuidFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err == nil {
 			uuidFile.Write([]byte(this.Uuid))
 			uuidFile.Close()
@@ -93,28 +106,14 @@ func NewWigo(config *Config) (this *Wigo, err error) {
 		}
 	}
 
-	// Get hostname
-	if this.config.Global.Hostname == "" {
-		// Get hostname
-		localHostname, err := os.Hostname()
-		if err == nil {
-			this.config.Global.Hostname = localHostname
-		} else {
-			log.Println("Couldn't get hostname for local machine, using localhost")
-			this.config.Global.Hostname = "localhost"
-		}
-	}
-
-	// Get groupname
-	if this.config.Global.Group == "" {
-		this.config.Global.Group = "local"
-	}
+	// Get hostname and groupname
+	config.Global.SetDefaultHostnameAndGroup()
 
 	// Init LocalHost
-	this.Hostname = this.config.Global.Hostname
+	this.Hostname = config.Global.Hostname
 	this.LocalHost = NewHost()
-	this.LocalHost.Name = this.config.Global.Hostname
-	this.LocalHost.Group = this.config.Global.Group
+	this.LocalHost.Name = config.Global.Hostname
+	this.LocalHost.Group = config.Global.Group
 	this.LocalHost.parentWigo = this
 
 	// Init RemoteWigos list
@@ -122,7 +121,6 @@ func NewWigo(config *Config) (this *Wigo, err error) {
 
 	// Private vars
 	this.locker = new(sync.RWMutex)
-	this.disabledProbes = new(list.List)
 
 	return
 }
@@ -149,6 +147,7 @@ Options:
 	-h 	--help
 	-v 	--version
 	-c, --config CONFIG		Specify config file
+	--check-config  		Check the config file and the probes config files, then exit
 `
 
 	// Parse args
@@ -164,6 +163,10 @@ Options:
 		}
 	}
 
+	if arguments["--check-config"] == true {
+		os.Exit(CheckConfig(configFile))
+	}
+
 	LocalWigo, err = NewWigo(NewConfig(configFile))
 	if err != nil {
 		return err
@@ -171,6 +174,9 @@ Options:
 
 	config := LocalWigo.GetConfig()
 
+	// Revisions of the state
+	LocalWigo.initChanges()
+
 	// Log file
 	LocalWigo.InitOrReloadLogger()
 
@@ -183,25 +189,38 @@ Options:
 	// Init channels
 	InitChannels()
 
-	// Rpc
-	if LocalWigo.config.PushServer.Enabled {
-		runtime.GOMAXPROCS(runtime.NumCPU())
-		LocalWigo.push = NewPushServer(LocalWigo.config.PushServer)
+	// Http users and tokens
+	LocalWigo.users = NewUsersStore(config.Http.UsersFile)
+
+	// Probes disabled through the api or by exit code 13
+	LocalWigo.disabledProbes = NewDisabledProbesStore(config.Global.DisabledProbesFile)
+
+	// Remote wigos
+	LocalWigo.remotes = NewRemotesManager(config.RemoteWigos)
+
+	// Rpc, the push server is started once the database is opened
+	// as the authority state is stored in it
+	if config.PushClient.Enabled {
+		if LocalWigo.pushClient, err = NewPushTargets(config.PushClient); err != nil {
+			log.Fatalf("Push client : %s", err)
+		}
 	}
 
 	// OpenTSDB
-	if LocalWigo.config.OpenTSDB.Enabled {
-		if LocalWigo.gopentsdb, err = gopentsdb.NewOpenTsdb(config.OpenTSDB.Address, config.OpenTSDB.SslEnabled, config.OpenTSDB.Deduplication, config.OpenTSDB.BufferSize); err != nil {
+	if config.OpenTSDB.Enabled {
+		tsdb, err := gopentsdb.NewOpenTsdb(config.OpenTSDB.Address, config.OpenTSDB.SslEnabled, config.OpenTSDB.Deduplication, config.OpenTSDB.BufferSize)
+		if err != nil {
 			log.Fatal(err)
 		}
+		LocalWigo.gopentsdb.Store(tsdb)
 		gopentsdb.Verbose(config.Global.Debug)
 	}
 
 	// SqlLite
 	LocalWigo.sqlLiteLock = new(sync.Mutex)
-	LocalWigo.sqlLiteConn, err = sql.Open("sqlite", LocalWigo.config.Global.Database)
+	LocalWigo.sqlLiteConn, err = sql.Open("sqlite", config.Global.Database)
 	if err != nil {
-		log.Fatalf("Fail to init sqllite database %s : %s", LocalWigo.config.Global.Database, err)
+		log.Fatalf("Fail to init sqllite database %s : %s", config.Global.Database, err)
 	}
 
 	sqlStmt := `
@@ -212,6 +231,12 @@ Options:
 		log.Fatalf("Fail to create table in sqlite database : %s\n", err)
 	}
 
+	// Push server
+	if config.PushServer.Enabled {
+		runtime.GOMAXPROCS(runtime.NumCPU())
+		LocalWigo.push = NewPushServer(config.PushServer)
+	}
+
 	// Launch cleaning routing
 	go func() {
 		for {
@@ -229,6 +254,14 @@ Options:
 		}
 	}()
 
+	// Expiring certificates
+	go func() {
+		for {
+			CheckCertificatesExpiry(LocalWigo.GetConfig())
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+
 	// UP / DOWN
 	go func() {
 		for {
@@ -238,10 +271,12 @@ Options:
 				if host.LastUpdate < now-int64(config.Global.AliveTimeout) {
 					if host.IsAlive {
 						host.Down()
+						LocalWigo.RemoteWigoChanged(host.Uuid)
 					}
 				} else {
 					if !host.IsAlive {
 						host.Up()
+						LocalWigo.RemoteWigoChanged(host.Uuid)
 					}
 				}
 			}
@@ -293,8 +328,10 @@ func (this *Wigo) Down() {
 	this.GlobalMessage = "DOWN"
 	this.IsAlive = false
 
-	// Send notification
-	SendNotification(NewNotificationFromMessage(fmt.Sprintf("Host %s DOWN", this.Hostname)))
+	// Send notification, the peer the host pushes to sends it
+	if this.peer == "" {
+		SendNotification(NewNotificationFromMessage(fmt.Sprintf("Host %s DOWN", this.Hostname)))
+	}
 
 	// Add a log
 	LocalWigo.AddLog(this, CRITICAL, fmt.Sprintf("Wigo %s DOWN", this.Hostname))
@@ -304,8 +341,10 @@ func (this *Wigo) Up() {
 	this.GlobalMessage = "UP"
 	this.IsAlive = true
 
-	// Send notification
-	SendNotification(NewNotificationFromMessage(fmt.Sprintf("Host %s UP", this.Hostname)))
+	// Send notification, the peer the host pushes to sends it
+	if this.peer == "" {
+		SendNotification(NewNotificationFromMessage(fmt.Sprintf("Host %s UP", this.Hostname)))
+	}
 
 	// Add a log
 	LocalWigo.AddLog(this, INFO, fmt.Sprintf("Wigo %s UP", this.Hostname))
@@ -334,7 +373,16 @@ func (this *Wigo) GetLocalHost() *Host {
 }
 
 func (this *Wigo) GetConfig() *Config {
-	return this.config
+	return this.config.Load()
+}
+
+func (this *Wigo) GetRemotes() *RemotesManager {
+	return this.remotes
+}
+
+// Nil if the push client is disabled
+func (this *Wigo) GetPushTargets() *PushTargets {
+	return this.pushClient
 }
 
 func (this *Wigo) GetHostname() string {
@@ -342,7 +390,7 @@ func (this *Wigo) GetHostname() string {
 }
 
 func (this *Wigo) GetOpenTsdb() *gopentsdb.OpenTsdb {
-	return this.gopentsdb
+	return this.gopentsdb.Load()
 }
 
 func (this *Wigo) Deduplicate(remoteWigo *Wigo) (err error) {
@@ -383,18 +431,41 @@ func (this *Wigo) AddOrUpdateRemoteWigo(remoteWigo *Wigo) {
 		return
 	}
 
+	// Remote wigos without revision are always considered changed
+	changed := true
 	if tmp, ok := this.RemoteWigos.Get(remoteWigo.Uuid); ok {
 		oldWigo := tmp.(*Wigo)
 		if !oldWigo.IsAlive {
 			remoteWigo.IsAlive = false
 		}
 		this.CompareTwoWigosAndRaiseNotifications(oldWigo, remoteWigo)
+
+		changed = remoteWigo.Epoch == "" || remoteWigo.Epoch != oldWigo.Epoch || remoteWigo.Revision != oldWigo.Revision
 	}
 
 	_remoteWigo := remoteWigo
 	_remoteWigo.LastUpdate = time.Now().Unix()
 	this.RemoteWigos.Set(remoteWigo.Uuid, _remoteWigo)
 	this.RecomputeGlobalStatus()
+
+	if changed {
+		this.RemoteWigoChanged(remoteWigo.Uuid)
+	}
+}
+
+// Forget a remote wigo which is not polled anymore
+func (this *Wigo) RemoveRemoteWigo(uuid string) {
+	this.Lock()
+	defer this.Unlock()
+
+	if tmp, ok := this.RemoteWigos.Get(uuid); ok {
+		remoteWigo := tmp.(*Wigo)
+		this.RemoteWigos.Remove(uuid)
+		this.RecomputeGlobalStatus()
+		this.RemoteWigoChanged(uuid)
+
+		log.Printf("Remote wigo %s removed", remoteWigo.GetHostname())
+	}
 }
 
 func (this *Wigo) CompareTwoWigosAndRaiseNotifications(oldWigo *Wigo, newWigo *Wigo) {
@@ -520,6 +591,12 @@ func (this *Wigo) AddLog(ressource interface{}, level uint8, message string) (er
 		newLog.Host = v.GetHost().GetParentWigo().GetHostname()
 		newLog.Group = v.GetHost().Group
 
+		// Replayed probe changes are logged at the time they happened
+		if v.Timestamp > 0 && v.Timestamp < newLog.Timestamp {
+			newLog.Timestamp = v.Timestamp
+			newLog.Date = time.Unix(v.Timestamp, 0).Format(dateLayout)
+		}
+
 		// Level
 		if v.Status > 100 && v.Status < 200 {
 			newLog.Level = INFO
@@ -556,7 +633,36 @@ func (this *Wigo) AddLog(ressource interface{}, level uint8, message string) (er
 	return nil
 }
 
-func (this *Wigo) SearchLogs(probe string, hostname string, group string, limit uint64, offset uint64) []*Log {
+// Logs matching every set criterion. Probe and Host are exact
+// names, or glob patterns like the ones of the api v2 if Glob is set.
+type LogsFilter struct {
+	Probe  string
+	Host   string
+	Groups []string
+	Glob   bool
+}
+
+func (this LogsFilter) apply(query squirrel.SelectBuilder) squirrel.SelectBuilder {
+	match := func(column string, value string) squirrel.Sqlizer {
+		if this.Glob {
+			return squirrel.Expr(column+" GLOB ?", value)
+		}
+		return squirrel.Eq{column: value}
+	}
+
+	if this.Probe != "" {
+		query = query.Where(match("probe", this.Probe))
+	}
+	if this.Host != "" {
+		query = query.Where(match("host", this.Host))
+	}
+	if len(this.Groups) > 0 {
+		query = query.Where(squirrel.Eq{"grp": this.Groups})
+	}
+	return query
+}
+
+func (this *Wigo) SearchLogs(filter LogsFilter, limit uint64, offset uint64) []*Log {
 
 	// Lock
 	LocalWigo.sqlLiteLock.Lock()
@@ -564,17 +670,7 @@ func (this *Wigo) SearchLogs(probe string, hostname string, group string, limit
 
 	// Construct SQL Query
 	logs := make([]*Log, 0)
-	logsQuery := squirrel.Select("date,level,grp,host,probe,message").From("logs")
-
-	if probe != "" {
-		logsQuery = logsQuery.Where(squirrel.Eq{"probe": probe})
-	}
-	if hostname != "" {
-		logsQuery = logsQuery.Where(squirrel.Eq{"host": hostname})
-	}
-	if group != "" {
-		logsQuery = logsQuery.Where(squirrel.Eq{"grp": group})
-	}
+	logsQuery := filter.apply(squirrel.Select("date,level,grp,host,probe,message").From("logs"))
 
 	// Index && Offset
 	logsQuery = logsQuery.OrderBy("id DESC")
@@ -606,6 +702,23 @@ func (this *Wigo) SearchLogs(probe string, hostname string, group string, limit
 	return logs
 }
 
+func (this *Wigo) CountLogs(filter LogsFilter) (count uint64) {
+
+	// Lock
+	LocalWigo.sqlLiteLock.Lock()
+	defer LocalWigo.sqlLiteLock.Unlock()
+
+	// Construct SQL Query
+	countQuery := filter.apply(squirrel.Select("COUNT(*)").From("logs"))
+
+	// Execute
+	if err := countQuery.RunWith(LocalWigo.sqlLiteConn).QueryRow().Scan(&count); err != nil {
+		log.Printf("Fail to exec query to count logs : %s", err)
+	}
+
+	return
+}
+
 // Serialize
 func (this *Wigo) ToJsonString() (string, error) {
 
@@ -618,43 +731,51 @@ func (this *Wigo) ToJsonString() (string, error) {
 	return string(j), nil
 }
 
-// Disabled probes
-func (this *Wigo) GetDisabledProbes() *list.List {
-	return this.disabledProbes
+// Disabled probes, see disabled_probes.go
+func (this *Wigo) GetDisabledProbes() []*DisabledProbe {
+	return this.disabledProbes.List()
+}
+func (this *Wigo) GetDisabledProbe(probeName string) *DisabledProbe {
+	return this.disabledProbes.Get(probeName)
+}
+func (this *Wigo) IsProbeDisabled(probeName string) bool {
+	return this.disabledProbes.Get(probeName) != nil
 }
-func (this *Wigo) DisableProbe(probeName string) {
-	alreadyDisabled := false
 
-	if probeName == "" {
+// Disable a probe and drop its result, by is the user name or DISABLED_BY_EXIT_CODE
+func (this *Wigo) DisableProbe(probeName string, reason string, by string) (err error) {
+	disabled, err := this.disabledProbes.Disable(probeName, reason, by)
+	if !disabled {
 		return
 	}
-
-	// Check if not already disabled
-	for e := this.disabledProbes.Front(); e != nil; e = e.Next() {
-		if p, ok := e.Value.(string); ok {
-			if p == probeName {
-				alreadyDisabled = true
-			}
-		}
+	if err != nil {
+		log.Printf("Failed to save disabled probes : %s", err)
 	}
 
-	if !alreadyDisabled {
-		this.disabledProbes.PushBack(probeName)
+	this.LocalHost.DeleteProbeByName(probeName)
+
+	message := "Probe " + probeName + " disabled by " + by
+	if reason != "" {
+		message += " : " + reason
 	}
+	this.AddLog(this, INFO, message)
 
 	return
 }
-func (this *Wigo) IsProbeDisabled(probeName string) bool {
-
-	for e := this.disabledProbes.Front(); e != nil; e = e.Next() {
-		if p, ok := e.Value.(string); ok {
-			if p == probeName {
-				return true
-			}
-		}
+func (this *Wigo) EnableProbe(probeName string, by string) (err error) {
+	if err = this.disabledProbes.Enable(probeName); err == errProbeNotDisabled {
+		return
+	} else if err != nil {
+		log.Printf("Failed to save disabled probes : %s", err)
 	}
 
-	return false
+	this.AddLog(this, INFO, "Probe "+probeName+" enabled by "+by)
+	return nil
+}
+
+// Whether a probe disabled by exit code 13 is due to run again
+func (this *Wigo) RetryDisabledProbe(probeName string) bool {
+	return this.disabledProbes.Retry(probeName, this.GetConfig().Global.DisabledProbesRetry)
 }
 
 // Summaries
@@ -805,6 +926,21 @@ func (this *Wigo) ListRemoteWigosNames() []string {
 	return list
 }
 
+func (this *Wigo) ListWigos() []*Wigo {
+	list := make([]*Wigo, 0)
+
+	if this.Uuid == LocalWigo.Uuid {
+		list = append(list, this)
+	}
+	for item := range this.RemoteWigos.IterBuffered() {
+		wigo := item.Val.(*Wigo)
+		list = append(list, wigo)
+		list = append(list, wigo.ListWigos()...)
+	}
+
+	return list
+}
+
 func (this *Wigo) ListProbes() []string {
 	list := make([]string, 0)
 
@@ -817,6 +953,51 @@ func (this *Wigo) ListProbes() []string {
 	return list
 }
 
+// Copy of the wigo tree restricted to what a user is allowed to see.
+// Wigos of other groups are kept without their probes only when
+// they lead to visible wigos.
+func (this *Wigo) FilterForUser(user *ApiUser) *Wigo {
+	if len(user.Groups) == 0 {
+		return this
+	}
+
+	filtered := new(Wigo)
+	filtered.Uuid = this.Uuid
+	filtered.Version = this.Version
+	filtered.IsAlive = this.IsAlive
+	filtered.GlobalStatus = this.GlobalStatus
+	filtered.GlobalMessage = this.GlobalMessage
+	filtered.Epoch = this.Epoch
+	filtered.Revision = this.GetRevision()
+	filtered.LocalHost = this.LocalHost
+	filtered.Hostname = this.Hostname
+	filtered.LastUpdate = this.LastUpdate
+	filtered.RemoteWigos = NewConcurrentMapWigos()
+
+	for item := range this.RemoteWigos.IterBuffered() {
+		remoteWigo := item.Val.(*Wigo).FilterForUser(user)
+		if user.CanSeeGroup(remoteWigo.GetLocalHost().Group) || remoteWigo.RemoteWigos.Count() > 0 {
+			filtered.RemoteWigos.Set(item.Key, remoteWigo)
+		}
+	}
+
+	// The status of a hidden host is the one of the visible hosts below it
+	if !user.CanSeeGroup(this.GetLocalHost().Group) {
+		filtered.LocalHost = NewHost()
+		filtered.LocalHost.Name = this.LocalHost.Name
+		filtered.LocalHost.Group = this.LocalHost.Group
+		filtered.GlobalMessage = ""
+		filtered.GlobalStatus = filtered.LocalHost.Status
+		for item := range filtered.RemoteWigos.IterBuffered() {
+			if status := item.Val.(*Wigo).GlobalStatus; status > filtered.GlobalStatus {
+				filtered.GlobalStatus = status
+			}
+		}
+	}
+
+	return filtered
+}
+
 // Erase RemoteWigos if maximum wanted depth is reached
 
 func (this *Wigo) EraseRemoteWigos(depth int) *Wigo {
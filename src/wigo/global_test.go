@@ -0,0 +1,98 @@
+package wigo
+
+import (
+	"testing"
+)
+
+func newTestWigo(hostname string, group string, status int, remotes ...*Wigo) *Wigo {
+	wigo := &Wigo{Uuid: hostname, Hostname: hostname, GlobalStatus: status, GlobalMessage: hostname + " message"}
+	wigo.LocalHost = NewHost()
+	wigo.LocalHost.Name = hostname
+	wigo.LocalHost.Group = group
+	wigo.LocalHost.Status = status
+	wigo.RemoteWigos = NewConcurrentMapWigos()
+	for _, remote := range remotes {
+		wigo.RemoteWigos.Set(remote.Uuid, remote)
+	}
+	return wigo
+}
+
+func TestFilterForUserStatus(t *testing.T) {
+	// master (ops, 500) -> relay (ops, 300) -> web1 (web, 200), db1 (db, 300)
+	//                   -> web2 (web, 100)
+	master := newTestWigo("master", "ops", 500,
+		newTestWigo("relay", "ops", 300, newTestWigo("web1", "web", 200), newTestWigo("db1", "db", 300)),
+		newTestWigo("web2", "web", 100),
+	)
+
+	tests := []struct {
+		name    string
+		groups  []string
+		status  int
+		message string
+		hosts   []string
+	}{
+		{
+			name:    "every group",
+			status:  500,
+			message: "master message",
+			hosts:   []string{"relay", "web1", "db1", "web2"},
+		},
+		{
+			name:   "web",
+			groups: []string{"web"},
+			status: 200,
+			hosts:  []string{"relay", "web1", "web2"},
+		},
+		{
+			name:   "db",
+			groups: []string{"db"},
+			status: 300,
+			hosts:  []string{"relay", "db1"},
+		},
+		{
+			name:   "unknown group",
+			groups: []string{"none"},
+			status: 100,
+		},
+		{
+			name:    "ops",
+			groups:  []string{"ops"},
+			status:  500,
+			message: "master message",
+			hosts:   []string{"relay"},
+		},
+	}
+
+	for _, test := range tests {
+		filtered := master.FilterForUser(&ApiUser{Name: "user", Role: "viewer", Groups: test.groups})
+
+		if filtered.GlobalStatus != test.status {
+			t.Errorf("%s : expected global status %d, got %d", test.name, test.status, filtered.GlobalStatus)
+		}
+		if filtered.GlobalMessage != test.message {
+			t.Errorf("%s : expected global message %q, got %q", test.name, test.message, filtered.GlobalMessage)
+		}
+
+		hosts := make(map[string]bool)
+		var walk func(wigo *Wigo)
+		walk = func(wigo *Wigo) {
+			for item := range wigo.RemoteWigos.IterBuffered() {
+				hosts[item.Key] = true
+				walk(item.Val.(*Wigo))
+			}
+		}
+		walk(filtered)
+
+		if len(hosts) != len(test.hosts) {
+			t.Errorf("%s : expected hosts %v, got %v", test.name, test.hosts, hosts)
+			continue
+		}
+		for _, host := range test.hosts {
+			if !hosts[host] {
+				t.Errorf("%s : expected hosts %v, got %v", test.name, test.hosts, hosts)
+				break
+			}
+		}
+	}
+}
@@ -54,16 +54,19 @@ func (this *Host) AddOrUpdateProbe(probe *ProbeResult) {
 		// Notification
 		if oldProbe.Status != probe.Status {
 			NewNotificationProbe(oldProbe, probe)
+			GetLocalWigo().RecordProbeTransition(probe.Name, probe)
 		}
 	} else {
 
 		// New probe
 		probe.SetHost(this)
+		GetLocalWigo().RecordProbeTransition(probe.Name, probe)
 	}
 
 	// Update
 	GetLocalWigo().LocalHost.Probes.Set(probe.Name, probe)
 	GetLocalWigo().LocalHost.RecomputeStatus()
+	GetLocalWigo().ProbeChanged(probe.Name)
 
 	// Graph
 	probe.GraphMetrics()
@@ -79,6 +82,8 @@ func (this *Host) DeleteProbeByName(probeName string) {
 		probeToDelete := tmp.(*ProbeResult)
 		NewNotificationProbe(probeToDelete, nil)
 		this.Probes.Remove(probeName)
+		GetLocalWigo().ProbeChanged(probeName)
+		GetLocalWigo().RecordProbeTransition(probeName, nil)
 	}
 }
 
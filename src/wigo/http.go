@@ -3,25 +3,134 @@ package wigo
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
+	"github.com/Masterminds/squirrel"
 	"github.com/codegangsta/martini"
 )
 
-func HttpRemotesHandler(params martini.Params) (int, string) {
+// Routes of the http api, every one of them must be described in openapi.json
+func NewHttpRouter() martini.Router {
+	r := martini.NewRouter()
+
+	operator := HttpRequireRole(OPERATOR)
+	admin := HttpRequireRole(ADMIN)
+
+	r.Get("/api", HttpWigoHandler)
+
+	r.Get("/api/changes", HttpChangesHandler)
+	r.Get("/api/status", func(user *ApiUser) string { return strconv.Itoa((GetLocalWigo().FilterForUser(user).GlobalStatus)) })
+	r.Get("/api/logs", HttpLogsHandler)
+	r.Get("/api/logs/indexes", HttpLogsIndexesHandler)
+	r.Get("/api/groups", HttpGroupsHandler)
+	r.Get("/api/groups/:group", HttpGroupsHandler)
+	r.Get("/api/groups/:group/logs", HttpLogsHandler)
+	r.Get("/api/groups/:group/probes/:probe/logs", HttpLogsHandler)
+	r.Get("/api/hosts", HttpRemotesHandler)
+	r.Get("/api/hosts/:hostname", HttpRemotesHandler)
+	r.Get("/api/hosts/:hostname/status", HttpRemotesStatusHandler)
+	r.Get("/api/hosts/:hostname/logs", HttpLogsHandler)
+	r.Get("/api/hosts/:hostname/probes", HttpRemotesProbesHandler)
+	r.Get("/api/hosts/:hostname/probes/:probe", HttpRemotesProbesHandler)
+	r.Get("/api/hosts/:hostname/probes/:probe/status", HttpRemotesProbesStatusHandler)
+	r.Get("/api/hosts/:hostname/probes/:probe/logs", HttpLogsHandler)
+	r.Post("/api/hosts/:hostname/probes/:probe/run", operator, HttpRemotesProbeRunHandler)
+	r.Get("/api/probes/:probe/logs", HttpLogsHandler)
+	r.Get("/api/probes/:probe/config", operator, HttpProbeConfigHandler)
+	r.Put("/api/probes/:probe/config", operator, HttpProbeConfigUpdateHandler)
+	r.Post("/api/probes/:probe/enable", operator, HttpProbeEnableHandler)
+	r.Post("/api/probes/:probe/disable", operator, HttpProbeDisableHandler)
+	r.Post("/api/probes/:probe/run", operator, HttpProbeRunHandler)
+	r.Get("/api/authority/hosts", admin, HttpAuthorityListHandler)
+	r.Post("/api/authority/hosts/:uuid/allow", admin, HttpAuthorityAllowHandler)
+	r.Post("/api/authority/hosts/:uuid/revoke", admin, HttpAuthorityRevokeHandler)
+	r.Get("/api/authority/tokens", admin, HttpEnrollmentTokensListHandler)
+	r.Post("/api/authority/tokens", admin, HttpEnrollmentTokensCreateHandler)
+	r.Delete("/api/authority/tokens/:name", admin, HttpEnrollmentTokensDeleteHandler)
+	r.Get("/api/whoami", HttpWhoamiHandler)
+	r.Get("/api/users", admin, HttpUsersListHandler)
+	r.Post("/api/users", admin, HttpUsersSetHandler)
+	r.Delete("/api/users/:name", admin, HttpUsersDeleteHandler)
+	r.Post("/api/tokens", admin, HttpTokensCreateHandler)
+	r.Delete("/api/tokens/:name", admin, HttpTokensDeleteHandler)
+	r.Get("/api/remotes", admin, HttpRemoteWigosListHandler)
+	r.Post("/api/remotes", admin, HttpRemoteWigosSetHandler)
+	r.Delete("/api/remotes/:remote", admin, HttpRemoteWigosDeleteHandler)
+	r.Get("/api/config", admin, HttpConfigHandler)
+	r.Post("/api/config/reload", admin, HttpConfigReloadHandler)
+
+	// Api v2
+	r.Get("/api/v2", HttpV2IndexHandler)
+	r.Get("/api/v2/hosts", HttpV2HostsHandler)
+	r.Get("/api/v2/hosts/:hostname", HttpV2HostHandler)
+	r.Get("/api/v2/hosts/:hostname/probes", HttpV2HostProbesHandler)
+	r.Get("/api/v2/hosts/:hostname/probes/:probe", HttpV2HostProbeHandler)
+	r.Get("/api/v2/probes", HttpV2ProbesHandler)
+	r.Get("/api/v2/groups", HttpV2GroupsHandler)
+	r.Get("/api/v2/groups/:group", HttpV2GroupHandler)
+	r.Get("/api/v2/groups/:group/hosts", HttpV2HostsHandler)
+	r.Get("/api/v2/logs", HttpV2LogsHandler)
+	r.NotFound(HttpV2NotFoundHandler)
+
+	// Api documentation, every route above must be described in it
+	r.Get("/api/openapi.json", HttpOpenApiHandler)
+
+	return r
+}
+
+func HttpWigoHandler(user *ApiUser) (int, string) {
+	// Add the status of the push targets and the disabled probes
+	result := struct {
+		*Wigo
+		PushTargets    []*PushTargetStatus `json:",omitempty"`
+		DisabledProbes []*DisabledProbe    `json:",omitempty"`
+	}{Wigo: GetLocalWigo().FilterForUser(user)}
+	if pushTargets := GetLocalWigo().GetPushTargets(); pushTargets != nil {
+		result.PushTargets = pushTargets.Status()
+	}
+	if user.CanSeeGroup(GetLocalWigo().GetLocalHost().Group) {
+		result.DisabledProbes = GetLocalWigo().GetDisabledProbes()
+	}
+
+	json, err := json.Marshal(result)
+	if err != nil {
+		return 500, fmt.Sprintf("%s", err)
+	}
+	return 200, string(json)
+}
+
+// Find a wigo by hostname, only if the user is allowed to see it
+func findVisibleWigo(user *ApiUser, hostname string) *Wigo {
+	remoteWigo := GetLocalWigo().FindRemoteWigoByHostname(hostname)
+	if remoteWigo == nil || !user.CanSeeGroup(remoteWigo.GetLocalHost().Group) {
+		return nil
+	}
+	return remoteWigo
+}
+
+func HttpRemotesHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	hostname := params["hostname"]
 
 	if hostname != "" {
-		remoteWigo := GetLocalWigo().FindRemoteWigoByHostname(hostname)
+		remoteWigo := findVisibleWigo(user, hostname)
 		if remoteWigo != nil {
-			json, err := remoteWigo.ToJsonString()
+			// Add the polls statistics of directly polled remotes
+			result := struct {
+				*Wigo
+				PollStats *RemotePollStats `json:",omitempty"`
+			}{Wigo: remoteWigo.FilterForUser(user)}
+			result.PollStats, _ = GetLocalWigo().GetRemotes().GetPollStats(remoteWigo.Uuid)
+
+			json, err := json.Marshal(result)
 			if err != nil {
 				return 500, "Failed to encode remote wigo"
 			} else {
-				return 200, json
+				return 200, string(json)
 			}
 		} else {
 			return 404, ""
@@ -29,7 +138,12 @@ func HttpRemotesHandler(params martini.Params) (int, string) {
 	}
 
 	// Return remotes list
-	list := GetLocalWigo().ListRemoteWigosNames()
+	list := make([]string, 0)
+	for _, remoteWigo := range GetLocalWigo().ListWigos() {
+		if user.CanSeeGroup(remoteWigo.GetLocalHost().Group) {
+			list = append(list, remoteWigo.GetHostname())
+		}
+	}
 	json, err := json.Marshal(list)
 	if err != nil {
 		return 500, ""
@@ -38,7 +152,7 @@ func HttpRemotesHandler(params martini.Params) (int, string) {
 	}
 }
 
-func HttpRemotesProbesHandler(params martini.Params) (int, string) {
+func HttpRemotesProbesHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	hostname := params["hostname"]
 	probeName := params["probe"]
@@ -48,7 +162,7 @@ func HttpRemotesProbesHandler(params martini.Params) (int, string) {
 	}
 
 	// Get remote wigo
-	remoteWigo := GetLocalWigo().FindRemoteWigoByHostname(hostname)
+	remoteWigo := findVisibleWigo(user, hostname)
 	if remoteWigo == nil {
 		return 404, "Remote wigo " + hostname + " not found"
 	}
@@ -77,7 +191,7 @@ func HttpRemotesProbesHandler(params martini.Params) (int, string) {
 	return 200, ""
 }
 
-func HttpRemotesStatusHandler(params martini.Params) (int, string) {
+func HttpRemotesStatusHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	hostname := params["hostname"]
 
@@ -86,7 +200,7 @@ func HttpRemotesStatusHandler(params martini.Params) (int, string) {
 	}
 
 	// Get remote wigo
-	remoteWigo := GetLocalWigo().FindRemoteWigoByHostname(hostname)
+	remoteWigo := findVisibleWigo(user, hostname)
 	if remoteWigo == nil {
 		return 404, "Remote wigo " + hostname + " not found"
 	}
@@ -94,7 +208,7 @@ func HttpRemotesStatusHandler(params martini.Params) (int, string) {
 	return 200, strconv.Itoa(remoteWigo.GlobalStatus)
 }
 
-func HttpRemotesProbesStatusHandler(params martini.Params) (int, string) {
+func HttpRemotesProbesStatusHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	hostname := params["hostname"]
 	probeName := params["probe"]
@@ -107,7 +221,7 @@ func HttpRemotesProbesStatusHandler(params martini.Params) (int, string) {
 	}
 
 	// Get remote wigo
-	remoteWigo := GetLocalWigo().FindRemoteWigoByHostname(hostname)
+	remoteWigo := findVisibleWigo(user, hostname)
 	if remoteWigo == nil {
 		return 404, "Remote wigo " + hostname + " not found"
 	}
@@ -122,7 +236,7 @@ func HttpRemotesProbesStatusHandler(params martini.Params) (int, string) {
 
 }
 
-func HttpLogsHandler(params martini.Params, r *http.Request) (int, string) {
+func HttpLogsHandler(params martini.Params, r *http.Request, user *ApiUser) (int, string) {
 
 	//Parse url
 	u, err := url.Parse(r.URL.String())
@@ -162,10 +276,16 @@ func HttpLogsHandler(params martini.Params, r *http.Request) (int, string) {
 		}
 	}
 
+	// Restrict to user groups
+	groups, ok := user.ScopeGroups(group)
+	if !ok {
+		return 404, "Group " + group + " not found"
+	}
+
 	// Test hostname if present
 	var remoteWigo *Wigo
 	if hostname != "" {
-		remoteWigo = GetLocalWigo().FindRemoteWigoByHostname(hostname)
+		remoteWigo = findVisibleWigo(user, hostname)
 		if remoteWigo == nil {
 			return 404, "Remote wigo " + hostname + " not found"
 		}
@@ -183,7 +303,7 @@ func HttpLogsHandler(params martini.Params, r *http.Request) (int, string) {
 	}
 
 	// Get logs
-	logs := LocalWigo.SearchLogs(probeName, hostname, group, uint64(limit), uint64(offset))
+	logs := LocalWigo.SearchLogs(LogsFilter{Probe: probeName, Host: hostname, Groups: groups}, uint64(limit), uint64(offset))
 
 	// Json
 	json, err := json.Marshal(logs)
@@ -194,10 +314,14 @@ func HttpLogsHandler(params martini.Params, r *http.Request) (int, string) {
 	return 200, string(json)
 }
 
-func HttpGroupsHandler(params martini.Params) (int, string) {
+func HttpGroupsHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	group := params["group"]
 
+	if group != "" && !user.CanSeeGroup(group) {
+		return 404, ""
+	}
+
 	result := make(map[string]interface{})
 	result["Name"] = group
 
@@ -219,8 +343,13 @@ func HttpGroupsHandler(params martini.Params) (int, string) {
 		}
 	}
 
-	// Return remotes list
-	list := GetLocalWigo().ListGroupsNames()
+	// Return groups list
+	list := make([]string, 0)
+	for _, name := range GetLocalWigo().ListGroupsNames() {
+		if user.CanSeeGroup(name) {
+			list = append(list, name)
+		}
+	}
 	json, err := json.Marshal(list)
 	if err != nil {
 		return 500, ""
@@ -229,7 +358,7 @@ func HttpGroupsHandler(params martini.Params) (int, string) {
 	}
 }
 
-func HttpLogsIndexesHandler(params martini.Params) (int, string) {
+func HttpLogsIndexesHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	result := make(map[string][]string)
 	result["probes"] = make([]string, 0)
@@ -237,12 +366,18 @@ func HttpLogsIndexesHandler(params martini.Params) (int, string) {
 	result["groups"] = make([]string, 0)
 
 	// Queries
-	qP := "SELECT DISTINCT(probe) FROM logs"
-	qH := "SELECT DISTINCT(host) FROM logs"
-	qG := "SELECT DISTINCT(grp) FROM logs"
+	qP := squirrel.Select("DISTINCT(probe)").From("logs")
+	qH := squirrel.Select("DISTINCT(host)").From("logs")
+	qG := squirrel.Select("DISTINCT(grp)").From("logs")
+
+	if len(user.Groups) > 0 {
+		qP = qP.Where(squirrel.Eq{"grp": user.Groups})
+		qH = qH.Where(squirrel.Eq{"grp": user.Groups})
+		qG = qG.Where(squirrel.Eq{"grp": user.Groups})
+	}
 
 	// Probes
-	if rowsProbes, err := LocalWigo.sqlLiteConn.Query(qP); err == nil {
+	if rowsProbes, err := qP.RunWith(LocalWigo.sqlLiteConn).Query(); err == nil {
 		for rowsProbes.Next() {
 			var p string
 			if err := rowsProbes.Scan(&p); err == nil {
@@ -252,7 +387,7 @@ func HttpLogsIndexesHandler(params martini.Params) (int, string) {
 	}
 
 	// Hosts
-	if rowsHosts, err := LocalWigo.sqlLiteConn.Query(qH); err == nil {
+	if rowsHosts, err := qH.RunWith(LocalWigo.sqlLiteConn).Query(); err == nil {
 		for rowsHosts.Next() {
 			var h string
 			if err := rowsHosts.Scan(&h); err == nil {
@@ -262,7 +397,7 @@ func HttpLogsIndexesHandler(params martini.Params) (int, string) {
 	}
 
 	// Groups
-	if rowsGroup, err := LocalWigo.sqlLiteConn.Query(qG); err == nil {
+	if rowsGroup, err := qG.RunWith(LocalWigo.sqlLiteConn).Query(); err == nil {
 		for rowsGroup.Next() {
 			var g string
 			if err := rowsGroup.Scan(&g); err == nil {
@@ -280,16 +415,50 @@ func HttpLogsIndexesHandler(params martini.Params) (int, string) {
 	}
 }
 
-func HttpAuthorityListHandler(params martini.Params) (int, string) {
-
-	result := make(map[string]map[string]string)
+func HttpAuthorityListHandler(r *http.Request) (int, string) {
 
 	if LocalWigo.push == nil {
 		return 500, "Push server is not started"
 	}
+	authority := LocalWigo.push.authority
+
+	// Most recent audit entries, of a client if uuid is set
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 || limit > 1000 {
+			return 400, "Invalid limit " + value
+		}
+	}
+	audit, err := authority.store.AuditTrail(r.URL.Query().Get("uuid"), limit)
+	if err != nil {
+		return 500, fmt.Sprintf("Error while reading audit trail : %s", err)
+	}
+
+	result := make(map[string]interface{})
+	lists := make(map[string]map[string]string)
+	for _, state := range []string{CLIENT_WAITING, CLIENT_ALLOWED, CLIENT_REJECTED} {
+		lists[state] = make(map[string]string)
+		result[state] = lists[state]
+	}
+	policies := make(map[string]string)
 
-	result["waiting"] = LocalWigo.push.authority.Waiting
-	result["allowed"] = LocalWigo.push.authority.Allowed
+	clients := authority.store.List()
+	for _, client := range clients {
+		if list, ok := lists[client.State]; ok {
+			list[client.Uuid] = client.Hostname
+		}
+		if client.Policy != "" {
+			policies[client.Uuid] = client.Policy
+		}
+	}
+
+	result["policies"] = policies
+	result["enrolled"], result["revoked"] = authority.ListClientCertificates()
+	result["clients"] = clients
+	result["audit"] = audit
+	result["throttling"] = LocalWigo.push.limiter.Stats()
+	result["peers"] = LocalWigo.push.peers.Status()
 
 	// Return remotes list
 	json, err := json.Marshal(result)
@@ -300,7 +469,7 @@ func HttpAuthorityListHandler(params martini.Params) (int, string) {
 	}
 }
 
-func HttpAuthorityAllowHandler(params martini.Params) (int, string) {
+func HttpAuthorityAllowHandler(params martini.Params, user *ApiUser) (int, string) {
 
 	uuid := params["uuid"]
 
@@ -308,7 +477,7 @@ func HttpAuthorityAllowHandler(params martini.Params) (int, string) {
 		return 500, "Push server is not started"
 	}
 
-	err := LocalWigo.push.authority.AllowClient(uuid)
+	err := LocalWigo.push.authority.AllowClient(uuid, user.Name)
 
 	if err != nil {
 		return 500, err.Error()
@@ -317,7 +486,8 @@ func HttpAuthorityAllowHandler(params martini.Params) (int, string) {
 	return 200, "OK"
 }
 
-func HttpAuthorityRevokeHandler(params martini.Params) (int, string) {
+// The revocation reason may be given in a json body
+func HttpAuthorityRevokeHandler(params martini.Params, user *ApiUser, r *http.Request) (int, string) {
 
 	uuid := params["uuid"]
 
@@ -325,7 +495,14 @@ func HttpAuthorityRevokeHandler(params martini.Params) (int, string) {
 		return 500, "Push server is not started"
 	}
 
-	err := LocalWigo.push.authority.RevokeClient(uuid)
+	req := struct{ Reason string }{}
+	if r.ContentLength != 0 {
+		if err := readJsonBody(r, &req); err != nil {
+			return 400, err.Error()
+		}
+	}
+
+	err := LocalWigo.push.authority.RevokeClient(uuid, user.Name, req.Reason)
 
 	if err != nil {
 		return 500, err.Error()
@@ -333,3 +510,300 @@ func HttpAuthorityRevokeHandler(params martini.Params) (int, string) {
 
 	return 200, "OK"
 }
+
+type enrollmentTokenRequest struct {
+	Name            string
+	MaxUses         int
+	Ttl             int64
+	HostnamePattern string
+	Group           string
+}
+
+func HttpEnrollmentTokensListHandler() (int, string) {
+	if LocalWigo.push == nil {
+		return 500, "Push server is not started"
+	}
+
+	json, err := json.Marshal(LocalWigo.push.authority.EnrollmentTokens.List())
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+func HttpEnrollmentTokensCreateHandler(user *ApiUser, r *http.Request) (int, string) {
+	if LocalWigo.push == nil {
+		return 500, "Push server is not started"
+	}
+
+	req := new(enrollmentTokenRequest)
+	if err := readJsonBody(r, req); err != nil {
+		return 400, err.Error()
+	}
+
+	token, err := LocalWigo.push.authority.EnrollmentTokens.Create(req.Name, req.MaxUses, req.Ttl, req.HostnamePattern, req.Group)
+	if err != nil {
+		return 400, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Enrollment token "+req.Name+" created by "+user.Name)
+
+	json, _ := json.Marshal(map[string]string{"Name": req.Name, "Token": token})
+	return 200, string(json)
+}
+
+func HttpEnrollmentTokensDeleteHandler(user *ApiUser, params martini.Params) (int, string) {
+	if LocalWigo.push == nil {
+		return 500, "Push server is not started"
+	}
+
+	if err := LocalWigo.push.authority.EnrollmentTokens.Delete(params["name"]); err != nil {
+		return 404, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Enrollment token "+params["name"]+" deleted by "+user.Name)
+	return 200, "OK"
+}
+
+func HttpRemoteWigosListHandler() (int, string) {
+	json, err := json.Marshal(LocalWigo.GetRemotes().List())
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+func HttpRemoteWigosSetHandler(user *ApiUser, r *http.Request) (int, string) {
+	remote := AdvancedRemoteWigoConfig{}
+	if err := readJsonBody(r, &remote); err != nil {
+		return 400, err.Error()
+	}
+
+	name, err := LocalWigo.GetRemotes().Set(remote)
+	if err != nil {
+		return 400, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Remote wigo "+name+" set by "+user.Name)
+	return 200, "OK"
+}
+
+func HttpRemoteWigosDeleteHandler(user *ApiUser, params martini.Params) (int, string) {
+	name := params["remote"]
+	if !strings.Contains(name, ":") {
+		name = name + ":" + strconv.Itoa(LocalWigo.GetConfig().Http.Port)
+	}
+
+	if err := LocalWigo.GetRemotes().Remove(name); err != nil {
+		return 404, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Remote wigo "+name+" removed by "+user.Name)
+	return 200, "OK"
+}
+
+// Local probes configuration
+
+func HttpProbeConfigHandler(user *ApiUser, params martini.Params, w http.ResponseWriter) (int, string) {
+	if !user.CanSeeGroup(LocalWigo.GetLocalHost().Group) {
+		return 404, "Unknown probe " + params["probe"]
+	}
+
+	content, etag, err := ReadProbeConfig(params["probe"])
+	if err == errProbeConfigNotFound {
+		return 404, err.Error()
+	} else if err != nil {
+		return 400, err.Error()
+	}
+
+	w.Header().Set("ETag", etag)
+	return 200, string(content)
+}
+
+func HttpProbeConfigUpdateHandler(user *ApiUser, params martini.Params, w http.ResponseWriter, r *http.Request) (int, string) {
+	name := params["probe"]
+	if !user.CanSeeGroup(LocalWigo.GetLocalHost().Group) {
+		return 404, "Unknown probe " + name
+	}
+
+	content, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	if err != nil {
+		return 400, err.Error()
+	}
+
+	etag, err := WriteProbeConfig(name, content, strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-Match")), "W/"))
+	switch err {
+	case nil:
+	case errProbeConfigModified:
+		return 412, err.Error()
+	case errProbeConfigIfMatchMissing:
+		return 428, err.Error()
+	default:
+		return 400, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Configuration of probe "+name+" updated by "+user.Name)
+
+	// Apply the new settings without waiting for the next run
+	if _, _, err := FindProbe(name); err == nil {
+		go RunProbe(name)
+	}
+
+	w.Header().Set("ETag", etag)
+	return 200, string(content)
+}
+
+func HttpProbeEnableHandler(user *ApiUser, params martini.Params) (int, string) {
+	name := params["probe"]
+	if !user.CanSeeGroup(LocalWigo.GetLocalHost().Group) {
+		return 404, "Unknown probe " + name
+	}
+
+	if err := LocalWigo.EnableProbe(name, user.Name); err != nil {
+		return 404, err.Error()
+	}
+
+	// No need to wait for the next run to get its result
+	if _, _, err := FindProbe(name); err == nil {
+		go RunProbe(name)
+	}
+
+	return 200, "OK"
+}
+
+func HttpProbeDisableHandler(user *ApiUser, params martini.Params, r *http.Request) (int, string) {
+	name := params["probe"]
+	if !user.CanSeeGroup(LocalWigo.GetLocalHost().Group) {
+		return 404, "Unknown probe " + name
+	}
+	if _, _, err := FindProbe(name); err != nil {
+		return 404, err.Error()
+	}
+
+	// The reason is optional
+	req := struct{ Reason string }{}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	if err != nil {
+		return 400, err.Error()
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err = json.Unmarshal(body, &req); err != nil {
+			return 400, err.Error()
+		}
+	}
+
+	LocalWigo.DisableProbe(name, req.Reason, user.Name)
+
+	json, err := json.Marshal(LocalWigo.GetDisabledProbe(name))
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+func HttpProbeRunHandler(user *ApiUser, params martini.Params) (int, string) {
+	name := params["probe"]
+	if !user.CanSeeGroup(LocalWigo.GetLocalHost().Group) {
+		return 404, "Unknown probe " + name
+	}
+	if _, _, err := FindProbe(name); err != nil {
+		return 404, err.Error()
+	}
+	if LocalWigo.IsProbeDisabled(name) {
+		return 409, "Probe " + name + " is disabled"
+	}
+
+	result, err := RunProbe(name)
+	if _, ok := err.(*ProbeDisabledError); ok {
+		return 409, err.Error()
+	} else if err == errProbeStillRunning {
+		return 202, err.Error()
+	} else if err != nil {
+		return 500, err.Error()
+	}
+
+	json, err := json.Marshal(result)
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+// Run a probe of a remote wigo, through the remote wigo it is polled from
+func HttpRemotesProbeRunHandler(user *ApiUser, params martini.Params) (int, string) {
+	hostname := params["hostname"]
+
+	remoteWigo := findVisibleWigo(user, hostname)
+	if remoteWigo == nil {
+		return 404, "Remote wigo " + hostname + " not found"
+	}
+	if remoteWigo == LocalWigo {
+		return HttpProbeRunHandler(user, params)
+	}
+
+	for item := range LocalWigo.RemoteWigos.IterBuffered() {
+		polled := item.Val.(*Wigo)
+
+		path := "/probes/" + url.PathEscape(params["probe"]) + "/run"
+		if polled != remoteWigo {
+			if polled.FindRemoteWigoByHostname(hostname) == nil {
+				continue
+			}
+			path = "/hosts/" + url.PathEscape(hostname) + path
+		}
+
+		body, status, err := LocalWigo.GetRemotes().Post(polled.Uuid, path)
+		if err == errRemoteNotPolled {
+			break
+		} else if err != nil {
+			return 502, "Remote wigo " + polled.GetHostname() + " : " + err.Error()
+		}
+		return status, string(body)
+	}
+
+	return 501, "Remote wigo " + hostname + " is not polled by this wigo, its probes can't be run from here"
+}
+
+func HttpConfigHandler() (int, string) {
+	sources, err := LocalWigo.GetConfig().Sources()
+	if err != nil {
+		return 500, ""
+	}
+
+	json, err := json.Marshal(sources)
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+func HttpConfigReloadHandler(user *ApiUser) (int, string) {
+	result, err := LocalWigo.ReloadConfig()
+	if err != nil {
+		return 400, err.Error()
+	}
+
+	json, err := json.Marshal(result)
+	if err != nil {
+		return 500, ""
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Configuration reloaded by "+user.Name)
+	return 200, string(json)
+}
+
+func HttpChangesHandler(user *ApiUser, r *http.Request) (int, string) {
+	var since uint64
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return 400, "Invalid since revision " + value
+		}
+	}
+
+	json, err := json.Marshal(GetLocalWigo().GetChanges(since, r.URL.Query().Get("epoch"), user))
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
@@ -0,0 +1,167 @@
+package wigo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/auth"
+)
+
+// Http authentication. Requests are authenticated either with
+// the legacy Login/Password of the [Http] section, which grants
+// the admin role, with a user of the users file using basic auth,
+// with an api token using the "Authorization: Bearer" header, or
+// with a verified tls client certificate (see tls.go).
+//
+// When no credentials are configured at all the api stays open and
+// every request is handled as an anonymous user with the AnonymousRole,
+// viewer unless configured otherwise.
+//
+// The authenticated *ApiUser is mapped into the martini context
+// so handlers can check roles and groups.
+
+func HttpAuthHandler(c martini.Context, w http.ResponseWriter, r *http.Request) {
+	config := LocalWigo.GetConfig().Http
+	users := LocalWigo.users
+
+	legacyAuth := config.Login != "" && config.Password != ""
+	if !legacyAuth && users.IsEmpty() && len(config.ClientCerts) == 0 {
+		c.Map(&ApiUser{Name: "anonymous", Role: config.AnonymousRole})
+		return
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if user, ok := ClientCertUser(r.TLS.VerifiedChains[0][0], config.ClientCerts); ok {
+			c.Map(user)
+			return
+		}
+	}
+
+	authorization := r.Header.Get("Authorization")
+
+	if strings.HasPrefix(authorization, "Bearer ") {
+		if user, ok := users.AuthenticateToken(strings.TrimPrefix(authorization, "Bearer ")); ok {
+			c.Map(user)
+			return
+		}
+	} else if login, password, ok := r.BasicAuth(); ok {
+		if legacyAuth && auth.SecureCompare(login, config.Login) && auth.SecureCompare(password, config.Password) {
+			c.Map(&ApiUser{Name: config.Login, Role: "admin"})
+			return
+		}
+		if user, ok := users.AuthenticateUser(login, password); ok {
+			c.Map(user)
+			return
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+	http.Error(w, "Not Authorized", http.StatusUnauthorized)
+}
+
+// Route middleware refusing users below the given role
+func HttpRequireRole(role int) martini.Handler {
+	return func(user *ApiUser, w http.ResponseWriter, r *http.Request) {
+		if !user.HasRole(role) {
+			log.Printf("Http server : %s with role %s is not allowed to %s %s", user.Name, user.Role, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	}
+}
+
+func HttpWhoamiHandler(user *ApiUser) (int, string) {
+	json, err := json.Marshal(user)
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+// Users management
+
+type userRequest struct {
+	Name     string
+	Role     string
+	Groups   []string
+	Password string
+}
+
+func HttpUsersListHandler() (int, string) {
+	users, tokens := LocalWigo.users.ListUsers()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+
+	result := make(map[string][]*ApiUser)
+	result["users"] = users
+	result["tokens"] = tokens
+
+	json, err := json.Marshal(result)
+	if err != nil {
+		return 500, ""
+	}
+	return 200, string(json)
+}
+
+func HttpUsersSetHandler(user *ApiUser, r *http.Request) (int, string) {
+	req := new(userRequest)
+	if err := readJsonBody(r, req); err != nil {
+		return 400, err.Error()
+	}
+
+	if err := LocalWigo.users.SetUser(req.Name, req.Role, req.Groups, req.Password); err != nil {
+		return 400, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "User "+req.Name+" with role "+req.Role+" set by "+user.Name)
+	return 200, "OK"
+}
+
+func HttpUsersDeleteHandler(user *ApiUser, params martini.Params) (int, string) {
+	if err := LocalWigo.users.DeleteUser(params["name"]); err != nil {
+		return 404, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "User "+params["name"]+" deleted by "+user.Name)
+	return 200, "OK"
+}
+
+func HttpTokensCreateHandler(user *ApiUser, r *http.Request) (int, string) {
+	req := new(userRequest)
+	if err := readJsonBody(r, req); err != nil {
+		return 400, err.Error()
+	}
+
+	token, err := LocalWigo.users.CreateToken(req.Name, req.Role, req.Groups)
+	if err != nil {
+		return 400, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Api token "+req.Name+" with role "+req.Role+" created by "+user.Name)
+
+	json, _ := json.Marshal(map[string]string{"Name": req.Name, "Token": token})
+	return 200, string(json)
+}
+
+func HttpTokensDeleteHandler(user *ApiUser, params martini.Params) (int, string) {
+	if err := LocalWigo.users.DeleteToken(params["name"]); err != nil {
+		return 404, err.Error()
+	}
+
+	LocalWigo.AddLog(LocalWigo, INFO, "Api token "+params["name"]+" deleted by "+user.Name)
+	return 200, "OK"
+}
+
+// Decode a json request body, bodies are limited to 1MB
+func readJsonBody(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,583 @@
+package wigo
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/martini"
+)
+
+// Version 2 of the http api. Unlike v1, every response is json,
+// errors included. Lists can be filtered, sorted, paginated and
+// reduced to a subset of fields, and successful responses carry
+// an ETag so clients can poll cheaply using If-None-Match.
+//
+// Query parameters understood by list routes :
+//
+//	min_status=250       only items with Status >= 250
+//	group=web            only items of group web
+//	host=web-*           only hosts matching the glob
+//	probe=check_*        only probes matching the glob
+//	sort=-Status,Name    sort keys, prefix with - for descending
+//	limit=100&offset=0   pagination
+//	fields=Name,Status   only return these fields
+
+const (
+	apiV2DefaultLimit = 100
+	apiV2MaxLimit     = 10000
+)
+
+// Default order of the lists
+var (
+	apiV2HostsOrder  = []string{"Name", "Uuid"}
+	apiV2ProbesOrder = []string{"Host", "Name"}
+	apiV2GroupsOrder = []string{"Name"}
+)
+
+type ApiV2Error struct {
+	Status  int
+	Error   string
+	Message string
+}
+
+type ApiV2List struct {
+	Total  int
+	Offset int
+	Limit  int
+	Items  []map[string]interface{}
+}
+
+type ApiV2Host struct {
+	Name       string
+	Uuid       string
+	Group      string
+	Version    string
+	Status     int
+	Message    string
+	IsAlive    bool
+	LastUpdate int64
+	Probes     []*ProbeResult `json:",omitempty"`
+}
+
+type ApiV2Probe struct {
+	Host  string
+	Group string
+	*ProbeResult
+}
+
+type ApiV2Group struct {
+	Name   string
+	Status int
+	Hosts  int
+}
+
+type apiV2Query struct {
+	minStatus int
+	group     string
+	host      string
+	probe     string
+	sort      []string
+	fields    []string
+	limit     int
+	offset    int
+}
+
+func NewApiV2Host(wigo *Wigo, withProbes bool) (this *ApiV2Host) {
+	this = new(ApiV2Host)
+	this.Name = wigo.GetHostname()
+	this.Uuid = wigo.Uuid
+	this.Group = wigo.GetLocalHost().Group
+	this.Version = wigo.Version
+	this.Status = wigo.GlobalStatus
+	this.Message = wigo.GlobalMessage
+	this.IsAlive = wigo.IsAlive
+	this.LastUpdate = wigo.LastUpdate
+
+	if withProbes {
+		this.Probes = make([]*ProbeResult, 0)
+		for item := range wigo.GetLocalHost().Probes.IterBuffered() {
+			this.Probes = append(this.Probes, item.Val.(*ProbeResult))
+		}
+		sort.Slice(this.Probes, func(i, j int) bool { return this.Probes[i].Name < this.Probes[j].Name })
+	}
+
+	return
+}
+
+// Handlers
+
+func HttpV2IndexHandler(w http.ResponseWriter, r *http.Request, user *ApiUser) (int, string) {
+	wigo := LocalWigo.FilterForUser(user)
+
+	result := make(map[string]interface{})
+	result["Version"] = wigo.Version
+	result["Hostname"] = wigo.GetHostname()
+	result["Uuid"] = wigo.Uuid
+	result["GlobalStatus"] = wigo.GlobalStatus
+	result["GlobalMessage"] = wigo.GlobalMessage
+
+	return httpV2Reply(w, r, result)
+}
+
+func HttpV2HostsHandler(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+	q, apiErr := parseApiV2Query(r)
+	if apiErr != nil {
+		return httpV2ErrorReply(apiErr)
+	}
+
+	// Group from url takes precedence
+	if params["group"] != "" {
+		q.group = params["group"]
+	}
+
+	hosts := make([]interface{}, 0)
+	for _, wigo := range LocalWigo.ListWigos() {
+		if !user.CanSeeGroup(wigo.GetLocalHost().Group) || !q.matchHost(wigo) {
+			continue
+		}
+		hosts = append(hosts, NewApiV2Host(wigo, false))
+	}
+
+	return httpV2ListReply(w, r, q, hosts, apiV2HostsOrder)
+}
+
+func HttpV2HostHandler(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+	wigo := findVisibleWigo(user, params["hostname"])
+	if wigo == nil {
+		return httpV2Error(404, "Host %s not found", params["hostname"])
+	}
+
+	return httpV2Reply(w, r, NewApiV2Host(wigo, true))
+}
+
+func HttpV2HostProbesHandler(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+	q, apiErr := parseApiV2Query(r)
+	if apiErr != nil {
+		return httpV2ErrorReply(apiErr)
+	}
+
+	wigo := findVisibleWigo(user, params["hostname"])
+	if wigo == nil {
+		return httpV2Error(404, "Host %s not found", params["hostname"])
+	}
+
+	probes := make([]interface{}, 0)
+	for _, probe := range q.filterProbes(wigo) {
+		probes = append(probes, probe)
+	}
+
+	return httpV2ListReply(w, r, q, probes, apiV2ProbesOrder)
+}
+
+func HttpV2HostProbeHandler(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+	wigo := findVisibleWigo(user, params["hostname"])
+	if wigo == nil {
+		return httpV2Error(404, "Host %s not found", params["hostname"])
+	}
+
+	tmp, ok := wigo.GetLocalHost().Probes.Get(params["probe"])
+	if !ok {
+		return httpV2Error(404, "Probe %s not found on host %s", params["probe"], params["hostname"])
+	}
+
+	return httpV2Reply(w, r, &ApiV2Probe{wigo.GetHostname(), wigo.GetLocalHost().Group, tmp.(*ProbeResult)})
+}
+
+func HttpV2ProbesHandler(w http.ResponseWriter, r *http.Request, user *ApiUser) (int, string) {
+	q, apiErr := parseApiV2Query(r)
+	if apiErr != nil {
+		return httpV2ErrorReply(apiErr)
+	}
+
+	probes := make([]interface{}, 0)
+	for _, wigo := range LocalWigo.ListWigos() {
+		if !user.CanSeeGroup(wigo.GetLocalHost().Group) {
+			continue
+		}
+		if q.group != "" && wigo.GetLocalHost().Group != q.group {
+			continue
+		}
+		if q.host != "" {
+			if ok, _ := path.Match(q.host, wigo.GetHostname()); !ok {
+				continue
+			}
+		}
+		for _, probe := range q.filterProbes(wigo) {
+			probes = append(probes, probe)
+		}
+	}
+
+	return httpV2ListReply(w, r, q, probes, apiV2ProbesOrder)
+}
+
+func HttpV2GroupsHandler(w http.ResponseWriter, r *http.Request, user *ApiUser) (int, string) {
+	q, apiErr := parseApiV2Query(r)
+	if apiErr != nil {
+		return httpV2ErrorReply(apiErr)
+	}
+
+	groups := make([]interface{}, 0)
+	for _, name := range LocalWigo.ListGroupsNames() {
+		if !user.CanSeeGroup(name) {
+			continue
+		}
+		group := newApiV2Group(name)
+		if q.group != "" && q.group != group.Name {
+			continue
+		}
+		if group.Status < q.minStatus {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	return httpV2ListReply(w, r, q, groups, apiV2GroupsOrder)
+}
+
+func HttpV2GroupHandler(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+	group := newApiV2Group(params["group"])
+	if group.Hosts == 0 || !user.CanSeeGroup(group.Name) {
+		return httpV2Error(404, "Group %s not found", params["group"])
+	}
+
+	return httpV2Reply(w, r, group)
+}
+
+func HttpV2LogsHandler(w http.ResponseWriter, r *http.Request, user *ApiUser) (int, string) {
+	q, apiErr := parseApiV2Query(r)
+	if apiErr != nil {
+		return httpV2ErrorReply(apiErr)
+	}
+	if len(q.sort) > 0 {
+		return httpV2Error(400, "Logs can't be sorted, they are always returned newest first")
+	}
+	if q.minStatus != 0 {
+		return httpV2Error(400, "Logs have a level, not a status, they can't be filtered by min_status")
+	}
+	if r.URL.Query().Get("hostname") != "" {
+		return httpV2Error(400, "Unknown parameter hostname, use host")
+	}
+
+	groups, ok := user.ScopeGroups(q.group)
+	if !ok {
+		return httpV2Error(404, "Group %s not found", q.group)
+	}
+	filter := LogsFilter{Probe: q.probe, Host: q.host, Groups: groups, Glob: true}
+
+	logs := LocalWigo.SearchLogs(filter, uint64(q.limit), uint64(q.offset))
+
+	items, err := toApiV2Items(logs)
+	if err != nil {
+		return httpV2Error(500, "Fail to encode logs : %s", err)
+	}
+	if items, err = selectApiV2Fields(items, q.fields); err != nil {
+		return httpV2Error(400, "%s", err)
+	}
+
+	list := new(ApiV2List)
+	list.Total = int(LocalWigo.CountLogs(filter))
+	list.Offset = q.offset
+	list.Limit = q.limit
+	list.Items = items
+
+	return httpV2Reply(w, r, list)
+}
+
+func HttpV2NotFoundHandler(w http.ResponseWriter, r *http.Request) (int, string) {
+	if !strings.HasPrefix(r.URL.Path, "/api/v2") {
+		return 404, "404 page not found"
+	}
+
+	return httpV2Error(404, "No route for %s %s", r.Method, r.URL.Path)
+}
+
+// Query parsing and filters
+
+func parseApiV2Query(r *http.Request) (q *apiV2Query, apiErr *ApiV2Error) {
+	q = new(apiV2Query)
+	q.limit = apiV2DefaultLimit
+
+	pq := r.URL.Query()
+
+	var err error
+	if v := pq.Get("min_status"); v != "" {
+		if q.minStatus, err = strconv.Atoi(v); err != nil {
+			return nil, newApiV2Error(400, "Invalid min_status %s", v)
+		}
+	}
+	if v := pq.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 0 {
+			return nil, newApiV2Error(400, "Invalid limit %s", v)
+		}
+		if q.limit > apiV2MaxLimit {
+			return nil, newApiV2Error(400, "Limit %d is over the maximum of %d", q.limit, apiV2MaxLimit)
+		}
+	}
+	if v := pq.Get("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return nil, newApiV2Error(400, "Invalid offset %s", v)
+		}
+	}
+
+	q.group = pq.Get("group")
+
+	q.host = pq.Get("host")
+	if _, err := path.Match(q.host, ""); err != nil {
+		return nil, newApiV2Error(400, "Invalid host pattern %s", q.host)
+	}
+	q.probe = pq.Get("probe")
+	if _, err := path.Match(q.probe, ""); err != nil {
+		return nil, newApiV2Error(400, "Invalid probe pattern %s", q.probe)
+	}
+
+	q.sort = splitApiV2List(pq.Get("sort"))
+	q.fields = splitApiV2List(pq.Get("fields"))
+
+	return q, nil
+}
+
+func splitApiV2List(value string) (list []string) {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+func (q *apiV2Query) matchHost(wigo *Wigo) bool {
+	if wigo.GlobalStatus < q.minStatus {
+		return false
+	}
+	if q.group != "" && wigo.GetLocalHost().Group != q.group {
+		return false
+	}
+	if q.host != "" {
+		if ok, _ := path.Match(q.host, wigo.GetHostname()); !ok {
+			return false
+		}
+	}
+	if q.probe != "" {
+		found := false
+		for _, name := range wigo.ListProbes() {
+			if ok, _ := path.Match(q.probe, name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *apiV2Query) filterProbes(wigo *Wigo) (probes []*ApiV2Probe) {
+	probes = make([]*ApiV2Probe, 0)
+
+	for item := range wigo.GetLocalHost().Probes.IterBuffered() {
+		probe := item.Val.(*ProbeResult)
+
+		if probe.Status < q.minStatus {
+			continue
+		}
+		if q.probe != "" {
+			if ok, _ := path.Match(q.probe, probe.Name); !ok {
+				continue
+			}
+		}
+		probes = append(probes, &ApiV2Probe{wigo.GetHostname(), wigo.GetLocalHost().Group, probe})
+	}
+
+	return
+}
+
+func newApiV2Group(name string) (this *ApiV2Group) {
+	this = new(ApiV2Group)
+	this.Name = name
+
+	hosts, status := LocalWigo.GroupSummary(name)
+	this.Hosts = len(hosts)
+	this.Status = status
+
+	return
+}
+
+// Generic list processing. Items are converted to maps through their
+// json representation so any exported field can be sorted or selected.
+
+func toApiV2Items(data interface{}) (items []map[string]interface{}, err error) {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	items = make([]map[string]interface{}, 0)
+	err = json.Unmarshal(j, &items)
+	return
+}
+
+func sortApiV2Items(items []map[string]interface{}, keys []string) error {
+	if len(keys) == 0 || len(items) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if _, ok := items[0][strings.TrimPrefix(key, "-")]; !ok {
+			return fmt.Errorf("Unknown sort field %s", strings.TrimPrefix(key, "-"))
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, key := range keys {
+			desc := strings.HasPrefix(key, "-")
+			key = strings.TrimPrefix(key, "-")
+
+			c := compareApiV2Values(items[i][key], items[j][key])
+			if c == 0 {
+				continue
+			}
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	return nil
+}
+
+func compareApiV2Values(a interface{}, b interface{}) int {
+	switch va := a.(type) {
+	case float64:
+		if vb, ok := b.(float64); ok {
+			if va < vb {
+				return -1
+			} else if va > vb {
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb)
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			if va == vb {
+				return 0
+			} else if vb {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// Mixed or null values, nulls first
+	if a == nil && b != nil {
+		return -1
+	} else if a != nil && b == nil {
+		return 1
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func selectApiV2Fields(items []map[string]interface{}, fields []string) ([]map[string]interface{}, error) {
+	if len(fields) == 0 || len(items) == 0 {
+		return items, nil
+	}
+
+	for _, field := range fields {
+		if _, ok := items[0][field]; !ok {
+			return nil, fmt.Errorf("Unknown field %s", field)
+		}
+	}
+
+	selected := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		selected[i] = make(map[string]interface{})
+		for _, field := range fields {
+			selected[i][field] = item[field]
+		}
+	}
+
+	return selected, nil
+}
+
+// Replies
+
+func newApiV2Error(status int, format string, args ...interface{}) *ApiV2Error {
+	return &ApiV2Error{status, http.StatusText(status), fmt.Sprintf(format, args...)}
+}
+
+func httpV2Error(status int, format string, args ...interface{}) (int, string) {
+	return httpV2ErrorReply(newApiV2Error(status, format, args...))
+}
+
+func httpV2ErrorReply(apiErr *ApiV2Error) (int, string) {
+	j, _ := json.Marshal(apiErr)
+	return apiErr.Status, string(j)
+}
+
+// Lists are built from maps, they are always sorted by the given
+// keys after the requested ones so the pages and the ETag are stable
+func httpV2ListReply(w http.ResponseWriter, r *http.Request, q *apiV2Query, data []interface{}, order []string) (int, string) {
+	items, err := toApiV2Items(data)
+	if err != nil {
+		return httpV2Error(500, "Fail to encode response : %s", err)
+	}
+
+	keys := make([]string, 0, len(q.sort)+len(order))
+	keys = append(keys, q.sort...)
+	keys = append(keys, order...)
+	if err := sortApiV2Items(items, keys); err != nil {
+		return httpV2Error(400, "%s", err)
+	}
+
+	list := new(ApiV2List)
+	list.Total = len(items)
+	list.Offset = q.offset
+	list.Limit = q.limit
+
+	// Paginate
+	start := q.offset
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + q.limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	if list.Items, err = selectApiV2Fields(items[start:end], q.fields); err != nil {
+		return httpV2Error(400, "%s", err)
+	}
+
+	return httpV2Reply(w, r, list)
+}
+
+func httpV2Reply(w http.ResponseWriter, r *http.Request, data interface{}) (int, string) {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return httpV2Error(500, "Fail to encode response : %s", err)
+	}
+
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum(j))
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return 304, ""
+		}
+	}
+
+	return 200, string(j)
+}
@@ -0,0 +1,213 @@
+package wigo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini"
+)
+
+func addTestProbe(wigo *Wigo, name string, status int) {
+	wigo.LocalHost.Probes.Set(name, &ProbeResult{Name: name, Status: status, Message: name + " message"})
+}
+
+// Replace the local wigo by a tree of test hosts with some probes and logs
+func setupApiV2Test(t *testing.T) {
+	web1 := newTestWigo("web-1", "web", 250)
+	addTestProbe(web1, "check_disk", 250)
+	addTestProbe(web1, "check_load", 100)
+	web2 := newTestWigo("web-2", "web", 100)
+	addTestProbe(web2, "check_disk", 100)
+	db1 := newTestWigo("db-1", "db", 300)
+	addTestProbe(db1, "check_disk", 100)
+	addTestProbe(db1, "check_mysql", 300)
+	master := newTestWigo("master", "ops", 100, web2, web1, db1)
+	addTestProbe(master, "check_load", 100)
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "wigo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`CREATE TABLE logs (id integer not null primary key, date timestamp, level int, grp text, host text, probe text, message text) ;`); err != nil {
+		t.Fatal(err)
+	}
+	logs := []struct{ group, host, probe string }{
+		{"web", "web-1", "check_disk"},
+		{"web", "web-2", "check_disk"},
+		{"db", "db-1", "check_mysql"},
+		{"web", "web-1", "check_load"},
+		{"ops", "master", ""},
+	}
+	for i, l := range logs {
+		if _, err = db.Exec(`INSERT INTO logs(date,level,grp,host,probe,message) VALUES(?,?,?,?,?,?);`, time.Unix(int64(1000+i), 0), INFO, l.group, l.host, l.probe, l.host+" "+l.probe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	master.sqlLiteConn = db
+	master.sqlLiteLock = new(sync.Mutex)
+
+	previous := LocalWigo
+	LocalWigo = master
+	t.Cleanup(func() {
+		LocalWigo = previous
+		db.Close()
+	})
+}
+
+type apiV2Handler func(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string)
+
+func apiV2Get(handler apiV2Handler, url string, groups []string, header http.Header) (*httptest.ResponseRecorder, int, string) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", url, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	status, body := handler(w, r, martini.Params{}, &ApiUser{Name: "test", Role: "viewer", Groups: groups})
+	return w, status, body
+}
+
+func TestApiV2Lists(t *testing.T) {
+	setupApiV2Test(t)
+
+	hosts := apiV2Handler(HttpV2HostsHandler)
+	probes := func(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+		return HttpV2ProbesHandler(w, r, user)
+	}
+	logs := func(w http.ResponseWriter, r *http.Request, params martini.Params, user *ApiUser) (int, string) {
+		return HttpV2LogsHandler(w, r, user)
+	}
+
+	tests := []struct {
+		name    string
+		handler apiV2Handler
+		url     string
+		groups  []string
+		status  int
+		total   int
+		items   []string // Values of the first selected field, or Name
+	}{
+		{"hosts in default order", hosts, "/api/v2/hosts", nil, 200, 4, []string{"db-1", "master", "web-1", "web-2"}},
+		{"hosts of a group", hosts, "/api/v2/hosts?group=web", nil, 200, 2, []string{"web-1", "web-2"}},
+		{"hosts matching a glob", hosts, "/api/v2/hosts?host=web-*", nil, 200, 2, []string{"web-1", "web-2"}},
+		{"hosts with a probe", hosts, "/api/v2/hosts?probe=check_mysql", nil, 200, 1, []string{"db-1"}},
+		{"hosts over a status", hosts, "/api/v2/hosts?min_status=200", nil, 200, 2, []string{"db-1", "web-1"}},
+		{"hosts sorted by status", hosts, "/api/v2/hosts?sort=-Status", nil, 200, 4, []string{"db-1", "web-1", "master", "web-2"}},
+		{"hosts paginated", hosts, "/api/v2/hosts?limit=2&offset=1", nil, 200, 4, []string{"master", "web-1"}},
+		{"hosts past the last page", hosts, "/api/v2/hosts?offset=10", nil, 200, 4, []string{}},
+		{"hosts fields", hosts, "/api/v2/hosts?fields=Group&sort=Group", nil, 200, 4, []string{"db", "ops", "web", "web"}},
+		{"hosts of the user groups", hosts, "/api/v2/hosts", []string{"db"}, 200, 1, []string{"db-1"}},
+		{"hosts unknown sort field", hosts, "/api/v2/hosts?sort=Unknown", nil, 400, 0, nil},
+		{"hosts unknown field", hosts, "/api/v2/hosts?fields=Unknown", nil, 400, 0, nil},
+		{"hosts invalid glob", hosts, "/api/v2/hosts?host=[", nil, 400, 0, nil},
+		{"hosts invalid limit", hosts, "/api/v2/hosts?limit=-1", nil, 400, 0, nil},
+
+		{"probes in default order", probes, "/api/v2/probes?fields=Host", nil, 200, 6, []string{"db-1", "db-1", "master", "web-1", "web-1", "web-2"}},
+		{"probes matching a glob", probes, "/api/v2/probes?probe=*_disk&fields=Host", nil, 200, 3, []string{"db-1", "web-1", "web-2"}},
+		{"probes over a status", probes, "/api/v2/probes?min_status=200", nil, 200, 2, []string{"check_mysql", "check_disk"}},
+		{"probes of hosts matching a glob", probes, "/api/v2/probes?host=web-*&sort=-Status&fields=Name", nil, 200, 3, []string{"check_disk", "check_load", "check_disk"}},
+
+		{"logs newest first", logs, "/api/v2/logs?fields=Host", nil, 200, 5, []string{"master", "web-1", "db-1", "web-2", "web-1"}},
+		{"logs of hosts matching a glob", logs, "/api/v2/logs?host=web-*&fields=Probe", nil, 200, 3, []string{"check_load", "check_disk", "check_disk"}},
+		{"logs of probes matching a glob", logs, "/api/v2/logs?probe=check_d*&fields=Host", nil, 200, 2, []string{"web-2", "web-1"}},
+		{"logs paginated", logs, "/api/v2/logs?limit=1&offset=1&fields=Host", nil, 200, 5, []string{"web-1"}},
+		{"logs of the user groups", logs, "/api/v2/logs?fields=Host", []string{"db"}, 200, 1, []string{"db-1"}},
+		{"logs min_status", logs, "/api/v2/logs?min_status=200", nil, 400, 0, nil},
+		{"logs sort", logs, "/api/v2/logs?sort=Host", nil, 400, 0, nil},
+		{"logs hostname", logs, "/api/v2/logs?hostname=web-1", nil, 400, 0, nil},
+	}
+
+	for _, test := range tests {
+		_, status, body := apiV2Get(test.handler, test.url, test.groups, nil)
+		if status != test.status {
+			t.Errorf("%s : expected status %d, got %d : %s", test.name, test.status, status, body)
+			continue
+		}
+
+		if status != 200 {
+			apiErr := new(ApiV2Error)
+			if err := json.Unmarshal([]byte(body), apiErr); err != nil || apiErr.Status != status || apiErr.Message == "" {
+				t.Errorf("%s : expected a json error, got %s", test.name, body)
+			}
+			continue
+		}
+
+		list := new(ApiV2List)
+		if err := json.Unmarshal([]byte(body), list); err != nil {
+			t.Fatalf("%s : %s", test.name, err)
+		}
+		if list.Total != test.total {
+			t.Errorf("%s : expected %d items in total, got %d", test.name, test.total, list.Total)
+		}
+
+		field := "Name"
+		if i := strings.Index(test.url, "fields="); i >= 0 {
+			field = strings.Split(test.url[i+len("fields="):], ",")[0]
+			field = strings.Split(field, "&")[0]
+		}
+		items := make([]string, 0)
+		for _, item := range list.Items {
+			if field != "Name" && len(item) != 1 {
+				t.Errorf("%s : expected only the %s field, got %v", test.name, field, item)
+			}
+			value, _ := item[field].(string)
+			items = append(items, value)
+		}
+		if !reflect.DeepEqual(items, test.items) {
+			t.Errorf("%s : expected %v, got %v", test.name, test.items, items)
+		}
+	}
+}
+
+func TestApiV2ETag(t *testing.T) {
+	setupApiV2Test(t)
+
+	hosts := apiV2Handler(HttpV2HostsHandler)
+
+	w, status, body := apiV2Get(hosts, "/api/v2/hosts", nil, nil)
+	etag := w.Header().Get("ETag")
+	if status != 200 || etag == "" {
+		t.Fatalf("expected a 200 with an ETag, got %d %q", status, etag)
+	}
+
+	// The same state gives the same ETag, whatever the order of the maps
+	for i := 0; i < 10; i++ {
+		w, _, again := apiV2Get(hosts, "/api/v2/hosts", nil, nil)
+		if again != body || w.Header().Get("ETag") != etag {
+			t.Fatalf("expected a stable response and ETag")
+		}
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"same etag", etag, 304},
+		{"weak etag", "W/" + etag, 304},
+		{"one of several etags", "\"other\", " + etag, 304},
+		{"any etag", "*", 304},
+		{"other etag", "\"other\"", 200},
+	}
+	for _, test := range tests {
+		_, status, _ := apiV2Get(hosts, "/api/v2/hosts", nil, http.Header{"If-None-Match": {test.ifNoneMatch}})
+		if status != test.status {
+			t.Errorf("%s : expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	// A change gives another ETag
+	addTestProbe(LocalWigo, "check_new", 100)
+	LocalWigo.GlobalStatus = 300
+	w, status, _ = apiV2Get(hosts, "/api/v2/hosts", nil, http.Header{"If-None-Match": {etag}})
+	if status != 200 || w.Header().Get("ETag") == etag {
+		t.Errorf("expected a 200 with a new ETag after a change, got %d", status)
+	}
+}
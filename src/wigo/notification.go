@@ -115,6 +115,11 @@ func NewNotificationProbe(oldProbe *ProbeResult, newProbe *ProbeResult) (this *N
 			}
 		}
 
+		// The peer the host pushes to sends it
+		if weSend && newProbe.GetHost().GetParentWigo().peer != "" {
+			weSend = false
+		}
+
 		if weSend {
 			Channels.ChanCallbacks <- this
 		}
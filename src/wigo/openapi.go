@@ -0,0 +1,76 @@
+package wigo
+
+import (
+	_ "embed"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/codegangsta/martini"
+)
+
+// The OpenAPI 3 document describing the http api lives in openapi.json
+// next to this file. Every route registered in NewHttpRouter must have a
+// matching entry, CheckOpenApiRoutes reports the ones that are missing.
+
+//go:embed openapi.json
+var openApiSpec []byte
+
+var martiniParamRegexp = regexp.MustCompile(`:([^/]+)`)
+
+func GetOpenApiSpec() (spec map[string]interface{}, err error) {
+	spec = make(map[string]interface{})
+	if err = json.Unmarshal(openApiSpec, &spec); err != nil {
+		return nil, err
+	}
+
+	if info, ok := spec["info"].(map[string]interface{}); ok {
+		info["version"] = Version
+	}
+
+	return
+}
+
+func HttpOpenApiHandler() (int, string) {
+	spec, err := GetOpenApiSpec()
+	if err != nil {
+		return 500, "Fail to decode openapi specification : " + err.Error()
+	}
+
+	j, err := json.Marshal(spec)
+	if err != nil {
+		return 500, "Fail to encode openapi specification : " + err.Error()
+	}
+
+	return 200, string(j)
+}
+
+// Return the "METHOD /path" of every /api route that is not described in the specification
+func CheckOpenApiRoutes(routes martini.Routes) (missing []string, err error) {
+	spec, err := GetOpenApiSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, _ := spec["paths"].(map[string]interface{})
+
+	for _, route := range routes.All() {
+		if !strings.HasPrefix(route.Pattern(), "/api") {
+			continue
+		}
+
+		// Martini uses /:param where OpenAPI uses /{param}
+		pattern := martiniParamRegexp.ReplaceAllString(route.Pattern(), "{$1}")
+		method := strings.ToLower(route.Method())
+
+		if operations, ok := paths[pattern].(map[string]interface{}); ok {
+			if _, ok := operations[method]; ok {
+				continue
+			}
+		}
+
+		missing = append(missing, route.Method()+" "+route.Pattern())
+	}
+
+	return
+}
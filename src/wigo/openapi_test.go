@@ -0,0 +1,33 @@
+package wigo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/martini"
+)
+
+func TestOpenApiDescribesEveryRoute(t *testing.T) {
+	r := NewHttpRouter()
+
+	missing, err := CheckOpenApiRoutes(r.(martini.Routes))
+	if err != nil {
+		t.Fatalf("invalid openapi specification : %s", err)
+	}
+	if len(missing) > 0 {
+		t.Fatalf("routes missing from openapi specification : %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestOpenApiReportsMissingRoutes(t *testing.T) {
+	r := NewHttpRouter()
+	r.Get("/api/undocumented/:name", HttpOpenApiHandler)
+
+	missing, err := CheckOpenApiRoutes(r.(martini.Routes))
+	if err != nil {
+		t.Fatalf("invalid openapi specification : %s", err)
+	}
+	if len(missing) != 1 || missing[0] != "GET /api/undocumented/:name" {
+		t.Fatalf("expected the undocumented route to be reported, got %v", missing)
+	}
+}
@@ -0,0 +1,115 @@
+package wigo
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// Probes read their settings from <probe>.conf json files in the
+// ProbesConfigDirectory. They can be read and updated through the
+// api with optimistic concurrency : reads return an ETag, updates
+// of an existing file must send it back in If-Match and fail if the
+// file changed meanwhile. The previous version is kept as
+// <probe>.conf.bak and the probe runs at once with its new settings.
+
+var (
+	errProbeConfigNotFound       = errors.New("No configuration file for this probe")
+	errProbeConfigModified       = errors.New("The configuration file changed since it was read")
+	errProbeConfigIfMatchMissing = errors.New("Missing If-Match header with the ETag of the configuration file")
+)
+
+var probeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+var probeConfigLocker sync.Mutex
+
+func probeConfigFile(name string) (string, error) {
+	if !probeNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("Invalid probe name %s", name)
+	}
+	return filepath.Join(GetLocalWigo().GetConfig().Global.ProbesConfigDirectory, name+".conf"), nil
+}
+
+func probeConfigEtag(content []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(content))
+}
+
+// A probe configuration must be a json object, enabled is a boolean
+func ValidateProbeConfig(content []byte) error {
+	var probeConfig map[string]interface{}
+	if err := json.Unmarshal(content, &probeConfig); err != nil {
+		return fmt.Errorf("not a valid json object : %s", err)
+	}
+	if enabled, ok := probeConfig["enabled"]; ok {
+		if _, ok := enabled.(bool); !ok {
+			return errors.New("enabled must be true or false")
+		}
+	}
+	return nil
+}
+
+func ReadProbeConfig(name string) (content []byte, etag string, err error) {
+	file, err := probeConfigFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err = ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, "", errProbeConfigNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	return content, probeConfigEtag(content), nil
+}
+
+// Replace the configuration of a probe if it did not change since
+// the ETag ifMatch was read. Creating a configuration needs no ETag.
+func WriteProbeConfig(name string, content []byte, ifMatch string) (etag string, err error) {
+	file, err := probeConfigFile(name)
+	if err != nil {
+		return "", err
+	}
+	if err = ValidateProbeConfig(content); err != nil {
+		return "", fmt.Errorf("Invalid configuration of probe %s : %s", name, err)
+	}
+
+	probeConfigLocker.Lock()
+	defer probeConfigLocker.Unlock()
+
+	previous, err := ioutil.ReadFile(file)
+	if err == nil {
+		if ifMatch == "" {
+			return "", errProbeConfigIfMatchMissing
+		}
+		if ifMatch != "*" && ifMatch != probeConfigEtag(previous) {
+			return "", errProbeConfigModified
+		}
+		if err = ioutil.WriteFile(file+".bak", previous, 0644); err != nil {
+			return "", fmt.Errorf("Unable to backup %s : %s", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	} else if ifMatch != "" {
+		return "", errProbeConfigModified
+	}
+
+	// Probes must never read a partially written file
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return "", fmt.Errorf("Unable to write %s : %s", tmp, err)
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("Unable to write %s : %s", file, err)
+	}
+
+	return probeConfigEtag(content), nil
+}
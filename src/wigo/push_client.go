@@ -3,11 +3,13 @@ package wigo
 import (
 	"crypto/tls"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"log"
 	"net"
 	"net/rpc"
 	"strconv"
+	"strings"
 
 	"crypto/x509"
 	"encoding/pem"
@@ -19,7 +21,9 @@ import (
 
 // Push client connect to the push server to
 // update client's data over RPCs. Data is transferred
-// using binary gob serialisation over tcp connection.
+// using binary gob serialisation over tcp connection,
+// wigo states are json encoded. With the push protocol v2
+// only changes are sent, plus periodic full snapshots.
 // Secure TLS connection is available and highly recommended.
 //
 // If an error occurs during the push process the connection
@@ -29,13 +33,29 @@ type PushClient struct {
 	serverAddress string
 	uuidSignature []byte
 	token         string
+	tokenTtl      time.Duration
+	tokenExpires  time.Time
 	client        *rpc.Client
 	tlsConfig     *tls.Config
+	journal       *PushJournal
+
+	// Negotiated push protocol
+	protocol     int
+	capabilities []string
+
+	// Last state of the local wigo known by the server
+	epoch    string
+	revision uint64
+	lastFull time.Time
+
+	// Enrolled client certificate, see enrollment.go
+	clientCert *x509.Certificate
 }
 
-func NewPushClient(config *PushClientConfig) (this *PushClient, err error) {
+func NewPushClient(config *PushClientConfig, journal *PushJournal) (this *PushClient, err error) {
 	this = new(PushClient)
 	this.config = config
+	this.journal = journal
 
 	gob.Register([]interface{}{})
 	gob.Register(map[string]interface{}{})
@@ -71,12 +91,32 @@ func NewPushClient(config *PushClientConfig) (this *PushClient, err error) {
 			this.tlsConfig.InsecureSkipVerify = true
 		}
 
+		// Authenticate with the enrolled client certificate
+		if this.enrollment() && !this.tlsConfig.InsecureSkipVerify {
+			if pair, cert, err := loadClientCertificate(this.config.SslClientCert, this.config.SslClientKey); err == nil {
+				this.tlsConfig.Certificates = []tls.Certificate{pair}
+				this.clientCert = cert
+			} else if !os.IsNotExist(err) {
+				log.Printf("Push client : not using client certificate : %s", err)
+			}
+		}
+
+		// Until then, present the certificate matched by the accept policies of the server
+		if this.tlsConfig.Certificates == nil && this.config.SslRegistrationCert != "" {
+			if pair, err := tls.LoadX509KeyPair(this.config.SslRegistrationCert, this.config.SslRegistrationKey); err == nil {
+				this.tlsConfig.Certificates = []tls.Certificate{pair}
+			} else {
+				log.Printf("Push client : not using registration certificate : %s", err)
+			}
+		}
+
 		dialer := &net.Dialer{
 			Timeout: 5 * time.Second,
 		}
 		log.Printf("Push client : connecting to push server @ %s", address)
 		listener, err = tls.DialWithDialer(dialer, "tcp", address, this.tlsConfig)
 		if err != nil {
+			this.checkClientCertRejected(err)
 			if err.Error() == "unexpected EOF" {
 				log.Println("Push client : connection failed, is server configured for a TLS connection ?")
 			} else {
@@ -115,8 +155,11 @@ func NewPushClient(config *PushClientConfig) (this *PushClient, err error) {
 	// to true on the push server.
 	log.Println("Push client : registering")
 	b := new(bool) // void response
-	err = this.CallWithTimeout("PushServer.Register", NewHelloRequest(nil), b, time.Duration(5)*time.Second)
+	hello := NewHelloRequest(nil)
+	hello.EnrollmentToken = this.config.EnrollmentToken
+	err = this.CallWithTimeout("PushServer.Register", hello, b, time.Duration(5)*time.Second)
 	if err != nil {
+		this.checkClientCertRejected(err)
 		if !config.SslEnabled && err.Error() == "unexpected EOF" {
 			log.Println("Push client : error while trying to register, maybe remote server is expecting a TLS connection ?")
 		} else {
@@ -125,6 +168,30 @@ func NewPushClient(config *PushClientConfig) (this *PushClient, err error) {
 		return
 	}
 
+	// Enroll a client certificate, fall back to the uuid
+	// signature if the server doesn't support it
+	if this.enrollment() {
+		if this.clientCert != nil {
+			return
+		}
+
+		err = this.Enroll()
+		if err == nil {
+			log.Printf("Push client : client certificate enrolled, reconnecting")
+			err = errors.New("RECONNECT")
+			return
+		}
+		switch {
+		case strings.HasPrefix(err.Error(), "rpc: can't find method"), err.Error() == "ENROLLMENT DISABLED":
+			log.Println("Push client : push server does not support client certificates, using uuid signature")
+		case err.Error() == "ALREADY ENROLLED":
+			log.Println("Push client : already enrolled on the push server but no valid client certificate, the client must be revoked and allowed again to enroll")
+		default:
+			return
+		}
+		err = nil
+	}
+
 	if _, err = os.Stat(this.config.UuidSig); err == nil {
 		if this.uuidSignature, err = ioutil.ReadFile(this.config.UuidSig); err != nil {
 			log.Fatalf("Push client : while registering on %s, unable to read uuid signature from %s", address, this.config.UuidSig)
@@ -142,6 +209,104 @@ func NewPushClient(config *PushClientConfig) (this *PushClient, err error) {
 	return
 }
 
+func (this *PushClient) enrollment() bool {
+	return this.config.SslEnabled && this.config.ClientCertEnrollment
+}
+
+// Forget a client certificate the server does not accept anymore
+// (revoked or expired), the client will try to enroll again
+func (this *PushClient) checkClientCertRejected(err error) {
+	if this.clientCert != nil && strings.Contains(err.Error(), "tls: bad certificate") {
+		log.Printf("Push client : client certificate rejected by the push server, removing %s", this.config.SslClientCert)
+		os.Remove(this.config.SslClientCert)
+		this.clientCert = nil
+	}
+}
+
+// Send a certificate signing request to the server and save the
+// signed certificate. The server will only sign it once the client
+// has been allowed.
+func (this *PushClient) Enroll() (err error) {
+	if this.client == nil {
+		return errors.New("Push client : Not connected")
+	}
+
+	key, err := loadOrCreateClientKey(this.config.SslClientKey)
+	if err != nil {
+		log.Fatalf("Push client : unable to load client key %s : %s", this.config.SslClientKey, err)
+	}
+	req := EnrollRequest{HelloRequest: *NewHelloRequest(nil)}
+	if req.Csr, err = newClientCsr(key); err != nil {
+		return
+	}
+
+	log.Println("Push client : Enroll client certificate")
+	var cert []byte
+	for {
+		err = this.CallWithTimeout("PushServer.Enroll", req, &cert, time.Duration(5)*time.Second)
+		if err != nil {
+			// In failover mode try the next target instead of waiting
+			if err.Error() == "WAITING" && this.config.Mode != PUSH_MODE_FAILOVER {
+				log.Println("Push client : I'm on the waiting list of the server, will retry later")
+				time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
+				continue
+			}
+			return
+		}
+		break
+	}
+
+	if err = ioutil.WriteFile(this.config.SslClientCert, cert, 0600); err != nil {
+		log.Fatalf("Push client : failed to write client certificate %s : %s", this.config.SslClientCert, err)
+	}
+	return
+}
+
+// Renew the client certificate before it expires, the
+// new certificate is used from the next connection
+func (this *PushClient) RenewCertificate() (err error) {
+	if this.clientCert == nil || !clientCertificateNeedsRenewal(this.clientCert) {
+		return
+	}
+
+	log.Printf("Push client : client certificate expires on %s, renewing", this.clientCert.NotAfter.Format(time.RFC3339))
+	if err = this.Enroll(); err != nil {
+		log.Println("Push client : renewal error : " + err.Error())
+		return
+	}
+	this.clientCert = nil
+	return
+}
+
+func (this *PushClient) setTokenTtl(ttl int) {
+	this.tokenTtl = time.Duration(ttl) * time.Second
+	if ttl > 0 {
+		this.tokenExpires = time.Now().Add(this.tokenTtl)
+	} else {
+		this.tokenExpires = time.Time{}
+	}
+}
+
+// Replace the session token if it would expire before the next push.
+// Servers without the refresh capability make us reconnect instead.
+func (this *PushClient) RefreshToken() (err error) {
+	if this.tokenExpires.IsZero() || !IsStringInArray(PUSH_CAPABILITY_REFRESH, this.capabilities) {
+		return
+	}
+	if time.Until(this.tokenExpires) > time.Duration(this.config.PushInterval)*time.Second+this.tokenTtl/3 {
+		return
+	}
+
+	reply := new(RefreshTokenReply)
+	if err = this.CallWithTimeout("PushServer.RefreshToken", NewRequest(LocalWigo.Uuid, this.token), reply, time.Duration(5)*time.Second); err != nil {
+		log.Println("Push client : token refresh error : " + err.Error())
+		return
+	}
+	this.token = reply.Token
+	this.setTokenTtl(reply.TokenTtl)
+	return
+}
+
 // Download the server certificate from the server thus
 // the client can ensure the server's identity. To avoid the small window
 // of MITM vulnerability you might copy the certificate by yourself.
@@ -179,7 +344,8 @@ func (this *PushClient) SignUuid() (err error) {
 		// Check if the client has been allowed and ask the server to sign the client's uuid
 		err = this.CallWithTimeout("PushServer.GetUuidSignature", NewHelloRequest(nil), &this.uuidSignature, time.Duration(5)*time.Second)
 		if err != nil {
-			if err.Error() == "WAITING" {
+			// In failover mode try the next target instead of waiting
+			if err.Error() == "WAITING" && this.config.Mode != PUSH_MODE_FAILOVER {
 				log.Println("Push client : I'm on the waiting list of the server, will retry later")
 				time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
 				continue
@@ -214,9 +380,15 @@ func (this *PushClient) Hello() (err error) {
 
 	log.Println("Push client : Hello")
 	for {
-		err = this.CallWithTimeout("PushServer.Hello", NewHelloRequest(this.uuidSignature), &this.token, time.Duration(5)*time.Second)
+		err = this.helloV2()
+		if err != nil && strings.HasPrefix(err.Error(), "rpc: can't find method") {
+			log.Println("Push client : push server does not support protocol v2, falling back to v1")
+			this.protocol = 1
+			this.capabilities = nil
+			err = this.CallWithTimeout("PushServer.Hello", NewHelloRequest(this.uuidSignature), &this.token, time.Duration(5)*time.Second)
+		}
 		if err != nil {
-			if err.Error() == "WAITING" {
+			if err.Error() == "WAITING" && this.config.Mode != PUSH_MODE_FAILOVER {
 				log.Println("Push client : waiting to be allowed on server")
 				time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
 				continue
@@ -229,12 +401,40 @@ func (this *PushClient) Hello() (err error) {
 	return
 }
 
+func (this *PushClient) helloV2() (err error) {
+	req := HelloV2Request{
+		HelloRequest:    *NewHelloRequest(this.uuidSignature),
+		ProtocolVersion: PUSH_PROTOCOL_VERSION,
+		Capabilities:    PushCapabilities,
+	}
+	reply := new(HelloV2Reply)
+	if err = this.CallWithTimeout("PushServer.HelloV2", req, reply, time.Duration(5)*time.Second); err != nil {
+		return
+	}
+
+	this.token = reply.Token
+	this.protocol = reply.ProtocolVersion
+	this.capabilities = reply.Capabilities
+	this.setTokenTtl(reply.TokenTtl)
+	log.Printf("Push client : using push protocol v%d %v", this.protocol, this.capabilities)
+	return
+}
+
 // Send the local data to the server
 func (this *PushClient) Update() (err error) {
 	if this.client == nil {
 		return errors.New("Push client : Not connected")
 	}
 
+	this.RenewCertificate()
+	if err = this.RefreshToken(); err != nil {
+		return
+	}
+
+	if this.protocol >= 2 {
+		return this.updateV2()
+	}
+
 	log.Println("Push client : Update")
 
 	reply := new(bool)
@@ -246,6 +446,122 @@ func (this *PushClient) Update() (err error) {
 	return
 }
 
+// Replay the probe changes journaled while disconnected. The
+// next update is a full snapshot of the current state.
+func (this *PushClient) Replay() (err error) {
+	if this.client == nil {
+		return errors.New("Push client : Not connected")
+	}
+	if this.journal == nil {
+		return
+	}
+
+	entries, dropped := this.journal.Drain()
+	if dropped > 0 {
+		log.Printf("Push client : %d probe changes were dropped from the full push journal", dropped)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if !IsStringInArray(PUSH_CAPABILITY_REPLAY, this.capabilities) {
+		log.Printf("Push client : push server can't replay probe changes, dropping %d journaled changes", len(entries))
+		return
+	}
+
+	log.Printf("Push client : Replay of %d probe changes", len(entries))
+	for i := 0; i < len(entries); i += pushReplayBatchSize {
+		end := i + pushReplayBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		payload, err := json.Marshal(entries[i:end])
+		if err != nil {
+			log.Println("Push client : replay error : " + err.Error())
+			return err
+		}
+		req := &ReplayRequest{
+			Request:      NewRequest(LocalWigo.Uuid, this.token),
+			WigoHostname: LocalWigo.GetHostname(),
+			Entries:      string(payload),
+		}
+
+		replayed := new(int)
+		if err = this.CallWithTimeout("PushServer.Replay", req, replayed, time.Duration(30)*time.Second); err != nil {
+			log.Println("Push client : replay error : " + err.Error())
+			this.journal.Restore(entries[i:])
+			return err
+		}
+	}
+
+	this.epoch = ""
+	return
+}
+
+// Send the changes since the previous update, or a full snapshot
+// every FullPushInterval seconds, when the changes journal can't
+// tell what changed or when the server asks for it
+func (this *PushClient) updateV2() (err error) {
+	full := this.epoch == "" ||
+		!IsStringInArray(PUSH_CAPABILITY_DELTA, this.capabilities) ||
+		time.Since(this.lastFull) >= time.Duration(this.config.FullPushInterval)*time.Second
+
+	for {
+		req := &UpdateV2Request{
+			Request:      NewRequest(LocalWigo.Uuid, this.token),
+			WigoHostname: LocalWigo.GetHostname(),
+		}
+
+		var revision uint64
+		var epoch string
+		if !full {
+			changes := LocalWigo.GetChanges(this.revision, this.epoch, new(ApiUser))
+			if changes.Full {
+				full = true
+				continue
+			}
+			payload, err := json.Marshal(changes)
+			if err != nil {
+				log.Println("Push client : update error : " + err.Error())
+				return err
+			}
+			req.Kind = PUSH_UPDATE_DELTA
+			req.Since = this.revision
+			req.Payload = string(payload)
+			revision, epoch = changes.Revision, changes.Epoch
+		} else {
+			// Changes made while serializing will be sent again with the next delta
+			revision, epoch = LocalWigo.GetRevision(), LocalWigo.Epoch
+			req.Kind = PUSH_UPDATE_FULL
+			if req.Payload, err = LocalWigo.ToJsonString(); err != nil {
+				log.Println("Push client : update error : " + err.Error())
+				return
+			}
+		}
+
+		log.Printf("Push client : Update (%s)", req.Kind)
+
+		reply := new(UpdateV2Reply)
+		err = this.CallWithTimeout("PushServer.UpdateV2", req, reply, time.Duration(5)*time.Second)
+		if err != nil {
+			log.Println("Push client : update error : " + err.Error())
+			return
+		}
+
+		if reply.Resync && !full {
+			log.Println("Push client : push server asked for a full snapshot")
+			full = true
+			continue
+		}
+
+		this.revision, this.epoch = revision, epoch
+		if full {
+			this.lastFull = time.Now()
+		}
+		return
+	}
+}
+
 // Disconnect the client gracefully
 func (this *PushClient) Goodbye() (err error) {
 	if this.client == nil {
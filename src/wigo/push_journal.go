@@ -0,0 +1,237 @@
+package wigo
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// While the push client is disconnected probe state changes are
+// journaled to a bounded on-disk queue. They are replayed in order
+// on reconnect so the server raises the notifications and logs of
+// every transition, not only of the final state.
+//
+// The journal is a file of json lines, one change per line. When
+// it is full the oldest changes are dropped.
+
+type PushJournalEntry struct {
+	Timestamp int64
+	Name      string
+
+	// Nil if the probe has been deleted
+	Probe *ProbeResult `json:",omitempty"`
+}
+
+type PushJournal struct {
+	locker    *sync.Mutex
+	file      string
+	size      int
+	entries   []*PushJournalEntry
+	recording bool
+	dropped   int
+}
+
+// Number of entries sent in every Replay rpc
+const pushReplayBatchSize = 500
+
+func NewPushJournal(config *PushClientConfig) (this *PushJournal) {
+	this = new(PushJournal)
+	this.locker = new(sync.Mutex)
+	this.file = config.JournalFile
+	this.size = config.JournalSize
+
+	// Until the first successful push we don't know what the server has seen
+	this.recording = true
+
+	if err := this.load(); err != nil {
+		log.Printf("Push client : unable to load push journal %s : %s", this.file, err)
+	}
+	if len(this.entries) > 0 {
+		log.Printf("Push client : %d probe changes to replay from push journal %s", len(this.entries), this.file)
+	}
+
+	return
+}
+
+func (this *PushJournal) load() (err error) {
+	file, err := os.Open(this.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := new(PushJournalEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			log.Printf("Push client : skipping invalid push journal entry : %s", err)
+			continue
+		}
+		this.entries = append(this.entries, entry)
+	}
+	if len(this.entries) > this.size {
+		this.entries = this.entries[len(this.entries)-this.size:]
+	}
+
+	return scanner.Err()
+}
+
+// Record a probe state change if the client is disconnected
+func (this *PushJournal) Record(name string, probe *ProbeResult) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if !this.recording {
+		return
+	}
+
+	entry := &PushJournalEntry{Timestamp: time.Now().Unix(), Name: name, Probe: probe}
+	this.entries = append(this.entries, entry)
+
+	// Drop the oldest tenth of the journal when it's full
+	if len(this.entries) > this.size {
+		drop := len(this.entries) - this.size + this.size/10
+		if drop > len(this.entries) {
+			drop = len(this.entries)
+		}
+		if this.dropped == 0 {
+			log.Printf("Push client : push journal is full, dropping oldest probe changes")
+		}
+		this.dropped += drop
+		this.entries = this.entries[drop:]
+		this.save()
+		return
+	}
+
+	this.append(entry)
+}
+
+func (this *PushJournal) append(entry *PushJournalEntry) {
+	file, err := os.OpenFile(this.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Push client : unable to write push journal %s : %s", this.file, err)
+		return
+	}
+	defer file.Close()
+
+	line, _ := json.Marshal(entry)
+	file.Write(append(line, '\n'))
+}
+
+func (this *PushJournal) save() {
+	file, err := os.OpenFile(this.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("Push client : unable to write push journal %s : %s", this.file, err)
+		return
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range this.entries {
+		line, _ := json.Marshal(entry)
+		writer.Write(append(line, '\n'))
+	}
+	writer.Flush()
+}
+
+// Start journaling changes, the connection to the server is lost
+func (this *PushJournal) Start() {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.recording = true
+}
+
+// Take the journaled changes and stop journaling
+func (this *PushJournal) Drain() (entries []*PushJournalEntry, dropped int) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	entries, dropped = this.entries, this.dropped
+	this.entries = nil
+	this.dropped = 0
+	this.recording = false
+	this.save()
+
+	return
+}
+
+// Put back changes which could not be replayed before the
+// ones journaled since, and start journaling again
+func (this *PushJournal) Restore(entries []*PushJournalEntry) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.entries = append(entries, this.entries...)
+	if len(this.entries) > this.size {
+		this.dropped += len(this.entries) - this.size
+		this.entries = this.entries[len(this.entries)-this.size:]
+	}
+	this.recording = true
+	this.save()
+}
+
+// Journals of the push clients
+var pushJournals []*PushJournal
+var pushJournalsLock = new(sync.Mutex)
+
+func AddPushJournal(journal *PushJournal) {
+	pushJournalsLock.Lock()
+	defer pushJournalsLock.Unlock()
+
+	pushJournals = append(pushJournals, journal)
+}
+
+// Record a local probe state change in the push journals
+func (this *Wigo) RecordProbeTransition(name string, probe *ProbeResult) {
+	pushJournalsLock.Lock()
+	journals := pushJournals
+	pushJournalsLock.Unlock()
+
+	for _, journal := range journals {
+		journal.Record(name, probe)
+	}
+}
+
+// Replay probe changes journaled by a client on the last state we
+// have for it, so notifications and logs are raised for every change
+func (this *Wigo) ReplayProbeChanges(uuid string, entries []*PushJournalEntry) (replayed int) {
+	for _, entry := range entries {
+		tmp, ok := this.RemoteWigos.Get(uuid)
+		if !ok {
+			break
+		}
+		previous := tmp.(*Wigo)
+
+		changes := new(ApiChanges)
+		changes.Uuid = previous.Uuid
+		changes.Version = previous.Version
+		changes.Hostname = previous.Hostname
+		changes.IsAlive = previous.IsAlive
+		changes.GlobalMessage = previous.GlobalMessage
+		changes.LocalHost = NewHost()
+		changes.LocalHost.Name = previous.LocalHost.Name
+		changes.LocalHost.Group = previous.LocalHost.Group
+		if entry.Probe != nil {
+			changes.LocalHost.Probes.Set(entry.Name, entry.Probe)
+		} else {
+			changes.RemovedProbes = []string{entry.Name}
+		}
+
+		// Without epoch the replayed state is always considered changed
+		wigo := previous.ApplyChanges(changes, 1)
+		wigo.LocalHost.RecomputeStatus()
+		wigo.RecomputeGlobalStatus()
+
+		this.AddOrUpdateRemoteWigo(wigo)
+		replayed++
+	}
+	return
+}
@@ -0,0 +1,333 @@
+package wigo
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// The push server limits what a single client may cost it : the
+// number of connections from an address, the rate of the rpcs of a
+// client and of all the clients, the size of the payloads and the
+// number of probes of a client. Requests over a limit fail with
+// THROTTLED, PAYLOAD TOO LARGE or TOO MANY PROBES. Throttled clients
+// are logged at most once a minute and counted in the statistics.
+//
+// Rpcs preceding Hello are limited by address, the following ones by
+// uuid once the token is verified, so a client claiming the uuid of
+// another one can't exhaust its quota.
+//
+// The size of the payloads is bounded while the requests are read
+// from the connection, before they are decoded in memory : the
+// connection of a client sending a larger request is closed.
+
+var errThrottled = errors.New("THROTTLED")
+
+var errPayloadTooLarge = errors.New("PAYLOAD TOO LARGE")
+
+// Room for the rpc header and the other fields of a request
+const pushRequestOverhead = 65536
+
+// Refused requests counters of the clients not refused for this long are dropped
+const throttledStatsTtl = time.Hour
+
+type PushServerStats struct {
+	Connections         int
+	RejectedConnections uint64
+	ThrottledRequests   uint64
+	OversizedPayloads   uint64
+	TooManyProbes       uint64
+
+	// Refused requests by client uuid or address, for the clients refused in the last hour
+	Throttled map[string]uint64
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+type PushLimiter struct {
+	config *PushServerConfig
+	locker *sync.Mutex
+
+	connections map[string]int
+	clients     map[string]*rateWindow
+	global      *rateWindow
+	lastLog     map[string]time.Time
+	lastRefused map[string]time.Time
+	lastSweep   time.Time
+
+	stats *PushServerStats
+}
+
+func NewPushLimiter(config *PushServerConfig) (this *PushLimiter) {
+	this = new(PushLimiter)
+	this.config = config
+	this.locker = new(sync.Mutex)
+	this.connections = make(map[string]int)
+	this.clients = make(map[string]*rateWindow)
+	this.global = new(rateWindow)
+	this.lastLog = make(map[string]time.Time)
+	this.lastRefused = make(map[string]time.Time)
+	this.lastSweep = time.Now()
+	this.stats = &PushServerStats{Throttled: make(map[string]uint64)}
+	return
+}
+
+// Count a new connection from address, false if there are too many
+func (this *PushLimiter) Connect(address string) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if this.config.MaxConnectionsPerIp > 0 && this.connections[address] >= this.config.MaxConnectionsPerIp {
+		this.stats.RejectedConnections++
+		this.refused(address, address, fmt.Sprintf("more than %d connections", this.config.MaxConnectionsPerIp))
+		return false
+	}
+	this.connections[address]++
+	this.stats.Connections++
+	return true
+}
+
+func (this *PushLimiter) Disconnect(address string) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if this.connections[address]--; this.connections[address] <= 0 {
+		delete(this.connections, address)
+	}
+	this.stats.Connections--
+}
+
+// Count a request of a client, identified by its uuid or address
+func (this *PushLimiter) Allow(client string, name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	if this.config.MaxRequests > 0 && !this.global.allow(now, time.Second, this.config.MaxRequests) {
+		this.stats.ThrottledRequests++
+		this.refused(client, name, fmt.Sprintf("more than %d requests per second from all clients", this.config.MaxRequests))
+		return errThrottled
+	}
+
+	if this.config.MaxRequestsPerClient > 0 {
+		window, ok := this.clients[client]
+		if !ok {
+			window = new(rateWindow)
+			this.clients[client] = window
+		}
+		if !window.allow(now, time.Minute, this.config.MaxRequestsPerClient) {
+			this.stats.ThrottledRequests++
+			this.refused(client, name, fmt.Sprintf("more than %d requests per minute", this.config.MaxRequestsPerClient))
+			return errThrottled
+		}
+	}
+
+	return
+}
+
+func (this *rateWindow) allow(now time.Time, length time.Duration, max int) bool {
+	if now.Sub(this.start) >= length {
+		this.start = now
+		this.count = 0
+	}
+	this.count++
+	return this.count <= max
+}
+
+// Forget the windows of the clients which stopped calling us.
+// Must be called with the lock held.
+func (this *PushLimiter) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < time.Minute {
+		return
+	}
+	this.lastSweep = now
+
+	for client, window := range this.clients {
+		if now.Sub(window.start) >= time.Minute {
+			delete(this.clients, client)
+		}
+	}
+	for client, last := range this.lastLog {
+		if now.Sub(last) >= time.Minute {
+			delete(this.lastLog, client)
+		}
+	}
+	for client, last := range this.lastRefused {
+		if now.Sub(last) >= throttledStatsTtl {
+			delete(this.lastRefused, client)
+			delete(this.stats.Throttled, client)
+		}
+	}
+}
+
+// Check the size of a payload sent by a client
+func (this *PushLimiter) CheckPayload(client string, name string, size int) (err error) {
+	if this.config.MaxPayloadSize <= 0 || size <= this.config.MaxPayloadSize {
+		return
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.stats.OversizedPayloads++
+	this.refused(client, name, fmt.Sprintf("payload of %d bytes exceeds %d bytes", size, this.config.MaxPayloadSize))
+	return errPayloadTooLarge
+}
+
+// Check the number of probes of a client, remote wigos included
+func (this *PushLimiter) CheckProbes(client string, name string, wigo *Wigo) (err error) {
+	if this.config.MaxProbesPerClient <= 0 {
+		return
+	}
+	count := countProbes(wigo)
+	if count <= this.config.MaxProbesPerClient {
+		return
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.stats.TooManyProbes++
+	this.refused(client, name, fmt.Sprintf("%d probes exceed %d probes", count, this.config.MaxProbesPerClient))
+	return errors.New("TOO MANY PROBES")
+}
+
+func countProbes(wigo *Wigo) (count int) {
+	if wigo.LocalHost != nil && wigo.LocalHost.Probes != nil {
+		count = wigo.LocalHost.Probes.Count()
+	}
+	if wigo.RemoteWigos != nil {
+		for item := range wigo.RemoteWigos.IterBuffered() {
+			count += countProbes(item.Val.(*Wigo))
+		}
+	}
+	return
+}
+
+// Count and log a refused request, at most once a minute by client.
+// Must be called with the lock held.
+func (this *PushLimiter) refused(client string, name string, reason string) {
+	now := time.Now()
+	this.stats.Throttled[client]++
+	this.lastRefused[client] = now
+
+	if last, ok := this.lastLog[client]; ok && now.Sub(last) < time.Minute {
+		return
+	}
+	this.lastLog[client] = now
+
+	message := fmt.Sprintf("Push server throttled %s : %s (%d refused requests)", name, reason, this.stats.Throttled[client])
+	log.Println(message)
+	LocalWigo.AddLog(LocalWigo, WARNING, message)
+}
+
+func (this *PushLimiter) Stats() *PushServerStats {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	stats := *this.stats
+	stats.Throttled = make(map[string]uint64)
+	for client, count := range this.stats.Throttled {
+		stats.Throttled[client] = count
+	}
+	return &stats
+}
+
+// Serve the rpcs of a connection, closing it if a request is larger
+// than MaxPayloadSize
+func (this *PushLimiter) ServeConn(server *rpc.Server, conn net.Conn) {
+	reader := &requestReader{reader: conn}
+	if this.config.MaxPayloadSize > 0 {
+		reader.max = this.config.MaxPayloadSize + pushRequestOverhead
+	}
+
+	codec := &pushServerCodec{rwc: conn, reader: reader}
+	codec.dec = gob.NewDecoder(bufio.NewReader(reader))
+	codec.encBuf = bufio.NewWriter(conn)
+	codec.enc = gob.NewEncoder(codec.encBuf)
+	server.ServeCodec(codec)
+
+	if reader.oversized > 0 {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		this.CheckPayload(host, host, reader.oversized)
+	}
+}
+
+// Counts the bytes of the current request, fails once there are too many
+type requestReader struct {
+	reader    io.Reader
+	read      int
+	max       int
+	oversized int
+}
+
+func (this *requestReader) Read(p []byte) (n int, err error) {
+	if this.oversized > 0 {
+		return 0, errPayloadTooLarge
+	}
+	n, err = this.reader.Read(p)
+	this.read += n
+	if this.max > 0 && this.read > this.max {
+		this.oversized = this.read
+	}
+	return
+}
+
+// The gob codec of net/rpc, counting the bytes of every request
+type pushServerCodec struct {
+	rwc    io.ReadWriteCloser
+	reader *requestReader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func (this *pushServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	this.reader.read = 0
+	return this.dec.Decode(r)
+}
+
+func (this *pushServerCodec) ReadRequestBody(body interface{}) (err error) {
+	if err = this.dec.Decode(body); err != nil && this.reader.oversized > 0 {
+		// The decoder can't be used anymore
+		this.Close()
+	}
+	return
+}
+
+func (this *pushServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = this.enc.Encode(r); err != nil {
+		if this.encBuf.Flush() == nil {
+			this.Close()
+		}
+		return
+	}
+	if err = this.enc.Encode(body); err != nil {
+		if this.encBuf.Flush() == nil {
+			this.Close()
+		}
+		return
+	}
+	return this.encBuf.Flush()
+}
+
+func (this *pushServerCodec) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	return this.rwc.Close()
+}
@@ -0,0 +1,464 @@
+package wigo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Several push servers sharing the same CA certificate and key may
+// work as peers so clients can push to any of them. Every peer sends
+// the changes it makes to the others over the push port : the state
+// of the authority clients with their audit trail, the client
+// certificates, the enrollment tokens and the wigos of the clients
+// pushing to it. Peers authenticate with a certificate they sign
+// themselves with the shared CA key.
+//
+// Only the peer a client pushes to raises its notifications, so
+// clients should push to the peers in failover mode. A peer sends
+// a full copy of its state every time it connects to another one.
+
+// Organization of the peer certificates
+const PUSH_PEER_ORGANIZATION = "wigo peer"
+
+// Replicated changes
+const (
+	PEER_REPLICATE_WIGO        = "wigo"
+	PEER_REPLICATE_CLIENT      = "client"
+	PEER_REPLICATE_AUDIT       = "audit"
+	PEER_REPLICATE_CERTIFICATE = "certificate"
+	PEER_REPLICATE_TOKENS      = "tokens"
+)
+
+// Changes queued for a peer while it's unreachable, a full copy
+// is sent when it comes back if the queue overflows
+const pushPeerQueueSize = 10000
+
+// Changes sent in a single rpc
+const pushPeerBatchSize = 100
+
+type PeerMessage struct {
+	Kind    string
+	Payload string
+}
+
+type ReplicateRequest struct {
+	Peer     string
+	Messages []*PeerMessage
+}
+
+// A client state change and its audit entry
+type replicatedClient struct {
+	Client *AuthorityClient
+	Audit  *AuthorityAuditEntry
+}
+
+type replicatedCertificate struct {
+	ClientCertificate
+	Revoked bool
+}
+
+type PushPeerStatus struct {
+	Name      string
+	Address   string
+	Port      int
+	Connected bool
+	Sent      uint64
+	Dropped   uint64
+	LastSync  int64
+	LastError string `json:",omitempty"`
+}
+
+type PushPeer struct {
+	config PushPeerConfig
+	queue  chan *PeerMessage
+	resync bool
+	status *PushPeerStatus
+}
+
+type PushPeers struct {
+	server *PushServer
+	locker *sync.Mutex
+	peers  []*PushPeer
+}
+
+func NewPushPeers(server *PushServer) (this *PushPeers) {
+	this = new(PushPeers)
+	this.server = server
+	this.locker = new(sync.Mutex)
+
+	if len(server.config.Peers) > 0 && !server.config.SslEnabled {
+		log.Fatal("Push server : peers need SslEnabled")
+	}
+
+	for i, config := range server.config.Peers {
+		if config.Address == "" {
+			log.Fatalf("Push server : missing address for peer %d", i)
+		}
+		if config.Port == 0 {
+			config.Port = server.config.Port
+		}
+		if config.Name == "" {
+			config.Name = net.JoinHostPort(config.Address, strconv.Itoa(config.Port))
+		}
+
+		peer := new(PushPeer)
+		peer.config = config
+		peer.queue = make(chan *PeerMessage, pushPeerQueueSize)
+		peer.resync = true
+		peer.status = &PushPeerStatus{Name: config.Name, Address: config.Address, Port: config.Port}
+		this.peers = append(this.peers, peer)
+	}
+
+	return
+}
+
+func (this *PushPeers) Start() {
+	for _, peer := range this.peers {
+		go this.run(peer)
+	}
+}
+
+// Queue a change for every peer
+func (this *PushPeers) Broadcast(kind string, value interface{}) {
+	if len(this.peers) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Push server : unable to encode %s for peers : %s", kind, err)
+		return
+	}
+	message := &PeerMessage{Kind: kind, Payload: string(payload)}
+
+	for _, peer := range this.peers {
+		select {
+		case peer.queue <- message:
+		default:
+			this.locker.Lock()
+			peer.resync = true
+			peer.status.Dropped++
+			this.locker.Unlock()
+		}
+	}
+}
+
+// Send the wigo of a client pushing to us
+func (this *PushPeers) ReplicateWigo(uuid string) {
+	if len(this.peers) == 0 {
+		return
+	}
+	if tmp, ok := LocalWigo.RemoteWigos.Get(uuid); ok {
+		this.Broadcast(PEER_REPLICATE_WIGO, tmp.(*Wigo))
+	}
+}
+
+func (this *PushPeers) Status() (list []*PushPeerStatus) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	list = make([]*PushPeerStatus, 0)
+	for _, peer := range this.peers {
+		status := *peer.status
+		list = append(list, &status)
+	}
+	return
+}
+
+func (this *PushPeers) run(peer *PushPeer) {
+	for {
+		client, err := this.connect(peer)
+		if err == nil {
+			err = this.replicate(peer, client)
+			client.Close()
+		}
+
+		this.locker.Lock()
+		peer.resync = true
+		peer.status.Connected = false
+		peer.status.LastError = err.Error()
+		this.locker.Unlock()
+
+		log.Printf("Push server : peer %s : %s", peer.config.Name, err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Connect to a peer with a peer certificate
+func (this *PushPeers) connect(peer *PushPeer) (client *rpc.Client, err error) {
+	certificate, err := this.newPeerCertificate()
+	if err != nil {
+		return
+	}
+
+	authority := this.server.authority
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	tlsConfig.RootCAs.AddCert(authority.certificate)
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	address := net.JoinHostPort(peer.config.Address, strconv.Itoa(peer.config.Port))
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Push server : connected to peer %s @ %s", peer.config.Name, address)
+	return rpc.NewClient(conn), nil
+}
+
+// Sign a short-lived peer certificate with the CA key
+func (this *PushPeers) newPeerCertificate() (certificate tls.Certificate, err error) {
+	authority := this.server.authority
+	if authority.privateKey == nil {
+		return certificate, errors.New("no CA private key to sign the peer certificate")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   LocalWigo.GetHostname(),
+			Organization: []string{PUSH_PEER_ORGANIZATION},
+		},
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().Add(24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.privateKey)
+	if err != nil {
+		return
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Send a full copy of our state if needed, then the queued changes.
+// Peer certificates are renewed by reconnecting every few hours.
+func (this *PushPeers) replicate(peer *PushPeer, client *rpc.Client) (err error) {
+	this.locker.Lock()
+	peer.status.Connected = true
+	peer.status.LastError = ""
+	this.locker.Unlock()
+
+	reconnect := time.After(12 * time.Hour)
+	for {
+		this.locker.Lock()
+		resync := peer.resync
+		peer.resync = false
+		this.locker.Unlock()
+
+		if resync {
+			// The queued changes are part of the full copy
+			for len(peer.queue) > 0 {
+				<-peer.queue
+			}
+			if err = this.send(peer, client, this.snapshot()); err != nil {
+				return
+			}
+
+			this.locker.Lock()
+			peer.status.LastSync = time.Now().Unix()
+			this.locker.Unlock()
+			log.Printf("Push server : sent a full copy of the state to peer %s", peer.config.Name)
+		}
+
+		var messages []*PeerMessage
+		select {
+		case message := <-peer.queue:
+			messages = append(messages, message)
+		case <-time.After(time.Minute):
+			// Check the connection is still alive
+		case <-reconnect:
+			return errors.New("renewing peer certificate")
+		}
+		for len(messages) < pushPeerBatchSize && len(peer.queue) > 0 {
+			messages = append(messages, <-peer.queue)
+		}
+
+		if err = this.send(peer, client, messages); err != nil {
+			this.locker.Lock()
+			peer.status.Dropped += uint64(len(messages))
+			this.locker.Unlock()
+			return
+		}
+	}
+}
+
+func (this *PushPeers) send(peer *PushPeer, client *rpc.Client, messages []*PeerMessage) (err error) {
+	for len(messages) > 0 {
+		batch := messages
+		if len(batch) > pushPeerBatchSize {
+			batch = batch[:pushPeerBatchSize]
+		}
+		messages = messages[len(batch):]
+
+		req := &ReplicateRequest{Peer: LocalWigo.GetHostname(), Messages: batch}
+		reply := new(bool)
+		call := client.Go("PushServer.Replicate", req, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(30 * time.Second):
+			err = errors.New("replication timed out")
+		}
+		if err != nil {
+			return
+		}
+
+		this.locker.Lock()
+		peer.status.Sent += uint64(len(batch))
+		this.locker.Unlock()
+	}
+	return
+}
+
+// A full copy of the authority state and of the wigos of the clients pushing to us
+func (this *PushPeers) snapshot() (messages []*PeerMessage) {
+	add := func(kind string, value interface{}) {
+		if payload, err := json.Marshal(value); err == nil {
+			messages = append(messages, &PeerMessage{Kind: kind, Payload: string(payload)})
+		}
+	}
+
+	authority := this.server.authority
+	for _, client := range authority.store.List() {
+		add(PEER_REPLICATE_CLIENT, &replicatedClient{Client: client})
+	}
+
+	authority.certLocker.Lock()
+	for _, certificate := range authority.Enrolled {
+		add(PEER_REPLICATE_CERTIFICATE, &replicatedCertificate{ClientCertificate: *certificate})
+	}
+	for _, certificate := range authority.Revoked {
+		add(PEER_REPLICATE_CERTIFICATE, &replicatedCertificate{ClientCertificate: *certificate, Revoked: true})
+	}
+	authority.certLocker.Unlock()
+
+	if content, err := authority.EnrollmentTokens.encode(); err == nil {
+		add(PEER_REPLICATE_TOKENS, string(content))
+	}
+
+	for item := range LocalWigo.RemoteWigos.IterBuffered() {
+		wigo := item.Val.(*Wigo)
+		if wigo.peer == "" && authority.IsAllowed(wigo.Uuid) {
+			add(PEER_REPLICATE_WIGO, wigo)
+		}
+	}
+
+	return
+}
+
+// Apply the changes sent by a peer
+func (this *PushSession) Replicate(req ReplicateRequest, reply *bool) (err error) {
+	if this.peer == "" {
+		log.Printf("Push server : replication from %s refused, not a peer", this.remoteAddr)
+		return errors.New("NOT ALLOWED")
+	}
+
+	for _, message := range req.Messages {
+		if err := this.applyPeerMessage(req.Peer, message); err != nil {
+			log.Printf("Push server : unable to apply %s from peer %s : %s", message.Kind, req.Peer, err)
+		}
+	}
+	*reply = true
+	return
+}
+
+func (this *PushSession) applyPeerMessage(peer string, message *PeerMessage) (err error) {
+	authority := this.authority
+
+	switch message.Kind {
+	case PEER_REPLICATE_WIGO:
+		wigo, err := NewWigoFromJson([]byte(message.Payload), 1)
+		if err != nil {
+			return err
+		}
+		if !authority.IsAllowed(wigo.Uuid) {
+			return fmt.Errorf("%s is not allowed", wigo.Uuid)
+		}
+
+		// Ignore the stale copies of a client which now pushes to us
+		if tmp, ok := LocalWigo.RemoteWigos.Get(wigo.Uuid); ok {
+			current := tmp.(*Wigo)
+			if current.peer == "" && current.LastUpdate >= time.Now().Unix()-int64(LocalWigo.GetConfig().Global.AliveTimeout) {
+				return nil
+			}
+		}
+
+		wigo.peer = peer
+		LocalWigo.AddOrUpdateRemoteWigo(wigo)
+
+	case PEER_REPLICATE_CLIENT:
+		change := new(replicatedClient)
+		if err = json.Unmarshal([]byte(message.Payload), change); err != nil {
+			return
+		}
+		if err = authority.store.Replicate(change.Client, change.Audit); err != nil {
+			return
+		}
+		if change.Client != nil {
+			if state := authority.store.State(change.Client.Uuid); state != CLIENT_ALLOWED {
+				authority.RevokeTokens(change.Client.Uuid)
+				if state == CLIENT_REVOKED {
+					LocalWigo.RemoveRemoteWigo(change.Client.Uuid)
+				}
+			}
+		}
+
+	case PEER_REPLICATE_AUDIT:
+		entry := new(AuthorityAuditEntry)
+		if err = json.Unmarshal([]byte(message.Payload), entry); err != nil {
+			return
+		}
+		err = authority.store.Replicate(nil, entry)
+
+	case PEER_REPLICATE_CERTIFICATE:
+		certificate := new(replicatedCertificate)
+		if err = json.Unmarshal([]byte(message.Payload), certificate); err != nil {
+			return
+		}
+		authority.ReplicateClientCertificate(&certificate.ClientCertificate, certificate.Revoked)
+
+	case PEER_REPLICATE_TOKENS:
+		var content string
+		if err = json.Unmarshal([]byte(message.Payload), &content); err != nil {
+			return
+		}
+		err = authority.EnrollmentTokens.Replace([]byte(content))
+
+	default:
+		err = errors.New("unknown change")
+	}
+
+	return
+}
+
+// Peers are authenticated by a certificate signed by the CA
+func isPeerCertificate(certificate *x509.Certificate) bool {
+	return IsStringInArray(PUSH_PEER_ORGANIZATION, certificate.Subject.Organization)
+}
@@ -1,23 +1,55 @@
 package wigo
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"strconv"
+	"time"
 )
 
 // Push server expose method to update client's
 // data over RPCs. Data is transferred using binary
 // gob serialisation over tcp connection. Secure TLS
 // connection is available and highly recommended.
+//
+// Every connection is served by its own PushSession
+// which knows the identity of the client certificate.
 type PushServer struct {
 	config    *PushServerConfig
-	server    *rpc.Server
 	authority *Authority
+	limiter   *PushLimiter
+	peers     *PushPeers
+
+	// Signers of the client certificates and of the registration certificates
+	clientRoots       *x509.CertPool
+	registrationRoots *x509.CertPool
+}
+
+type PushSession struct {
+	*PushServer
+
+	// Random id session tokens are bound to
+	id string
+
+	// Uuid of the verified client certificate, or subject of
+	// the registration certificate, if any
+	certUuid    string
+	certSubject string
+
+	// Address of the client
+	remoteAddr net.IP
+
+	// Name of the push server peer, see push_peers.go
+	peer string
 }
 
 func NewPushServer(config *PushServerConfig) (this *PushServer) {
@@ -26,10 +58,12 @@ func NewPushServer(config *PushServerConfig) (this *PushServer) {
 	this.config = config
 	address := this.config.Address + ":" + strconv.Itoa(config.Port)
 	this.authority = NewAuthority(this.config)
+	this.limiter = NewPushLimiter(this.config)
+	this.peers = NewPushPeers(this)
+	this.authority.peers = this.peers
 
 	gob.Register([]interface{}{})
 	gob.Register(map[string]interface{}{})
-	rpc.Register(this)
 
 	var listener net.Listener
 	var err error
@@ -40,6 +74,34 @@ func NewPushServer(config *PushServerConfig) (this *PushServer) {
 		if err != nil {
 			log.Fatalf("Push server : error while loading server certificate from %s : %s", this.config.SslCert, err)
 		}
+
+		// Client certificates are signed by the authority. They are
+		// verified here as the authority certificate may be restricted
+		// to server authentication, like the ones of generate_cert.
+		this.clientRoots = x509.NewCertPool()
+		this.clientRoots.AddCert(this.authority.certificate)
+
+		// Registering clients may present a certificate of another CA,
+		// only used to match the accept policies
+		if this.config.RegistrationClientCa != "" {
+			if this.registrationRoots, err = LoadCertPool(this.config.RegistrationClientCa); err != nil {
+				log.Fatalf("Push server : %s", err)
+			}
+		}
+
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return nil
+			}
+			if err := verifyCertificateChain(state.PeerCertificates, this.clientRoots, x509.ExtKeyUsageAny); err != nil {
+				if this.registrationRoots != nil && verifyCertificateChain(state.PeerCertificates, this.registrationRoots, x509.ExtKeyUsageClientAuth) == nil {
+					return nil
+				}
+				return err
+			}
+			return this.authority.VerifyClientCertificate(state.PeerCertificates[0])
+		}
 		rawListner, err := net.Listen("tcp", address)
 		if err != nil {
 			log.Fatalf("Push server : listen error : %s", err)
@@ -58,9 +120,21 @@ func NewPushServer(config *PushServerConfig) (this *PushServer) {
 	go func() {
 		for {
 			if conn, err := listener.Accept(); err == nil {
+				host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				if !this.limiter.Connect(host) {
+					conn.Close()
+					continue
+				}
 				log.Printf("Push server [client %s] : accepting connection", conn.RemoteAddr())
 				go func() {
-					rpc.ServeConn(conn)
+					defer this.limiter.Disconnect(host)
+					if session, err := this.NewPushSession(conn); err == nil {
+						server := rpc.NewServer()
+						server.RegisterName("PushServer", session)
+						this.limiter.ServeConn(server, conn)
+					} else {
+						log.Printf("Push server [client %s] : %s", conn.RemoteAddr(), err)
+					}
 					log.Printf("Push server [client %s] : closing connection", conn.RemoteAddr())
 					conn.Close()
 				}()
@@ -69,6 +143,45 @@ func NewPushServer(config *PushServerConfig) (this *PushServer) {
 			}
 		}
 	}()
+
+	this.peers.Start()
+	return
+}
+
+// Complete the tls handshake to know the client identity
+func (this *PushServer) NewPushSession(conn net.Conn) (session *PushSession, err error) {
+	session = &PushSession{PushServer: this}
+
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	session.id = hex.EncodeToString(id)
+
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		session.remoteAddr = net.ParseIP(host)
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake failed : %s", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+			if verifyCertificateChain(certificates, this.clientRoots, x509.ExtKeyUsageAny) != nil {
+				// Accepted by the handshake, so signed by the RegistrationClientCa
+				session.certSubject = certificates[0].Subject.String()
+			} else if isPeerCertificate(certificates[0]) {
+				session.peer = certificates[0].Subject.CommonName
+				log.Printf("Push server [client %s] : peer %s connected", conn.RemoteAddr(), session.peer)
+			} else {
+				session.certUuid = certificates[0].Subject.CommonName
+			}
+		}
+	}
+
 	return
 }
 
@@ -77,10 +190,13 @@ func NewPushServer(config *PushServerConfig) (this *PushServer) {
 // Send the server CA certificate to the client so it can
 // verify the identity of the server. To avoid the small window
 // of MITM vulnerability you might copy the certificate by yourself.
-func (this *PushServer) GetServerCertificate(req HelloRequest, cert *[]byte) (err error) {
+func (this *PushSession) GetServerCertificate(req HelloRequest, cert *[]byte) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : GetServerCertificate \n%s", ToJson(req))
 	}
+	if err = this.throttle(req.Hostname); err != nil {
+		return
+	}
 	log.Printf("Push server [client %s] : sending server certificate", req.Hostname)
 	*cert = this.authority.GetServerCertificate()
 	return
@@ -89,29 +205,62 @@ func (this *PushServer) GetServerCertificate(req HelloRequest, cert *[]byte) (er
 // Register a new client. It will first be added to a
 // waiting list, then an admin action will be required
 // to grant the client to the allowed list. You may accept
-// new clients automatically with the AutoAcceptClient setting.
-func (this *PushServer) Register(req HelloRequest, reply *bool) (err error) {
+// new clients automatically with the AutoAcceptClient setting,
+// with accept policies or with enrollment tokens.
+func (this *PushSession) Register(req HelloRequest, reply *bool) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : Register \n%s", ToJson(req))
 	}
-	if !this.authority.IsAllowed(req.Uuid) {
-		log.Printf("Push server [client %s] : adding client to waiting list", req.Hostname)
-		this.authority.AddClientToWaitingList(req.Uuid, req.Hostname)
-		if this.config.AutoAcceptClients {
-			log.Printf("Push server [client %s] : automatically accepting client as configured", req.Hostname)
-			this.authority.AllowClient(req.Uuid)
+	if err = this.throttle(req.Hostname); err != nil {
+		return
+	}
+	if this.authority.IsAllowed(req.Uuid) {
+		this.authority.store.Seen(req.Uuid, this.remoteAddr)
+		return
+	}
+
+	policy := this.authority.MatchAcceptPolicy(req.Hostname, this.remoteAddr, this.certSubject)
+	policyName := ""
+	if policy != nil {
+		policyName = policy.Name
+		if policy.Action == ACCEPT_POLICY_REJECT {
+			log.Printf("Push server [client %s] : client rejected by accept policy %s", req.Hostname, policy.Name)
+			this.authority.RejectClient(req.Uuid, req.Hostname, this.remoteAddr, policy.Name)
+			return errors.New("REJECTED")
+		}
+	}
+
+	if req.EnrollmentToken != "" {
+		if this.authority.AllowClientWithToken(req.Uuid, req.Hostname, this.remoteAddr, req.EnrollmentToken) == nil {
+			log.Printf("Push server [client %s] : client allowed with enrollment token", req.Hostname)
+			return
 		}
 	}
+
+	log.Printf("Push server [client %s] : adding client to waiting list", req.Hostname)
+	this.authority.AddClientToWaitingList(req.Uuid, req.Hostname, this.remoteAddr, policyName)
+	if policy != nil {
+		if policy.Action == ACCEPT_POLICY_ACCEPT {
+			log.Printf("Push server [client %s] : automatically accepting client by accept policy %s", req.Hostname, policy.Name)
+			this.authority.AllowClient(req.Uuid, "accept policy "+policy.Name)
+		}
+	} else if this.config.AutoAcceptClients {
+		log.Printf("Push server [client %s] : automatically accepting client as configured", req.Hostname)
+		this.authority.AllowClient(req.Uuid, "AutoAcceptClients")
+	}
 	return
 }
 
 // Sign the client uuid with the server's private key.
 // The client will have to provide this as a proof of
 // his identity at every new connection.
-func (this *PushServer) GetUuidSignature(req HelloRequest, sig *[]byte) (err error) {
+func (this *PushSession) GetUuidSignature(req HelloRequest, sig *[]byte) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : GetUuidSignature \n%s", ToJson(req))
 	}
+	if err = this.throttle(req.Hostname); err != nil {
+		return
+	}
 	if this.authority.IsAllowed(req.Uuid) {
 		log.Printf("Push server [client %s] : sending uuid signature", req.Hostname)
 		*sig, err = this.authority.GetUuidSignature(req.Uuid, req.Hostname)
@@ -129,13 +278,16 @@ func (this *PushServer) GetUuidSignature(req HelloRequest, sig *[]byte) (err err
 
 // Verify the validity of the client's uuid signature. This is done
 // once for every connection then a token then a token is used.
-func (this *PushServer) Hello(req HelloRequest, token *string) (err error) {
+func (this *PushSession) Hello(req HelloRequest, token *string) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : Hello \n%s", ToJson(req))
 	}
+	if err = this.throttle(req.Hostname); err != nil {
+		return
+	}
 	if this.authority.IsAllowed(req.Uuid) {
-		if err = this.authority.VerifyUuidSignature(req.Uuid, req.UuidSignature); err == nil {
-			if *token, err = this.authority.GetToken(req.Uuid); err == nil {
+		if err = this.verifyIdentity(req); err == nil {
+			if *token, err = this.authority.GetToken(req.Uuid, this.id); err == nil {
 				log.Printf("Push server [client %s] : Hello", req.Hostname)
 			} else {
 				log.Printf("Push server [client %s] : Hello, your uuid is valid but couldn't get your token (%s)", req.Hostname, err.Error())
@@ -159,7 +311,7 @@ func (this *PushServer) Hello(req HelloRequest, token *string) (err error) {
 }
 
 // Update a client's data
-func (this *PushServer) Update(req UpdateRequest, reply *bool) (err error) {
+func (this *PushSession) Update(req UpdateRequest, reply *bool) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : Update \n%s", ToJson(req))
 	}
@@ -167,32 +319,216 @@ func (this *PushServer) Update(req UpdateRequest, reply *bool) (err error) {
 		if req.WigoJson == "" {
 			wigoHostname := req.WigoHostname
 			if this.authority.IsAllowed(req.Uuid) {
-				wigoHostname = this.authority.Allowed[req.Uuid]
+				wigoHostname = this.authority.GetHostname(req.Uuid)
 			}
 			log.Printf("Push server : Legacy data format received from wigo %s with uuid %s, please update your wigo client", wigoHostname, req.Uuid)
 			err = errors.New("TOO OLD WIGO CLIENT")
-		} else {
+		} else if err = this.limiter.CheckPayload(req.Uuid, req.WigoHostname, len(req.WigoJson)); err == nil {
 			wigoJson := []byte(req.WigoJson)
 			wigo, err := NewWigoFromJson(wigoJson, 1)
 			if err != nil {
 				log.Printf("Push server : Cannot decode json for wigo %s with uuid %s : %s", req.WigoHostname, req.Uuid, err.Error())
 				err = errors.New("CANNOT DECODE")
 			} else {
+				// Clients may only update their own state
+				if wigo.Uuid != req.Uuid {
+					log.Printf("Push server : Update from %s with uuid %s refused, it holds the state of uuid %s", req.WigoHostname, req.Uuid, wigo.Uuid)
+					return errors.New("NOT ALLOWED")
+				}
 				log.Printf("Push server : Update from %s with uuid %s", req.WigoHostname, req.Uuid)
+				if err := this.limiter.CheckProbes(req.Uuid, req.WigoHostname, wigo); err != nil {
+					return err
+				}
 				wigo.SetParentHostsInProbes()
+				this.authority.SetDefaultGroup(wigo)
 				// TODO this should return an error
 				LocalWigo.AddOrUpdateRemoteWigo(wigo)
+				this.peers.ReplicateWigo(wigo.Uuid)
 			}
 		}
-	} else {
+	} else if err != errThrottled {
 		log.Printf("Push server : Update for %s with uuid %s refused, you're not allowed", req.WigoHostname, req.Uuid)
-		err = errors.New("NOT ALLOWED")
 	}
 	return
 }
 
+// Clients prove their identity with their certificate or with their uuid signature
+func (this *PushSession) verifyIdentity(req HelloRequest) (err error) {
+	if this.certUuid != "" {
+		if this.certUuid != req.Uuid {
+			return fmt.Errorf("certificate of %s used by %s", this.certUuid, req.Uuid)
+		}
+		return
+	}
+	if this.config.RequireClientCert {
+		return errors.New("client certificate required")
+	}
+	return this.authority.VerifyUuidSignature(req.Uuid, req.UuidSignature)
+}
+
+// Sign the certificate signing request of an allowed client. Clients
+// enroll once, then renew their certificate over mutual tls.
+func (this *PushSession) Enroll(req EnrollRequest, cert *[]byte) (err error) {
+	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
+		log.Printf("Push server Debug : Enroll \n%s", ToJson(req))
+	}
+	if err = this.throttle(req.Hostname); err != nil {
+		return
+	}
+	if !this.config.SslEnabled || !this.config.ClientCertEnrollment {
+		return errors.New("ENROLLMENT DISABLED")
+	}
+
+	if !this.authority.IsAllowed(req.Uuid) {
+		if this.authority.IsWaiting(req.Uuid) {
+			log.Printf("Push server [client %s] : won't sign your certificate, you're on the waiting queue", req.Hostname)
+			return errors.New("WAITING")
+		}
+		log.Printf("Push server [client %s] : won't sign your certificate, you're not allowed", req.Hostname)
+		return errors.New("NOT ALLOWED")
+	}
+
+	// Renewals must be authenticated by the current certificate
+	if this.certUuid != req.Uuid && this.authority.IsEnrolled(req.Uuid) {
+		log.Printf("Push server [client %s] : won't sign your certificate, you're already enrolled", req.Hostname)
+		return errors.New("ALREADY ENROLLED")
+	}
+
+	log.Printf("Push server [client %s] : signing client certificate", req.Hostname)
+	*cert, err = this.authority.IssueClientCertificate(req.Uuid, req.Hostname, req.Csr)
+	return
+}
+
+// Hello for clients speaking the push protocol v2 and above. Older
+// servers don't have this method so clients fall back to Hello.
+// The reply holds the negotiated protocol version and the
+// capabilities supported by both sides.
+func (this *PushSession) HelloV2(req HelloV2Request, reply *HelloV2Reply) (err error) {
+	if err = this.Hello(req.HelloRequest, &reply.Token); err != nil {
+		return
+	}
+
+	reply.ProtocolVersion = PUSH_PROTOCOL_VERSION
+	if req.ProtocolVersion < reply.ProtocolVersion {
+		reply.ProtocolVersion = req.ProtocolVersion
+	}
+	for _, capability := range req.Capabilities {
+		if IsStringInArray(capability, PushCapabilities) {
+			reply.Capabilities = append(reply.Capabilities, capability)
+		}
+	}
+	reply.TokenTtl = this.config.SessionTokenTtl
+
+	log.Printf("Push server [client %s] : using push protocol v%d %v", req.Hostname, reply.ProtocolVersion, reply.Capabilities)
+	return
+}
+
+// Update a client's data with a full snapshot or with the
+// changes since the previous update. If the server doesn't have
+// the state the changes apply to it asks for a full snapshot.
+func (this *PushSession) UpdateV2(req UpdateV2Request, reply *UpdateV2Reply) (err error) {
+	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
+		log.Printf("Push server Debug : UpdateV2 \n%s", ToJson(req))
+	}
+	if err = this.auth(req.Request); err != nil {
+		if err != errThrottled {
+			log.Printf("Push server : Update for %s with uuid %s refused, you're not allowed", req.WigoHostname, req.Uuid)
+		}
+		return
+	}
+	if err = this.limiter.CheckPayload(req.Uuid, req.WigoHostname, len(req.Payload)); err != nil {
+		return
+	}
+
+	var wigo *Wigo
+	switch req.Kind {
+	case PUSH_UPDATE_FULL:
+		if wigo, err = NewWigoFromJson([]byte(req.Payload), 1); err != nil {
+			log.Printf("Push server : Cannot decode json for wigo %s with uuid %s : %s", req.WigoHostname, req.Uuid, err.Error())
+			return errors.New("CANNOT DECODE")
+		}
+
+		// Clients may only update their own state
+		if wigo.Uuid != req.Uuid {
+			log.Printf("Push server : Update from %s with uuid %s refused, it holds the state of uuid %s", req.WigoHostname, req.Uuid, wigo.Uuid)
+			return errors.New("NOT ALLOWED")
+		}
+		log.Printf("Push server : Update from %s with uuid %s (full snapshot)", req.WigoHostname, req.Uuid)
+	case PUSH_UPDATE_DELTA:
+		changes := new(ApiChanges)
+		if err = json.Unmarshal([]byte(req.Payload), changes); err != nil {
+			log.Printf("Push server : Cannot decode json for wigo %s with uuid %s : %s", req.WigoHostname, req.Uuid, err.Error())
+			return errors.New("CANNOT DECODE")
+		}
+
+		// The changes must apply to the state we already have
+		tmp, ok := LocalWigo.RemoteWigos.Get(req.Uuid)
+		if !ok || changes.Uuid != req.Uuid || tmp.(*Wigo).Epoch != changes.Epoch || tmp.(*Wigo).Revision < req.Since {
+			log.Printf("Push server : Update from %s with uuid %s can't be applied, asking for a full snapshot", req.WigoHostname, req.Uuid)
+			reply.Resync = true
+			return nil
+		}
+
+		wigo = tmp.(*Wigo).ApplyChanges(changes, 1)
+		log.Printf("Push server : Update from %s with uuid %s (revision %d)", req.WigoHostname, req.Uuid, changes.Revision)
+	default:
+		log.Printf("Push server : Unknown update kind %s from %s with uuid %s", req.Kind, req.WigoHostname, req.Uuid)
+		return errors.New("UNKNOWN UPDATE KIND")
+	}
+
+	if err = this.limiter.CheckProbes(req.Uuid, req.WigoHostname, wigo); err != nil {
+		return
+	}
+
+	this.authority.SetDefaultGroup(wigo)
+	LocalWigo.AddOrUpdateRemoteWigo(wigo)
+	this.peers.ReplicateWigo(wigo.Uuid)
+	reply.Revision = wigo.Revision
+	return
+}
+
+// Replay the probe changes journaled by a client while it
+// was disconnected, before it sends its current state
+func (this *PushSession) Replay(req ReplayRequest, reply *int) (err error) {
+	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
+		log.Printf("Push server Debug : Replay \n%s", ToJson(req))
+	}
+	if err = this.auth(req.Request); err != nil {
+		if err != errThrottled {
+			log.Printf("Push server : Replay for %s with uuid %s refused, you're not allowed", req.WigoHostname, req.Uuid)
+		}
+		return
+	}
+	if err = this.limiter.CheckPayload(req.Uuid, req.WigoHostname, len(req.Entries)); err != nil {
+		return
+	}
+
+	var entries []*PushJournalEntry
+	if err = json.Unmarshal([]byte(req.Entries), &entries); err != nil {
+		log.Printf("Push server : Cannot decode json for wigo %s with uuid %s : %s", req.WigoHostname, req.Uuid, err.Error())
+		return errors.New("CANNOT DECODE")
+	}
+
+	*reply = LocalWigo.ReplayProbeChanges(req.Uuid, entries)
+	log.Printf("Push server : Replayed %d of %d probe changes from %s with uuid %s", *reply, len(entries), req.WigoHostname, req.Uuid)
+	return
+}
+
+// Replace the session token before it expires. The new token is
+// bound to the same connection, the previous one is revoked.
+func (this *PushSession) RefreshToken(req Request, reply *RefreshTokenReply) (err error) {
+	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
+		log.Printf("Push server Debug : RefreshToken \n%s", ToJson(req))
+	}
+	if reply.Token, err = this.authority.RefreshToken(req.Uuid, req.Token, this.id); err != nil {
+		return errors.New("NOT ALLOWED")
+	}
+	reply.TokenTtl = this.config.SessionTokenTtl
+	return
+}
+
 // Disconnect the client gracefully
-func (this *PushServer) Goodbye(req Request, reply *bool) (err error) {
+func (this *PushSession) Goodbye(req Request, reply *bool) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : Goodbye \n%s", ToJson(req))
 	}
@@ -211,6 +547,9 @@ type HelloRequest struct {
 	Hostname      string
 	Uuid          string
 	UuidSignature []byte
+
+	// Allows the client when registering, see enrollment_tokens.go
+	EnrollmentToken string `json:"-"`
 }
 
 func NewHelloRequest(uuidSignature []byte) (this *HelloRequest) {
@@ -221,6 +560,12 @@ func NewHelloRequest(uuidSignature []byte) (this *HelloRequest) {
 	return
 }
 
+// Certificate signing request of a client
+type EnrollRequest struct {
+	HelloRequest
+	Csr []byte
+}
+
 // Base request for every subsequent requests
 type Request struct {
 	Uuid  string
@@ -234,19 +579,25 @@ func NewRequest(uuid string, token string) (this *Request) {
 	return
 }
 
-// This check the validity of the token. Token will
-// expire within 300 seconds hence forcing the client
-// to reconnect. Here we also check for flooding clients.
-func (this *PushServer) auth(req *Request) (err error) {
+// This check the validity of the token. Tokens are bound to
+// the connection they were issued on and expire after
+// SessionTokenTtl seconds, forcing clients which don't
+// refresh them to reconnect.
+func (this *PushSession) auth(req *Request) (err error) {
 	if LocalWigo.GetConfig().Global.Debug && LocalWigo.GetConfig().Global.Trace {
 		log.Printf("Push server Debug : auth \n%s", ToJson(req))
 	}
-	err = this.authority.VerifyToken(req.Uuid, req.Token)
+	err = this.authority.VerifyToken(req.Uuid, req.Token, this.id)
 	if err != nil {
-		err = errors.New("NOT ALLOWED")
+		return errors.New("NOT ALLOWED")
 	}
 
-	return
+	return this.limiter.Allow(req.Uuid, this.authority.GetHostname(req.Uuid))
+}
+
+// Limit the requests preceding Hello by address, see push_limits.go
+func (this *PushSession) throttle(hostname string) (err error) {
+	return this.limiter.Allow(this.remoteAddr.String(), hostname+" ("+this.remoteAddr.String()+")")
 }
 
 // Request the server to update the client's data
@@ -267,3 +618,69 @@ func NewUpdateRequest(wigo *Wigo, token string) (this *UpdateRequest) {
 	this.WigoHostname = wigo.GetHostname()
 	return
 }
+
+// Push protocol v2 and above exchange json payloads, wrapped into
+// versioned requests. Capabilities are negotiated in HelloV2 so
+// mixed-version fleets keep working : clients fall back to the v1
+// rpcs when the server doesn't know HelloV2.
+const PUSH_PROTOCOL_VERSION = 2
+
+// Push capabilities
+const (
+	PUSH_CAPABILITY_DELTA   = "delta"
+	PUSH_CAPABILITY_REPLAY  = "replay"
+	PUSH_CAPABILITY_REFRESH = "refresh"
+)
+
+var PushCapabilities = []string{PUSH_CAPABILITY_DELTA, PUSH_CAPABILITY_REPLAY, PUSH_CAPABILITY_REFRESH}
+
+// Update kinds
+const (
+	PUSH_UPDATE_FULL  = "full"
+	PUSH_UPDATE_DELTA = "delta"
+)
+
+type HelloV2Request struct {
+	HelloRequest
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+type HelloV2Reply struct {
+	Token           string
+	ProtocolVersion int
+	Capabilities    []string
+
+	// Validity of the token in seconds, 0 never expires
+	TokenTtl int
+}
+
+type RefreshTokenReply struct {
+	Token    string
+	TokenTtl int
+}
+
+// A full snapshot of the client's wigo, or the changes
+// (ApiChanges) since the revision Since, as json
+type UpdateV2Request struct {
+	*Request
+	WigoHostname string
+	Kind         string
+	Since        uint64
+	Payload      string
+}
+
+type UpdateV2Reply struct {
+	// Revision of the client's state now known by the server
+	Revision uint64
+
+	// The server can't apply the changes, send a full snapshot
+	Resync bool
+}
+
+// Probe changes journaled while disconnected (PushJournalEntry), as json
+type ReplayRequest struct {
+	*Request
+	WigoHostname string
+	Entries      string
+}
@@ -0,0 +1,316 @@
+package wigo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The push client may push to several push servers. In fanout mode
+// it pushes to every target simultaneously, in failover mode only
+// to the first reachable target of the list, switching back to a
+// preferred target as soon as it is reachable again.
+//
+// Every target has its own server certificate, client certificate,
+// uuid signature and push journal. Without [[PushClient.Targets]]
+// the push client pushes to the Address and Port of the
+// [PushClient] section.
+
+// Push modes
+const (
+	PUSH_MODE_FANOUT   = "fanout"
+	PUSH_MODE_FAILOVER = "failover"
+)
+
+type PushTargetStatus struct {
+	Name     string
+	Address  string
+	Port     int
+	Priority int
+
+	// Failover mode : the target we're pushing to
+	Active bool
+
+	Connected       bool
+	ProtocolVersion int
+	Pushes          uint64
+	Failures        uint64
+	LastPush        int64
+	LastError       string `json:",omitempty"`
+}
+
+type PushTarget struct {
+	config  *PushClientConfig
+	journal *PushJournal
+	status  *PushTargetStatus
+}
+
+type PushTargets struct {
+	config  *PushClientConfig
+	locker  *sync.Mutex
+	targets []*PushTarget
+}
+
+func NewPushTargets(config *PushClientConfig) (this *PushTargets, err error) {
+	this = new(PushTargets)
+	this.config = config
+	this.locker = new(sync.Mutex)
+
+	switch config.Mode {
+	case PUSH_MODE_FANOUT, PUSH_MODE_FAILOVER:
+	default:
+		return nil, fmt.Errorf("Invalid push client mode %s", config.Mode)
+	}
+
+	names := make(map[string]bool)
+	if len(config.Targets) == 0 {
+		this.targets = append(this.targets, this.newTarget(config, net.JoinHostPort(config.Address, strconv.Itoa(config.Port)), 0))
+	}
+	for i, targetConfig := range config.Targets {
+		if targetConfig.Address == "" {
+			return nil, fmt.Errorf("Missing address for push target %d", i)
+		}
+
+		merged := *config
+		merged.Targets = nil
+		merged.Address = targetConfig.Address
+		if targetConfig.Port != 0 {
+			merged.Port = targetConfig.Port
+		}
+		if targetConfig.SslEnabled {
+			merged.SslEnabled = true
+		}
+		if targetConfig.EnrollmentToken != "" {
+			merged.EnrollmentToken = targetConfig.EnrollmentToken
+		}
+
+		name := targetConfig.Name
+		if name == "" {
+			name = net.JoinHostPort(merged.Address, strconv.Itoa(merged.Port))
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate push target %s", name)
+		}
+		names[name] = true
+
+		// Every target has its own certificates, uuid signature and journal
+		merged.SslCert = pushTargetFile(targetConfig.SslCert, config.SslCert, name)
+		merged.SslClientCert = pushTargetFile(targetConfig.SslClientCert, config.SslClientCert, name)
+		merged.SslClientKey = pushTargetFile(targetConfig.SslClientKey, config.SslClientKey, name)
+		merged.UuidSig = pushTargetFile(targetConfig.UuidSig, config.UuidSig, name)
+		merged.JournalFile = pushTargetFile(targetConfig.JournalFile, config.JournalFile, name)
+
+		this.targets = append(this.targets, this.newTarget(&merged, name, i))
+	}
+
+	// In failover mode the changes journaled while no target is
+	// reachable are replayed to the next one we connect to
+	if config.Mode == PUSH_MODE_FAILOVER && config.JournalSize > 0 {
+		journal := NewPushJournal(config)
+		AddPushJournal(journal)
+		for _, target := range this.targets {
+			target.journal = journal
+		}
+	}
+
+	return
+}
+
+func (this *PushTargets) newTarget(config *PushClientConfig, name string, priority int) (target *PushTarget) {
+	target = new(PushTarget)
+	target.config = config
+	target.status = &PushTargetStatus{Name: name, Address: config.Address, Port: config.Port, Priority: priority}
+
+	if this.config.Mode == PUSH_MODE_FANOUT && config.JournalSize > 0 {
+		target.journal = NewPushJournal(config)
+		AddPushJournal(target.journal)
+	}
+
+	return
+}
+
+// Derive a per target file name from the default one,
+// /var/lib/wigo/uuid.sig becomes /var/lib/wigo/uuid.<target>.sig
+func pushTargetFile(file string, defaultFile string, name string) string {
+	if file != "" {
+		return file
+	}
+
+	name = strings.NewReplacer("/", "_", ":", "_", "[", "", "]", "").Replace(name)
+	ext := filepath.Ext(defaultFile)
+	return strings.TrimSuffix(defaultFile, ext) + "." + name + ext
+}
+
+func (this *PushTargets) Start() {
+	if this.config.Mode == PUSH_MODE_FAILOVER {
+		go this.failover()
+		return
+	}
+
+	for _, target := range this.targets {
+		go this.fanout(target)
+	}
+}
+
+// Status of every push target
+func (this *PushTargets) Status() (list []*PushTargetStatus) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for _, target := range this.targets {
+		status := *target.status
+		list = append(list, &status)
+	}
+	return
+}
+
+// Connect, say hello and replay the journal. Retry at once
+// when the client asks to reconnect after downloading the
+// server certificate or getting its uuid signed.
+func (this *PushTargets) connect(target *PushTarget) (client *PushClient, err error) {
+	for i := 0; i < 3; i++ {
+		client, err = NewPushClient(target.config, target.journal)
+		if err == nil {
+			err = client.Hello()
+			if err == nil {
+				err = client.Replay()
+			}
+		}
+		if err == nil {
+			this.connected(target, client)
+			return
+		}
+
+		client.Close()
+		client = nil
+		if err.Error() != "RECONNECT" {
+			break
+		}
+	}
+
+	this.failed(target, err)
+	return
+}
+
+// Push to the target, closing the client on errors
+func (this *PushTargets) push(target *PushTarget, client *PushClient) (err error) {
+	if err = client.Update(); err != nil {
+		if target.journal != nil {
+			target.journal.Start()
+		}
+		client.Close()
+		this.failed(target, err)
+		return
+	}
+
+	this.locker.Lock()
+	target.status.Pushes++
+	target.status.LastPush = time.Now().Unix()
+	target.status.LastError = ""
+	this.locker.Unlock()
+	return
+}
+
+func (this *PushTargets) connected(target *PushTarget, client *PushClient) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	target.status.Connected = true
+	target.status.ProtocolVersion = client.protocol
+}
+
+func (this *PushTargets) failed(target *PushTarget, err error) {
+	if err == nil {
+		err = errors.New("Not connected")
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	target.status.Connected = false
+	target.status.Failures++
+	target.status.LastError = err.Error()
+}
+
+func (this *PushTargets) setActive(active *PushTarget) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for _, target := range this.targets {
+		target.status.Active = target == active
+	}
+}
+
+func (this *PushTargets) fanout(target *PushTarget) {
+	var client *PushClient
+	for {
+		if client == nil {
+			if client, _ = this.connect(target); client == nil {
+				time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
+				continue
+			}
+		}
+
+		time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
+		if err := this.push(target, client); err != nil {
+			client = nil
+		}
+	}
+}
+
+func (this *PushTargets) failover() {
+	var client *PushClient
+	active := -1
+	lastFailback := time.Now()
+
+	for {
+		// Connect to the first reachable target
+		if client == nil {
+			for i, target := range this.targets {
+				if client, _ = this.connect(target); client != nil {
+					log.Printf("Push client : pushing to %s", target.status.Name)
+					active = i
+					lastFailback = time.Now()
+					this.setActive(target)
+					break
+				}
+			}
+			if client == nil {
+				this.setActive(nil)
+				time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
+				continue
+			}
+		}
+
+		time.Sleep(time.Duration(this.config.PushInterval) * time.Second)
+		if err := this.push(this.targets[active], client); err != nil {
+			client = nil
+			continue
+		}
+
+		// Switch back to a preferred target when it's reachable again
+		if active > 0 && time.Since(lastFailback) >= time.Duration(this.config.FailbackInterval)*time.Second {
+			lastFailback = time.Now()
+			for i := 0; i < active; i++ {
+				if preferred, _ := this.connect(this.targets[i]); preferred != nil {
+					log.Printf("Push client : %s is reachable again, switching back from %s", this.targets[i].status.Name, this.targets[active].status.Name)
+					client.Goodbye()
+					this.locker.Lock()
+					this.targets[active].status.Connected = false
+					this.locker.Unlock()
+
+					client = preferred
+					active = i
+					this.setActive(this.targets[i])
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package wigo
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/root-gg/gopentsdb"
+)
+
+// The configuration file is read again on SIGHUP or through the
+// api. The new configuration is validated first (see Validate in
+// config_check.go), an invalid one is rejected and the running
+// configuration is left untouched.
+//
+// Settings read when they are used (notifications, http auth,
+// remote wigos polling, OpenTSDB, hostname, group, log file...)
+// are applied at once, probes results are kept. Other changes
+// are reported as requiring a restart and are not applied, the
+// running configuration keeps their previous value.
+//
+// The running configuration is never modified : the reloaded one
+// replaces it at once, so readers see either of them. The users
+// file is read again on every reload.
+
+// Settings applied on reload, by section or by Section.Setting
+var reloadableSettings = map[string]bool{
+	"Global.Hostname":            true,
+	"Global.Group":               true,
+	"Global.LogFile":             true,
+	"Global.Trace":               true,
+	"Global.AliveTimeout":        true,
+	"Global.CertExpiryWarning":   true,
+	"Global.DisabledProbesRetry": true,
+
+	"Http.Login":       true,
+	"Http.Password":    true,
+	"Http.UsersFile":   true,
+	"Http.ClientCerts": true,
+
+	"Http.AnonymousRole": true,
+
+	"RemoteWigos.CheckInterval": true,
+	"RemoteWigos.Timeout":       true,
+	"RemoteWigos.MaxBackoff":    true,
+	"RemoteWigos.Jitter":        true,
+	"RemoteWigos.SslEnabled":    true,
+	"RemoteWigos.SslCa":         true,
+	"RemoteWigos.SslCert":       true,
+	"RemoteWigos.SslKey":        true,
+	"RemoteWigos.Login":         true,
+	"RemoteWigos.Password":      true,
+	"RemoteWigos.List":          true,
+	"RemoteWigos.AdvancedList":  true,
+
+	"Notifications": true,
+	"OpenTSDB":      true,
+}
+
+type ConfigReload struct {
+	Applied         []string
+	RestartRequired []string
+}
+
+var reloadLocker sync.Mutex
+
+func (this *Wigo) ReloadConfig() (result *ConfigReload, err error) {
+	reloadLocker.Lock()
+	defer reloadLocker.Unlock()
+
+	running := this.GetConfig()
+
+	config, err := LoadConfig(running.Global.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	config.Global.SetDefaultHostnameAndGroup()
+
+	problems := config.Validate()
+	if HasConfigErrors(problems) {
+		return nil, fmt.Errorf("Invalid configuration file %s : %s", config.Global.ConfigFile, formatConfigProblems(problems))
+	}
+	for _, problem := range problems {
+		log.Printf("Configuration file %s : %s", config.Global.ConfigFile, problem)
+	}
+
+	var tsdb *gopentsdb.OpenTsdb
+	if config.OpenTSDB.Enabled && !reflect.DeepEqual(config.OpenTSDB, running.OpenTSDB) {
+		if tsdb, err = gopentsdb.NewOpenTsdb(config.OpenTSDB.Address, config.OpenTSDB.SslEnabled, config.OpenTSDB.Deduplication, config.OpenTSDB.BufferSize); err != nil {
+			return nil, fmt.Errorf("Invalid OpenTSDB configuration : %s", err)
+		}
+		gopentsdb.Verbose(running.Global.Debug)
+	}
+
+	// The new OpenTSDB client must be set before it is enabled
+	if tsdb != nil {
+		this.gopentsdb.Store(tsdb)
+	}
+
+	result = new(ConfigReload)
+	result.Applied = make([]string, 0)
+	result.RestartRequired = make([]string, 0)
+
+	// The running configuration is never modified, the reloadable
+	// settings are applied to a copy of its sections
+	next := *running
+	next.files = config.files
+	next.environment = config.environment
+
+	current := reflect.ValueOf(running).Elem()
+	reloaded := reflect.ValueOf(config).Elem()
+	copied := reflect.ValueOf(&next).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		if current.Field(i).Kind() != reflect.Ptr {
+			continue
+		}
+		section := current.Type().Field(i).Name
+		currentSection := current.Field(i).Elem()
+		reloadedSection := reloaded.Field(i).Elem()
+
+		nextSection := reflect.New(currentSection.Type())
+		nextSection.Elem().Set(currentSection)
+		copied.Field(i).Set(nextSection)
+
+		for j := 0; j < currentSection.NumField(); j++ {
+			if reflect.DeepEqual(currentSection.Field(j).Interface(), reloadedSection.Field(j).Interface()) {
+				continue
+			}
+			setting := section + "." + currentSection.Type().Field(j).Name
+
+			if reloadableSettings[section] || reloadableSettings[setting] {
+				nextSection.Elem().Field(j).Set(reloadedSection.Field(j))
+				result.Applied = append(result.Applied, setting)
+			} else {
+				result.RestartRequired = append(result.RestartRequired, setting)
+			}
+		}
+	}
+
+	this.config.Store(&next)
+	this.remotes.SetConfig(next.RemoteWigos)
+
+	for _, setting := range result.Applied {
+		switch setting {
+		case "Global.Hostname", "Global.Group":
+			this.Lock()
+			this.Hostname = next.Global.Hostname
+			this.LocalHost.Name = next.Global.Hostname
+			this.LocalHost.Group = next.Global.Group
+			this.Unlock()
+		case "RemoteWigos.AdvancedList":
+			this.remotes.Reload(next.RemoteWigos.AdvancedList)
+		}
+	}
+
+	// Users and tokens may have been edited by hand
+	if err := this.users.Reload(next.Http.UsersFile); err != nil {
+		log.Printf("Failed to reload users : %s", err)
+	}
+
+	// Reopen the log file, it may have been rotated
+	if err := this.InitOrReloadLogger(); err != nil {
+		log.Printf("Failed to reopen log file : %s", err)
+	}
+
+	message := "Configuration reloaded"
+	if len(result.Applied) > 0 {
+		message += ", applied " + strings.Join(result.Applied, ", ")
+	}
+	if len(result.RestartRequired) > 0 {
+		message += ", restart required to apply " + strings.Join(result.RestartRequired, ", ")
+	}
+	log.Println(message)
+	if len(result.Applied) > 0 || len(result.RestartRequired) > 0 {
+		this.AddLog(this, INFO, message)
+	}
+
+	return result, nil
+}
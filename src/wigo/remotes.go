@@ -0,0 +1,757 @@
+package wigo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Remote wigos are polled over http, see Polling below.
+//
+// The list is made of the [RemoteWigos] and [[AdvancedList]]
+// entries of the configuration file and of the remotes added
+// at runtime through the api. Remotes can be added, changed
+// or removed at any time, removing a remote stops its polling
+// goroutine and drops it from the RemoteWigos of the local wigo.
+//
+// Changes done through the api are saved in the remotes file
+// so they survive a restart : added remotes and the names of
+// the configuration file remotes that were removed.
+//
+// Remotes found by discovery providers (see discovery.go) are
+// not saved, they are discovered again at startup.
+
+// Sources of remote wigos
+const (
+	REMOTE_SOURCE_CONFIG = "config"
+	REMOTE_SOURCE_API    = "api"
+)
+
+var errRemoteNotPolled = errors.New("This wigo is not polled by the local wigo")
+
+const remotePostTimeout = time.Minute
+
+type RemotesManager struct {
+	config atomic.Pointer[RemoteWigoConfig]
+	file   string
+	locker *sync.Mutex
+
+	remotes   map[string]*remoteWigo
+	removed   []string
+	discovery []*Discovery
+	started   bool
+
+	jobs      chan func()
+	transport *http.Transport
+}
+
+type remoteWigo struct {
+	name   string
+	source string
+	config AdvancedRemoteWigoConfig
+
+	// Uuid of the last wigo fetched from the remote
+	uuid  string
+	stop  chan struct{}
+	stats RemotePollStats
+
+	// The remote does not support /api/changes
+	noChanges bool
+}
+
+// Remote wigo as returned by the api, without credentials
+type RemoteWigoStatus struct {
+	Name              string
+	Hostname          string
+	Port              int
+	Group             string
+	Source            string
+	CheckInterval     int
+	CheckRemotesDepth int
+	SslEnabled        bool
+	Uuid              string
+	Stats             RemotePollStats
+}
+
+type remotesFile struct {
+	Removed      []string
+	AdvancedList []AdvancedRemoteWigoConfig
+}
+
+func NewRemotesManager(config *RemoteWigoConfig) (this *RemotesManager) {
+	this = new(RemotesManager)
+	this.config.Store(config)
+	this.file = config.RemotesFile
+	this.locker = new(sync.Mutex)
+	this.remotes = make(map[string]*remoteWigo)
+
+	// Connections to remotes are kept open between polls
+	this.transport = http.DefaultTransport.(*http.Transport).Clone()
+	this.transport.MaxIdleConnsPerHost = 2
+
+	for _, remote := range config.AdvancedList {
+		this.remotes[this.remoteName(&remote)] = this.newRemote(remote, REMOTE_SOURCE_CONFIG)
+	}
+
+	if err := this.load(); err != nil {
+		log.Printf("Remotes : %s", err)
+	}
+
+	for _, config := range config.Discovery {
+		discovery, err := NewDiscovery(config, this)
+		if err != nil {
+			log.Fatalf("Remotes : %s", err)
+		}
+		this.discovery = append(this.discovery, discovery)
+	}
+
+	return
+}
+
+// The settings of the remote wigos, replaced when the configuration is reloaded
+func (this *RemotesManager) getConfig() *RemoteWigoConfig {
+	return this.config.Load()
+}
+
+func (this *RemotesManager) SetConfig(config *RemoteWigoConfig) {
+	this.config.Store(config)
+}
+
+func (this *RemotesManager) newRemote(config AdvancedRemoteWigoConfig, source string) *remoteWigo {
+	if config.Port == 0 {
+		config.Port = GetLocalWigo().GetConfig().Http.Port
+	}
+
+	remote := new(remoteWigo)
+	remote.name = this.remoteName(&config)
+	remote.source = source
+	remote.config = config
+
+	return remote
+}
+
+func (this *RemotesManager) remoteName(config *AdvancedRemoteWigoConfig) string {
+	port := config.Port
+	if port == 0 {
+		port = GetLocalWigo().GetConfig().Http.Port
+	}
+	return net.JoinHostPort(config.Hostname, strconv.Itoa(port))
+}
+
+// Start polling every remote
+func (this *RemotesManager) Start() {
+	this.locker.Lock()
+
+	log.Println("Listing remoteWigos : ")
+
+	this.startWorkers()
+	this.started = true
+	for _, remote := range this.remotes {
+		log.Printf(" -> Adding %s to the remote check list\n", remote.name)
+		this.start(remote)
+	}
+
+	this.locker.Unlock()
+
+	for _, discovery := range this.discovery {
+		discovery.Start()
+	}
+}
+
+// Must be called with the lock held
+func (this *RemotesManager) start(remote *remoteWigo) {
+	if !this.started {
+		return
+	}
+	remote.stop = make(chan struct{})
+	go this.poll(remote)
+}
+
+// Must be called with the lock held
+func (this *RemotesManager) stop(remote *remoteWigo) {
+	if remote.stop != nil {
+		close(remote.stop)
+		remote.stop = nil
+	}
+	if remote.uuid != "" {
+		GetLocalWigo().RemoveRemoteWigo(remote.uuid)
+	}
+}
+
+// Add a remote wigo or change the settings of an existing one
+func (this *RemotesManager) Set(config AdvancedRemoteWigoConfig) (name string, err error) {
+	if config.Hostname == "" {
+		return "", errors.New("Missing remote hostname")
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return "", fmt.Errorf("Invalid port %d", config.Port)
+	}
+	if config.CheckInterval < 0 {
+		return "", fmt.Errorf("Invalid check interval %d", config.CheckInterval)
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	remote := this.newRemote(config, REMOTE_SOURCE_API)
+
+	previous, existed := this.remotes[remote.name]
+	this.remotes[remote.name] = remote
+	removed := this.removed
+	this.removed = removeString(this.removed, remote.name)
+
+	if err = this.save(); err != nil {
+		if existed {
+			this.remotes[remote.name] = previous
+		} else {
+			delete(this.remotes, remote.name)
+		}
+		this.removed = removed
+		return "", err
+	}
+
+	if existed {
+		this.stop(previous)
+	}
+	this.start(remote)
+
+	return remote.name, nil
+}
+
+// Stop polling a remote wigo and forget it
+func (this *RemotesManager) Remove(name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	remote, ok := this.remotes[name]
+	if !ok {
+		return errors.New("Unknown remote wigo " + name)
+	}
+	if strings.HasPrefix(remote.source, REMOTE_SOURCE_DISCOVERY) {
+		return errors.New("Remote wigo " + name + " is managed by " + remote.source)
+	}
+
+	delete(this.remotes, name)
+	removed := this.removed
+	if remote.source == REMOTE_SOURCE_CONFIG {
+		this.removed = append(this.removed, name)
+	}
+
+	if err = this.save(); err != nil {
+		this.remotes[name] = remote
+		this.removed = removed
+		return err
+	}
+
+	this.stop(remote)
+
+	return
+}
+
+// Replace the remotes of a discovery source. Remotes already
+// defined by the configuration file or the api are left alone.
+func (this *RemotesManager) Sync(source string, configs []AdvancedRemoteWigoConfig) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	discovered := make(map[string]*remoteWigo)
+	for _, config := range configs {
+		remote := this.newRemote(config, source)
+		discovered[remote.name] = remote
+	}
+
+	for name, remote := range this.remotes {
+		if remote.source != source {
+			continue
+		}
+		if update, ok := discovered[name]; !ok || !reflect.DeepEqual(update.config, remote.config) {
+			log.Printf("Remotes : %s removed by %s", name, source)
+			delete(this.remotes, name)
+			this.stop(remote)
+		}
+	}
+
+	for name, remote := range discovered {
+		if _, ok := this.remotes[name]; ok {
+			continue
+		}
+		log.Printf("Remotes : %s added by %s", name, source)
+		this.remotes[name] = remote
+		this.start(remote)
+	}
+}
+
+// Replace the remotes of the configuration file after it was
+// reloaded, the ones removed through the api stay removed
+func (this *RemotesManager) Reload(configs []AdvancedRemoteWigoConfig) {
+	this.locker.Lock()
+	removed := this.removed
+	this.locker.Unlock()
+
+	kept := make([]AdvancedRemoteWigoConfig, 0, len(configs))
+configs:
+	for _, config := range configs {
+		for _, name := range removed {
+			if name == this.remoteName(&config) {
+				continue configs
+			}
+		}
+		kept = append(kept, config)
+	}
+
+	this.Sync(REMOTE_SOURCE_CONFIG, kept)
+}
+
+func (this *RemotesManager) List() (list []*RemoteWigoStatus) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	list = make([]*RemoteWigoStatus, 0)
+	for _, remote := range this.remotes {
+		list = append(list, &RemoteWigoStatus{
+			Name:              remote.name,
+			Hostname:          remote.config.Hostname,
+			Port:              remote.config.Port,
+			Group:             remote.config.Group,
+			Source:            remote.source,
+			CheckInterval:     remote.config.CheckInterval,
+			CheckRemotesDepth: remote.config.CheckRemotesDepth,
+			SslEnabled:        remote.config.SslEnabled,
+			Uuid:              remote.uuid,
+			Stats:             remote.stats,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return
+}
+
+// Persistence
+
+func (this *RemotesManager) load() (err error) {
+	if _, err = os.Stat(this.file); err != nil {
+		return nil
+	}
+
+	content := new(remotesFile)
+	if _, err = toml.DecodeFile(this.file, content); err != nil {
+		return fmt.Errorf("Unable to load remotes file %s : %s", this.file, err)
+	}
+
+	for _, name := range content.Removed {
+		if remote, ok := this.remotes[name]; ok && remote.source == REMOTE_SOURCE_CONFIG {
+			delete(this.remotes, name)
+			this.removed = append(this.removed, name)
+		}
+	}
+	for _, config := range content.AdvancedList {
+		remote := this.newRemote(config, REMOTE_SOURCE_API)
+		this.remotes[remote.name] = remote
+	}
+
+	return
+}
+
+// Must be called with the lock held
+func (this *RemotesManager) save() (err error) {
+	content := new(remotesFile)
+	content.Removed = this.removed
+	for _, remote := range this.remotes {
+		if remote.source == REMOTE_SOURCE_API {
+			content.AdvancedList = append(content.AdvancedList, remote.config)
+		}
+	}
+
+	tmp := this.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to write remotes file %s : %s", tmp, err)
+	}
+
+	if err = toml.NewEncoder(f).Encode(content); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to encode remotes file : %s", err)
+	}
+	f.Close()
+
+	return os.Rename(tmp, this.file)
+}
+
+// Polling
+//
+// Every remote has a goroutine which only schedules its polls,
+// the http requests and the json decoding are done by a bounded
+// pool of workers. Unreachable remotes are polled less and less
+// often, and some jitter spreads the polls of the remotes.
+
+// Statistics about the polls of a remote wigo
+type RemotePollStats struct {
+	Polls               int64
+	Failures            int64
+	ConsecutiveFailures int
+	LastPoll            int64
+	LastSuccess         int64
+	LastLatency         float64
+	AverageLatency      float64
+	LastError           string
+	NextPoll            int64
+}
+
+// Polls statistics of the remote wigo with the given uuid
+func (this *RemotesManager) GetPollStats(uuid string) (*RemotePollStats, bool) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for _, remote := range this.remotes {
+		if remote.uuid == uuid {
+			stats := remote.stats
+			return &stats, true
+		}
+	}
+
+	return nil, false
+}
+
+func (this *RemotesManager) startWorkers() {
+	workers := this.getConfig().Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	this.jobs = make(chan func())
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range this.jobs {
+				job()
+			}
+		}()
+	}
+}
+
+// Delay before the next poll, after the given number of consecutive failures
+func (this *RemotesManager) pollDelay(remote *remoteWigo, failures int) time.Duration {
+	interval := time.Duration(this.getConfig().CheckInterval) * time.Second
+	if remote.config.CheckInterval != 0 {
+		interval = time.Duration(remote.config.CheckInterval) * time.Second
+	}
+
+	delay := interval
+	maxBackoff := time.Duration(this.getConfig().MaxBackoff) * time.Second
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff && maxBackoff > interval {
+		delay = maxBackoff
+	}
+
+	// Add up to Jitter percent of random delay
+	if jitter := int64(delay) * int64(this.getConfig().Jitter) / 100; jitter > 0 {
+		delay += time.Duration(rand.Int63n(jitter))
+	}
+
+	return delay
+}
+
+func (this *RemotesManager) newPollClient(remote *remoteWigo) (client *http.Client, url string, err error) {
+	config := remote.config
+
+	timeout := this.getConfig().Timeout
+	if config.Timeout != 0 {
+		timeout = config.Timeout
+	}
+	client = &http.Client{Timeout: time.Duration(timeout) * time.Second, Transport: this.transport}
+
+	sslEnabled := this.getConfig().SslEnabled
+	if config.SslEnabled {
+		sslEnabled = config.SslEnabled
+	}
+
+	if sslEnabled {
+		tlsConfig, err := NewRemoteTlsConfig(config, this.getConfig())
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid tls configuration : %s", err)
+		}
+
+		// Keep connections to the remote open between polls
+		transport := this.transport.Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+
+		return client, "https://" + remote.name + "/api", nil
+	}
+
+	return client, "http://" + remote.name + "/api", nil
+}
+
+func (this *RemotesManager) poll(remote *remoteWigo) {
+	stop := remote.stop
+
+	// Returns false if the remote has been removed meanwhile
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	client, url, err := this.newPollClient(remote)
+	if err != nil {
+		log.Printf("RemoteHostCheckRoutine : %s : %s", remote.name, err)
+		this.locker.Lock()
+		remote.stats.LastError = err.Error()
+		this.locker.Unlock()
+		return
+	}
+
+	// Spread the first polls of all remotes over the check interval
+	delay := time.Duration(rand.Int63n(int64(this.pollDelay(remote, 0)) + 1))
+
+	for {
+		this.locker.Lock()
+		remote.stats.NextPoll = time.Now().Add(delay).Unix()
+		this.locker.Unlock()
+
+		if !sleep(delay) {
+			return
+		}
+
+		done := make(chan error, 1)
+		select {
+		case this.jobs <- func() { done <- this.fetch(remote, client, url) }:
+		case <-stop:
+			return
+		}
+		err := <-done
+
+		this.locker.Lock()
+		remote.stats.Polls++
+		if err != nil {
+			remote.stats.Failures++
+			remote.stats.ConsecutiveFailures++
+			remote.stats.LastError = err.Error()
+		} else {
+			remote.stats.ConsecutiveFailures = 0
+			remote.stats.LastSuccess = remote.stats.LastPoll
+		}
+		failures := remote.stats.ConsecutiveFailures
+		this.locker.Unlock()
+
+		if err != nil {
+			log.Printf("Remote wigo %s : %s", remote.name, err)
+		}
+
+		delay = this.pollDelay(remote, failures)
+	}
+}
+
+// Fetch a remote wigo and send it to main. Only the changes since
+// the last poll are fetched if the remote supports it.
+func (this *RemotesManager) fetch(remote *remoteWigo, client *http.Client, url string) (err error) {
+	if !remote.noChanges {
+		wigoObj, err := this.fetchChanges(remote, client, url)
+		if err != nil {
+			return err
+		}
+		if wigoObj != nil {
+			return this.update(remote, wigoObj)
+		}
+	}
+
+	body, status, err := this.get(remote, client, url)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("Unexpected http status %d", status)
+	}
+
+	// Instanciate object from remote return
+	wigoObj, err := NewWigoFromJson(body, remote.config.CheckRemotesDepth)
+	if err != nil {
+		return fmt.Errorf("Failed to parse return : %s", err)
+	}
+
+	return this.update(remote, wigoObj)
+}
+
+// Fetch the changes since the last poll and apply them to the
+// previous state, returns nil if a full fetch is needed
+func (this *RemotesManager) fetchChanges(remote *remoteWigo, client *http.Client, url string) (*Wigo, error) {
+	this.locker.Lock()
+	uuid := remote.uuid
+	this.locker.Unlock()
+
+	tmp, ok := GetLocalWigo().RemoteWigos.Get(uuid)
+	if uuid == "" || !ok {
+		return nil, nil
+	}
+	previous := tmp.(*Wigo)
+	if previous.Epoch == "" {
+		return nil, nil
+	}
+
+	body, status, err := this.get(remote, client, fmt.Sprintf("%s/changes?since=%d&epoch=%s", url, previous.Revision, previous.Epoch))
+	if err != nil {
+		return nil, err
+	}
+	if status == 404 {
+		log.Printf("Remote wigo %s : changes are not supported, falling back to full fetch", remote.name)
+		remote.noChanges = true
+		return nil, nil
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("Unexpected http status %d", status)
+	}
+
+	changes := new(ApiChanges)
+	if err = json.Unmarshal(body, changes); err != nil {
+		return nil, fmt.Errorf("Failed to parse changes : %s", err)
+	}
+	if changes.Full || changes.Uuid != previous.Uuid {
+		return nil, nil
+	}
+
+	return previous.ApplyChanges(changes, remote.config.CheckRemotesDepth), nil
+}
+
+func (this *RemotesManager) setCredentials(remote *remoteWigo, req *http.Request) {
+	login := this.getConfig().Login
+	if remote.config.Login != "" {
+		login = remote.config.Login
+	}
+
+	password := this.getConfig().Password
+	if remote.config.Password != "" {
+		password = remote.config.Password
+	}
+
+	if login != "" && password != "" {
+		req.SetBasicAuth(login, password)
+	}
+}
+
+func (this *RemotesManager) get(remote *remoteWigo, client *http.Client, url string) (body []byte, status int, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to build get request : %s", err)
+	}
+	this.setCredentials(remote, req)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		this.locker.Lock()
+		remote.stats.LastPoll = start.Unix()
+		this.locker.Unlock()
+
+		return nil, 0, fmt.Errorf("Can't connect : %s", err)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	latency := float64(time.Since(start)) / float64(time.Millisecond)
+
+	this.locker.Lock()
+	remote.stats.LastPoll = start.Unix()
+	remote.stats.LastLatency = latency
+	if remote.stats.AverageLatency == 0 {
+		remote.stats.AverageLatency = latency
+	} else {
+		remote.stats.AverageLatency = 0.8*remote.stats.AverageLatency + 0.2*latency
+	}
+	this.locker.Unlock()
+
+	return body, resp.StatusCode, err
+}
+
+// Post to the api of the directly polled remote wigo with the given
+// uuid, like /probes/<probe>/run, and return its response
+func (this *RemotesManager) Post(uuid string, path string) (body []byte, status int, err error) {
+	var remote *remoteWigo
+
+	this.locker.Lock()
+	for _, r := range this.remotes {
+		if r.uuid == uuid {
+			remote = r
+			break
+		}
+	}
+	this.locker.Unlock()
+
+	if remote == nil {
+		return nil, 0, errRemoteNotPolled
+	}
+
+	client, url, err := this.newPollClient(remote)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Remote wigos answer on demand runs within probeRunTimeout
+	client.Timeout = remotePostTimeout
+
+	req, err := http.NewRequest("POST", url+path, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to build post request : %s", err)
+	}
+	this.setCredentials(remote, req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Can't connect : %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+// Send a fetched wigo to main, unless the remote has been removed meanwhile
+func (this *RemotesManager) update(remote *remoteWigo, wigoObj *Wigo) error {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	select {
+	case <-remote.stop:
+		return nil
+	default:
+	}
+	if remote.stop == nil {
+		return nil
+	}
+
+	remote.uuid = wigoObj.Uuid
+	if remote.config.Group != "" && wigoObj.LocalHost != nil && (wigoObj.LocalHost.Group == "" || wigoObj.LocalHost.Group == "none") {
+		wigoObj.LocalHost.Group = remote.config.Group
+	}
+	GetLocalWigo().AddOrUpdateRemoteWigo(wigoObj)
+
+	return nil
+}
+
+func removeString(list []string, str string) (result []string) {
+	for _, s := range list {
+		if s != str {
+			result = append(result, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package wigo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"time"
+)
+
+// Tls configurations of the http server and of the http client
+// used to poll remote wigos.
+//
+// When a client CA bundle is configured the http server verifies
+// client certificates. A verified certificate authenticates the
+// request if its subject common name or one of its subject
+// alternative names matches one of the ClientCerts patterns, the
+// request then gets the role and groups of the first match.
+
+// Load a pem bundle of one or more CA certificates
+func LoadCertPool(file string) (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA bundle %s : %s", file, err)
+	}
+
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No pem certificate found in CA bundle %s", file)
+	}
+
+	return
+}
+
+func NewHttpServerTlsConfig(config *HttpConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS10}
+
+	if config.SslClientCa == "" {
+		if config.SslClientCertRequired {
+			return nil, errors.New("SslClientCertRequired needs a SslClientCa bundle")
+		}
+		return
+	}
+
+	if tlsConfig.ClientCAs, err = LoadCertPool(config.SslClientCa); err != nil {
+		return nil, err
+	}
+
+	if config.SslClientCertRequired {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if err = ValidateClientCerts(config.ClientCerts); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func ValidateClientCerts(mappings []ClientCertConfig) error {
+	for _, mapping := range mappings {
+		if !IsValidRole(mapping.Role) {
+			return fmt.Errorf("Invalid role %s for client certificate pattern %s", mapping.Role, mapping.Pattern)
+		}
+		if _, err := path.Match(mapping.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid client certificate pattern %s : %s", mapping.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Tls configuration to poll a remote wigo, settings of the
+// remote override the ones of the [RemoteWigos] section
+func NewRemoteTlsConfig(remote AdvancedRemoteWigoConfig, defaults *RemoteWigoConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS10}
+
+	ca := defaults.SslCa
+	if remote.SslCa != "" {
+		ca = remote.SslCa
+	}
+
+	cert, key := defaults.SslCert, defaults.SslKey
+	if remote.SslCert != "" {
+		cert, key = remote.SslCert, remote.SslKey
+	}
+
+	if ca != "" {
+		if tlsConfig.RootCAs, err = LoadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate %s : %s", cert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return
+}
+
+// Find the user matching a verified client certificate
+func ClientCertUser(cert *x509.Certificate, mappings []ClientCertConfig) (*ApiUser, bool) {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, mapping := range mappings {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if ok, _ := path.Match(mapping.Pattern, name); ok {
+				return &ApiUser{Name: name, Role: mapping.Role, Groups: mapping.Groups}, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Verify a certificate and its intermediates, as sent in a tls handshake
+func verifyCertificateChain(certificates []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) (err error) {
+	options := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool(), KeyUsages: []x509.ExtKeyUsage{usage}}
+	for _, certificate := range certificates[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	_, err = certificates[0].Verify(options)
+	return
+}
+
+// Certificates of the configuration which must be renewed by an admin
+func configuredCertificates(config *Config) (files map[string]string) {
+	files = make(map[string]string)
+	add := func(section string, file string) {
+		if file != "" {
+			if _, ok := files[file]; !ok {
+				files[file] = section
+			}
+		}
+	}
+
+	if config.Http.Enabled && config.Http.SslEnabled {
+		add("Http", config.Http.SslCert)
+	}
+	if config.PushServer.Enabled && config.PushServer.SslEnabled {
+		add("PushServer", config.PushServer.SslCert)
+	}
+	if config.PushClient.Enabled && config.PushClient.SslEnabled {
+		add("PushClient", config.PushClient.SslCert)
+		add("PushClient", config.PushClient.SslRegistrationCert)
+		for _, target := range config.PushClient.Targets {
+			add("PushClient.Targets", target.SslCert)
+		}
+	}
+	add("RemoteWigos", config.RemoteWigos.SslCert)
+	for _, remote := range config.RemoteWigos.AdvancedList {
+		add("AdvancedList", remote.SslCert)
+	}
+	return
+}
+
+// Warn when a configured certificate expires within CertExpiryWarning days,
+// once a day until it is renewed
+func CheckCertificatesExpiry(config *Config) {
+	if config.Global.CertExpiryWarning <= 0 {
+		return
+	}
+	limit := time.Now().Add(time.Duration(config.Global.CertExpiryWarning) * 24 * time.Hour)
+
+	for file, section := range configuredCertificates(config) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil || certificate.NotAfter.After(limit) {
+				continue
+			}
+
+			var message string
+			if certificate.NotAfter.Before(time.Now()) {
+				message = fmt.Sprintf("Certificate %s (%s) of [%s] expired on %s", file, certificate.Subject.CommonName, section, certificate.NotAfter.Format("2006-01-02"))
+			} else {
+				message = fmt.Sprintf("Certificate %s (%s) of [%s] expires in %d days, on %s", file, certificate.Subject.CommonName, section,
+					int(time.Until(certificate.NotAfter).Hours()/24), certificate.NotAfter.Format("2006-01-02"))
+			}
+
+			log.Println(message)
+			LocalWigo.AddLog(LocalWigo, WARNING, message)
+			SendNotification(NewNotificationFromMessage(message))
+		}
+	}
+}
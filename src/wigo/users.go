@@ -0,0 +1,385 @@
+package wigo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Http api users and tokens. Both have a role and may be
+// restricted to some groups. Passwords and tokens are only
+// stored as bcrypt hashes in the users file, which can be
+// edited by hand or through the /api/users and /api/tokens
+// routes.
+//
+// A token is made of the token name and a random secret
+// separated by a dot, the name is used to find the hash
+// to compare the secret with.
+
+// Roles
+const (
+	VIEWER   = 1
+	OPERATOR = 2
+	ADMIN    = 3
+)
+
+var roles = map[string]int{
+	"viewer":   VIEWER,
+	"operator": OPERATOR,
+	"admin":    ADMIN,
+}
+
+// Successful bcrypt verifications are cached for a while
+// as the web interface polls the api every few seconds
+const credentialsCacheTtl = 5 * time.Minute
+
+type ApiUser struct {
+	Name   string
+	Role   string
+	Groups []string
+
+	PasswordHash string `toml:",omitempty" json:"-"`
+	TokenHash    string `toml:",omitempty" json:"-"`
+	Created      int64  `toml:",omitempty" json:",omitempty"`
+}
+
+type usersFile struct {
+	Users  []*ApiUser
+	Tokens []*ApiUser
+}
+
+type UsersStore struct {
+	file   string
+	locker *sync.RWMutex
+
+	users  map[string]*ApiUser
+	tokens map[string]*ApiUser
+
+	cache map[string]*cachedCredentials
+}
+
+type cachedCredentials struct {
+	user    *ApiUser
+	expires time.Time
+}
+
+func NewUsersStore(file string) (this *UsersStore) {
+	this = new(UsersStore)
+	this.file = file
+	this.locker = new(sync.RWMutex)
+	this.users = make(map[string]*ApiUser)
+	this.tokens = make(map[string]*ApiUser)
+	this.cache = make(map[string]*cachedCredentials)
+
+	if err := this.Load(); err != nil {
+		log.Printf("Users : %s", err)
+	}
+
+	return
+}
+
+// Role level of a user, 0 for unknown roles
+func (this *ApiUser) Level() int {
+	return roles[this.Role]
+}
+
+func (this *ApiUser) HasRole(role int) bool {
+	return this.Level() >= role
+}
+
+// A user without groups can see every group
+func (this *ApiUser) CanSeeGroup(group string) bool {
+	if len(this.Groups) == 0 {
+		return true
+	}
+	return IsStringInArray(group, this.Groups)
+}
+
+// Groups to filter on for a request on the given group, which may be empty.
+// Returns false if the user is not allowed to see the requested group.
+func (this *ApiUser) ScopeGroups(group string) ([]string, bool) {
+	if group != "" {
+		return []string{group}, this.CanSeeGroup(group)
+	}
+	return this.Groups, true
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roles[role]
+	return ok
+}
+
+// Persistence
+
+func (this *UsersStore) Load() (err error) {
+	this.locker.RLock()
+	file := this.file
+	this.locker.RUnlock()
+
+	content := new(usersFile)
+	if _, err := os.Stat(file); err == nil {
+		if _, err = toml.DecodeFile(file, content); err != nil {
+			return fmt.Errorf("Unable to load users file %s : %s", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to load users file %s : %s", file, err)
+	}
+
+	users := make(map[string]*ApiUser)
+	for _, user := range content.Users {
+		if !IsValidRole(user.Role) {
+			log.Printf("Users : ignoring user %s with invalid role %s", user.Name, user.Role)
+			continue
+		}
+		users[user.Name] = user
+	}
+
+	tokens := make(map[string]*ApiUser)
+	for _, token := range content.Tokens {
+		if !IsValidRole(token.Role) {
+			log.Printf("Users : ignoring token %s with invalid role %s", token.Name, token.Role)
+			continue
+		}
+		tokens[token.Name] = token
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.users = users
+	this.tokens = tokens
+	this.cache = make(map[string]*cachedCredentials)
+
+	return
+}
+
+// Read the users file again, it may be another file
+func (this *UsersStore) Reload(file string) error {
+	this.locker.Lock()
+	this.file = file
+	this.locker.Unlock()
+
+	return this.Load()
+}
+
+// Must be called with the lock held
+func (this *UsersStore) save() (err error) {
+	content := new(usersFile)
+	for _, user := range this.users {
+		content.Users = append(content.Users, user)
+	}
+	for _, token := range this.tokens {
+		content.Tokens = append(content.Tokens, token)
+	}
+
+	tmp := this.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to write users file %s : %s", tmp, err)
+	}
+
+	if err = toml.NewEncoder(f).Encode(content); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to encode users file : %s", err)
+	}
+	f.Close()
+
+	return os.Rename(tmp, this.file)
+}
+
+// Authentication
+
+func (this *UsersStore) IsEmpty() bool {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	return len(this.users) == 0 && len(this.tokens) == 0
+}
+
+func (this *UsersStore) AuthenticateUser(name string, password string) (*ApiUser, bool) {
+	this.locker.RLock()
+	user, ok := this.users[name]
+	this.locker.RUnlock()
+
+	if !ok || user.PasswordHash == "" {
+		return nil, false
+	}
+
+	return this.verify("user\x00"+name+"\x00"+password, user, user.PasswordHash, password)
+}
+
+func (this *UsersStore) AuthenticateToken(token string) (*ApiUser, bool) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return nil, false
+	}
+
+	this.locker.RLock()
+	user, ok := this.tokens[token[:i]]
+	this.locker.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	return this.verify("token\x00"+token, user, user.TokenHash, token[i+1:])
+}
+
+func (this *UsersStore) verify(credentials string, user *ApiUser, hash string, secret string) (*ApiUser, bool) {
+	sum := sha256.Sum256([]byte(credentials))
+	key := hex.EncodeToString(sum[:])
+
+	this.locker.RLock()
+	cached, ok := this.cache[key]
+	this.locker.RUnlock()
+
+	if ok && cached.user == user && time.Now().Before(cached.expires) {
+		return user, true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return nil, false
+	}
+
+	this.locker.Lock()
+	this.cache[key] = &cachedCredentials{user, time.Now().Add(credentialsCacheTtl)}
+	this.locker.Unlock()
+
+	return user, true
+}
+
+// Management
+
+func (this *UsersStore) ListUsers() (users []*ApiUser, tokens []*ApiUser) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	users = make([]*ApiUser, 0)
+	for _, user := range this.users {
+		users = append(users, user)
+	}
+	tokens = make([]*ApiUser, 0)
+	for _, token := range this.tokens {
+		tokens = append(tokens, token)
+	}
+
+	return
+}
+
+func (this *UsersStore) SetUser(name string, role string, groups []string, password string) (err error) {
+	if name == "" || strings.ContainsAny(name, ":.") {
+		return errors.New("Invalid user name " + name)
+	}
+	if !IsValidRole(role) {
+		return errors.New("Invalid role " + role)
+	}
+	if password == "" {
+		return errors.New("Missing password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	previous, existed := this.users[name]
+	this.users[name] = &ApiUser{Name: name, Role: role, Groups: groups, PasswordHash: string(hash), Created: time.Now().Unix()}
+	this.cache = make(map[string]*cachedCredentials)
+
+	if err = this.save(); err != nil {
+		if existed {
+			this.users[name] = previous
+		} else {
+			delete(this.users, name)
+		}
+	}
+
+	return
+}
+
+func (this *UsersStore) DeleteUser(name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	user, ok := this.users[name]
+	if !ok {
+		return errors.New("Unknown user " + name)
+	}
+	delete(this.users, name)
+	this.cache = make(map[string]*cachedCredentials)
+
+	if err = this.save(); err != nil {
+		this.users[name] = user
+	}
+
+	return
+}
+
+// Create a new api token. The token is returned only once,
+// only its hash is kept.
+func (this *UsersStore) CreateToken(name string, role string, groups []string) (token string, err error) {
+	if name == "" || strings.ContainsAny(name, ":.") {
+		return "", errors.New("Invalid token name " + name)
+	}
+	if !IsValidRole(role) {
+		return "", errors.New("Invalid role " + role)
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", err
+	}
+	token = name + "." + hex.EncodeToString(secret)
+
+	// bcrypt only uses the first 72 bytes of the secret
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if _, ok := this.tokens[name]; ok {
+		return "", errors.New("Token " + name + " already exists")
+	}
+	this.tokens[name] = &ApiUser{Name: name, Role: role, Groups: groups, TokenHash: string(hash), Created: time.Now().Unix()}
+
+	if err = this.save(); err != nil {
+		delete(this.tokens, name)
+		return "", err
+	}
+
+	return
+}
+
+func (this *UsersStore) DeleteToken(name string) (err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	token, ok := this.tokens[name]
+	if !ok {
+		return errors.New("Unknown token " + name)
+	}
+	delete(this.tokens, name)
+	this.cache = make(map[string]*cachedCredentials)
+
+	if err = this.save(); err != nil {
+		this.tokens[name] = token
+	}
+
+	return
+}
@@ -3,8 +3,13 @@ package wigo
 import (
 	"container/list"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
 )
 
 // List probes in directory
@@ -50,6 +55,71 @@ func ListProbesDirectories() ([]string, error) {
 	return subdirectories, nil
 }
 
+// Find a probe in the interval directories
+func FindProbe(name string) (probePath string, interval int, err error) {
+	directories, err := ListProbesDirectories()
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, directory := range directories {
+		probePath = path.Join(GetLocalWigo().GetConfig().Global.ProbesDirectory, directory, name)
+		if info, err := os.Stat(probePath); err == nil && !info.IsDir() {
+			if interval, err = strconv.Atoi(directory); err == nil {
+				return probePath, interval, nil
+			}
+		}
+	}
+
+	return "", 0, errors.New("Unknown probe " + name)
+}
+
+// Probes are executed by the main package, which sets the runner
+var probeRunner func(name string) (*ProbeResult, error)
+
+func SetProbeRunner(runner func(name string) (*ProbeResult, error)) {
+	probeRunner = runner
+}
+
+// A probe gave no result because it is disabled, by the api or by exit codes 12 and 13
+type ProbeDisabledError struct {
+	Message string
+}
+
+func (this *ProbeDisabledError) Error() string {
+	return this.Message
+}
+
+// On demand runs wait at most this long, the probe itself keeps its interval as timeout
+var probeRunTimeout = 30 * time.Second
+
+var errProbeStillRunning = errors.New("The probe is still running, its result will be updated when it ends")
+
+// Run a probe at once, besides its interval, and wait for its result
+func RunProbe(name string) (*ProbeResult, error) {
+	runner := probeRunner
+	if runner == nil {
+		return nil, errors.New("Probes can't be run on demand")
+	}
+
+	type run struct {
+		result *ProbeResult
+		err    error
+	}
+	done := make(chan run, 1)
+	go func() {
+		result, err := runner(name)
+		done <- run{result, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-time.After(probeRunTimeout):
+		return nil, errProbeStillRunning
+	}
+}
+
 // Misc
 func Dump(data interface{}) {
 	json, _ := json.MarshalIndent(data, "", "   ")
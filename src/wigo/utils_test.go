@@ -0,0 +1,50 @@
+package wigo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunProbe(t *testing.T) {
+	previousRunner, previousTimeout := probeRunner, probeRunTimeout
+	t.Cleanup(func() {
+		probeRunner, probeRunTimeout = previousRunner, previousTimeout
+	})
+	probeRunTimeout = 100 * time.Millisecond
+
+	disabled := &ProbeDisabledError{Message: "Probe slow is disabled by its configuration"}
+	failed := errors.New("Probe slow is not executable")
+
+	tests := []struct {
+		name     string
+		duration time.Duration
+		result   *ProbeResult
+		err      error
+		expected error
+	}{
+		{"result", 0, &ProbeResult{Name: "slow", Status: 100}, nil, nil},
+		{"disabled", 0, nil, disabled, disabled},
+		{"failed", 0, nil, failed, failed},
+		{"still running", time.Second, &ProbeResult{Name: "slow", Status: 100}, nil, errProbeStillRunning},
+	}
+
+	for _, test := range tests {
+		probeRunner = func(name string) (*ProbeResult, error) {
+			time.Sleep(test.duration)
+			return test.result, test.err
+		}
+
+		start := time.Now()
+		result, err := RunProbe("slow")
+		if err != test.expected {
+			t.Errorf("%s : expected error %v, got %v", test.name, test.expected, err)
+		}
+		if test.expected == nil && result != test.result {
+			t.Errorf("%s : expected result %v, got %v", test.name, test.result, result)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s : expected an answer within the run timeout, waited %s", test.name, elapsed)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/root-gg/wigo/src/wigo"
@@ -24,8 +30,17 @@ Usage:
 	wigocli
 	wigocli <command>
 	wigocli probe <probe>
+	wigocli probe <probe> run
+	wigocli probe enable <probe>
+	wigocli probe disable <probe> [--reason=<reason>]
 	wigocli remote <wigo>
 	wigocli remote <wigo> probe <probe>
+	wigocli remote <wigo> probe <probe> run
+	wigocli remote add <address> [--ssl] [--interval=<seconds>] [--depth=<depth>]
+	wigocli remote remove <address>
+	wigocli enrollment-token list
+	wigocli enrollment-token create <name> [--uses=<count>] [--ttl=<seconds>] [--hostname=<pattern>] [--group=<group>]
+	wigocli enrollment-token delete <name>
 
 Commands:
 	detail
@@ -33,11 +48,32 @@ Commands:
 Options
 	--help
 	--version
+
+Local probes, remote wigos and the enrollment tokens of the push server
+are managed through the api of the local wigo, set WIGO_API_TOKEN if it
+requires authentication.
 `
 
 	// Parse args
 	arguments, _ := docopt.Parse(usage, nil, true, "wigocli v0.2", false)
 
+	if arguments["add"] == true || arguments["remove"] == true {
+		manageRemote(arguments)
+		return
+	}
+	if arguments["enrollment-token"] == true {
+		manageEnrollmentTokens(arguments)
+		return
+	}
+	if arguments["enable"] == true || arguments["disable"] == true {
+		manageProbe(arguments)
+		return
+	}
+	if arguments["run"] == true {
+		runProbe(arguments)
+		return
+	}
+
 	for key, value := range arguments {
 
 		if _, ok := value.(string); ok {
@@ -111,3 +147,182 @@ Options
 		fmt.Printf(wigoObj.GenerateSummary(showOnlyErrors))
 	}
 }
+
+// Add or remove a remote wigo polled by the local wigo
+func manageRemote(arguments map[string]interface{}) {
+	address := arguments["<address>"].(string)
+
+	var req *http.Request
+	var err error
+
+	if arguments["remove"] == true {
+		req, err = http.NewRequest("DELETE", "http://127.0.0.1:4000/api/remotes/"+url.PathEscape(address), nil)
+	} else {
+		remote := wigo.AdvancedRemoteWigoConfig{Hostname: address}
+		if host, port, found := strings.Cut(address, ":"); found {
+			remote.Hostname = host
+			if remote.Port, err = strconv.Atoi(port); err != nil {
+				fmt.Printf("Invalid port %s\n", port)
+				os.Exit(1)
+			}
+		}
+		remote.SslEnabled = arguments["--ssl"] == true
+		if interval, ok := arguments["--interval"].(string); ok {
+			remote.CheckInterval, _ = strconv.Atoi(interval)
+		}
+		if depth, ok := arguments["--depth"].(string); ok {
+			remote.CheckRemotesDepth, _ = strconv.Atoi(depth)
+		}
+
+		body, _ := json.Marshal(remote)
+		req, err = http.NewRequest("POST", "http://127.0.0.1:4000/api/remotes", bytes.NewReader(body))
+	}
+	if err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+
+	callApi(req)
+	fmt.Println("OK")
+}
+
+// Enable or disable a probe of the local wigo
+func manageProbe(arguments map[string]interface{}) {
+	name := arguments["<probe>"].(string)
+
+	var req *http.Request
+	var err error
+
+	if arguments["enable"] == true {
+		req, err = http.NewRequest("POST", "http://127.0.0.1:4000/api/probes/"+url.PathEscape(name)+"/enable", nil)
+	} else {
+		reason, _ := arguments["--reason"].(string)
+		body, _ := json.Marshal(map[string]string{"Reason": reason})
+		req, err = http.NewRequest("POST", "http://127.0.0.1:4000/api/probes/"+url.PathEscape(name)+"/disable", bytes.NewReader(body))
+	}
+	if err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+
+	callApi(req)
+	fmt.Println("OK")
+}
+
+// Run a probe at once and print its fresh result
+func runProbe(arguments map[string]interface{}) {
+	path := "/probes/" + url.PathEscape(arguments["<probe>"].(string)) + "/run"
+	if host, ok := arguments["<wigo>"].(string); ok {
+		path = "/hosts/" + url.PathEscape(host) + path
+	}
+
+	req, err := http.NewRequest("POST", "http://127.0.0.1:4000/api"+path, nil)
+	if err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+
+	// The api stops waiting for probes which run too long
+	status, body := requestApi(req)
+	if status == 202 {
+		fmt.Println(strings.TrimSpace(string(body)))
+		return
+	}
+	checkApiStatus(status, body)
+
+	p := new(wigo.ProbeResult)
+	if err := json.Unmarshal(body, p); err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(p.Summary())
+}
+
+// Create, list or delete enrollment tokens of the push server
+func manageEnrollmentTokens(arguments map[string]interface{}) {
+	var req *http.Request
+	var err error
+
+	switch {
+	case arguments["list"] == true:
+		req, err = http.NewRequest("GET", "http://127.0.0.1:4000/api/authority/tokens", nil)
+	case arguments["delete"] == true:
+		req, err = http.NewRequest("DELETE", "http://127.0.0.1:4000/api/authority/tokens/"+url.PathEscape(arguments["<name>"].(string)), nil)
+	default:
+		token := map[string]interface{}{"Name": arguments["<name>"]}
+		if uses, ok := arguments["--uses"].(string); ok {
+			token["MaxUses"], _ = strconv.Atoi(uses)
+		}
+		if ttl, ok := arguments["--ttl"].(string); ok {
+			token["Ttl"], _ = strconv.Atoi(ttl)
+		}
+		if pattern, ok := arguments["--hostname"].(string); ok {
+			token["HostnamePattern"] = pattern
+		}
+		if group, ok := arguments["--group"].(string); ok {
+			token["Group"] = group
+		}
+
+		body, _ := json.Marshal(token)
+		req, err = http.NewRequest("POST", "http://127.0.0.1:4000/api/authority/tokens", bytes.NewReader(body))
+	}
+	if err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+
+	body := callApi(req)
+
+	switch {
+	case arguments["list"] == true:
+		tokens := make([]*wigo.EnrollmentToken, 0)
+		if err := json.Unmarshal(body, &tokens); err != nil {
+			fmt.Printf("Error : %s\n", err)
+			os.Exit(1)
+		}
+		for _, token := range tokens {
+			expires := "never"
+			if token.Expires != 0 {
+				expires = time.Unix(token.Expires, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tuses %d/%d\texpires %s\thostname %s\tgroup %s\n", token.Name, token.Uses, token.MaxUses, expires, token.HostnamePattern, token.Group)
+		}
+	case arguments["delete"] == true:
+		fmt.Println("OK")
+	default:
+		token := make(map[string]string)
+		json.Unmarshal(body, &token)
+		fmt.Println(token["Token"])
+	}
+}
+
+// Call the api of the local wigo, exit on errors
+func callApi(req *http.Request) []byte {
+	status, body := requestApi(req)
+	checkApiStatus(status, body)
+	return body
+}
+
+// Call the api of the local wigo, exit if it can't be reached
+func requestApi(req *http.Request) (int, []byte) {
+	if token := os.Getenv("WIGO_API_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error : %s\n", err)
+		os.Exit(1)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, body
+}
+
+func checkApiStatus(status int, body []byte) {
+	if status != 200 {
+		fmt.Printf("Error : %s\n", strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+}